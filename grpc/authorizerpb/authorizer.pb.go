@@ -0,0 +1,293 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: authorizer.proto
+
+package authorizerpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// CheckRequest describes the request to be authorized as extracted from its metadata by the gateway
+type CheckRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// backend_url is the url of the 3scale backend (apisonator) the request is authorized against
+	BackendUrl string `protobuf:"bytes,1,opt,name=backend_url,json=backendUrl,proto3" json:"backend_url,omitempty"`
+	ServiceId  string `protobuf:"bytes,2,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	// auth_type is one of "provider_key" or "service_token"
+	AuthType  string `protobuf:"bytes,3,opt,name=auth_type,json=authType,proto3" json:"auth_type,omitempty"`
+	AuthValue string `protobuf:"bytes,4,opt,name=auth_value,json=authValue,proto3" json:"auth_value,omitempty"`
+	AppId     string `protobuf:"bytes,5,opt,name=app_id,json=appId,proto3" json:"app_id,omitempty"`
+	AppKey    string `protobuf:"bytes,6,opt,name=app_key,json=appKey,proto3" json:"app_key,omitempty"`
+	UserKey   string `protobuf:"bytes,7,opt,name=user_key,json=userKey,proto3" json:"user_key,omitempty"`
+	UserId    string `protobuf:"bytes,8,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	// metrics maps metric system names to the usage to report, one hit is reported if empty
+	Metrics       map[string]int64 `protobuf:"bytes,9,rep,name=metrics,proto3" json:"metrics,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CheckRequest) Reset() {
+	*x = CheckRequest{}
+	mi := &file_authorizer_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CheckRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckRequest) ProtoMessage() {}
+
+func (x *CheckRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_authorizer_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckRequest.ProtoReflect.Descriptor instead.
+func (*CheckRequest) Descriptor() ([]byte, []int) {
+	return file_authorizer_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CheckRequest) GetBackendUrl() string {
+	if x != nil {
+		return x.BackendUrl
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetServiceId() string {
+	if x != nil {
+		return x.ServiceId
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetAuthType() string {
+	if x != nil {
+		return x.AuthType
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetAuthValue() string {
+	if x != nil {
+		return x.AuthValue
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetAppId() string {
+	if x != nil {
+		return x.AppId
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetAppKey() string {
+	if x != nil {
+		return x.AppKey
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetUserKey() string {
+	if x != nil {
+		return x.UserKey
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetMetrics() map[string]int64 {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+// CheckResponse is the outcome of the authorization
+type CheckResponse struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Allowed   bool                   `protobuf:"varint,1,opt,name=allowed,proto3" json:"allowed,omitempty"`
+	ErrorCode string                 `protobuf:"bytes,2,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	Reason    string                 `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	// headers which should be added to the response sent to the client by the gateway
+	Headers       map[string]string `protobuf:"bytes,4,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CheckResponse) Reset() {
+	*x = CheckResponse{}
+	mi := &file_authorizer_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CheckResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckResponse) ProtoMessage() {}
+
+func (x *CheckResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_authorizer_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckResponse.ProtoReflect.Descriptor instead.
+func (*CheckResponse) Descriptor() ([]byte, []int) {
+	return file_authorizer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CheckResponse) GetAllowed() bool {
+	if x != nil {
+		return x.Allowed
+	}
+	return false
+}
+
+func (x *CheckResponse) GetErrorCode() string {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ""
+}
+
+func (x *CheckResponse) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *CheckResponse) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+var File_authorizer_proto protoreflect.FileDescriptor
+
+const file_authorizer_proto_rawDesc = "" +
+	"\n" +
+	"\x10authorizer.proto\x12\x18threescale.authorizer.v1\"\xf9\x02\n" +
+	"\fCheckRequest\x12\x1f\n" +
+	"\vbackend_url\x18\x01 \x01(\tR\n" +
+	"backendUrl\x12\x1d\n" +
+	"\n" +
+	"service_id\x18\x02 \x01(\tR\tserviceId\x12\x1b\n" +
+	"\tauth_type\x18\x03 \x01(\tR\bauthType\x12\x1d\n" +
+	"\n" +
+	"auth_value\x18\x04 \x01(\tR\tauthValue\x12\x15\n" +
+	"\x06app_id\x18\x05 \x01(\tR\x05appId\x12\x17\n" +
+	"\aapp_key\x18\x06 \x01(\tR\x06appKey\x12\x19\n" +
+	"\buser_key\x18\a \x01(\tR\auserKey\x12\x17\n" +
+	"\auser_id\x18\b \x01(\tR\x06userId\x12M\n" +
+	"\ametrics\x18\t \x03(\v23.threescale.authorizer.v1.CheckRequest.MetricsEntryR\ametrics\x1a:\n" +
+	"\fMetricsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\"\xec\x01\n" +
+	"\rCheckResponse\x12\x18\n" +
+	"\aallowed\x18\x01 \x01(\bR\aallowed\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\x02 \x01(\tR\terrorCode\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\x12N\n" +
+	"\aheaders\x18\x04 \x03(\v24.threescale.authorizer.v1.CheckResponse.HeadersEntryR\aheaders\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012f\n" +
+	"\n" +
+	"Authorizer\x12X\n" +
+	"\x05Check\x12&.threescale.authorizer.v1.CheckRequest\x1a'.threescale.authorizer.v1.CheckResponseB7Z5github.com/3scale/3scale-authorizer/grpc/authorizerpbb\x06proto3"
+
+var (
+	file_authorizer_proto_rawDescOnce sync.Once
+	file_authorizer_proto_rawDescData []byte
+)
+
+func file_authorizer_proto_rawDescGZIP() []byte {
+	file_authorizer_proto_rawDescOnce.Do(func() {
+		file_authorizer_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_authorizer_proto_rawDesc), len(file_authorizer_proto_rawDesc)))
+	})
+	return file_authorizer_proto_rawDescData
+}
+
+var file_authorizer_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_authorizer_proto_goTypes = []any{
+	(*CheckRequest)(nil),  // 0: threescale.authorizer.v1.CheckRequest
+	(*CheckResponse)(nil), // 1: threescale.authorizer.v1.CheckResponse
+	nil,                   // 2: threescale.authorizer.v1.CheckRequest.MetricsEntry
+	nil,                   // 3: threescale.authorizer.v1.CheckResponse.HeadersEntry
+}
+var file_authorizer_proto_depIdxs = []int32{
+	2, // 0: threescale.authorizer.v1.CheckRequest.metrics:type_name -> threescale.authorizer.v1.CheckRequest.MetricsEntry
+	3, // 1: threescale.authorizer.v1.CheckResponse.headers:type_name -> threescale.authorizer.v1.CheckResponse.HeadersEntry
+	0, // 2: threescale.authorizer.v1.Authorizer.Check:input_type -> threescale.authorizer.v1.CheckRequest
+	1, // 3: threescale.authorizer.v1.Authorizer.Check:output_type -> threescale.authorizer.v1.CheckResponse
+	3, // [3:4] is the sub-list for method output_type
+	2, // [2:3] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_authorizer_proto_init() }
+func file_authorizer_proto_init() {
+	if File_authorizer_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_authorizer_proto_rawDesc), len(file_authorizer_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_authorizer_proto_goTypes,
+		DependencyIndexes: file_authorizer_proto_depIdxs,
+		MessageInfos:      file_authorizer_proto_msgTypes,
+	}.Build()
+	File_authorizer_proto = out.File
+	file_authorizer_proto_goTypes = nil
+	file_authorizer_proto_depIdxs = nil
+}
@@ -0,0 +1,127 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: authorizer.proto
+
+package authorizerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Authorizer_Check_FullMethodName = "/threescale.authorizer.v1.Authorizer/Check"
+)
+
+// AuthorizerClient is the client API for Authorizer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Authorizer authorizes requests against 3scale on behalf of a gateway and is intended to be run as a sidecar
+type AuthorizerClient interface {
+	// Check does an Authorize and Report request into 3scale for the described request
+	Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error)
+}
+
+type authorizerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuthorizerClient(cc grpc.ClientConnInterface) AuthorizerClient {
+	return &authorizerClient{cc}
+}
+
+func (c *authorizerClient) Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CheckResponse)
+	err := c.cc.Invoke(ctx, Authorizer_Check_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AuthorizerServer is the server API for Authorizer service.
+// All implementations must embed UnimplementedAuthorizerServer
+// for forward compatibility.
+//
+// Authorizer authorizes requests against 3scale on behalf of a gateway and is intended to be run as a sidecar
+type AuthorizerServer interface {
+	// Check does an Authorize and Report request into 3scale for the described request
+	Check(context.Context, *CheckRequest) (*CheckResponse, error)
+	mustEmbedUnimplementedAuthorizerServer()
+}
+
+// UnimplementedAuthorizerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAuthorizerServer struct{}
+
+func (UnimplementedAuthorizerServer) Check(context.Context, *CheckRequest) (*CheckResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Check not implemented")
+}
+func (UnimplementedAuthorizerServer) mustEmbedUnimplementedAuthorizerServer() {}
+func (UnimplementedAuthorizerServer) testEmbeddedByValue()                    {}
+
+// UnsafeAuthorizerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AuthorizerServer will
+// result in compilation errors.
+type UnsafeAuthorizerServer interface {
+	mustEmbedUnimplementedAuthorizerServer()
+}
+
+func RegisterAuthorizerServer(s grpc.ServiceRegistrar, srv AuthorizerServer) {
+	// If the following call panics, it indicates UnimplementedAuthorizerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Authorizer_ServiceDesc, srv)
+}
+
+func _Authorizer_Check_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthorizerServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Authorizer_Check_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthorizerServer).Check(ctx, req.(*CheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Authorizer_ServiceDesc is the grpc.ServiceDesc for Authorizer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Authorizer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "threescale.authorizer.v1.Authorizer",
+	HandlerType: (*AuthorizerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    _Authorizer_Check_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "authorizer.proto",
+}
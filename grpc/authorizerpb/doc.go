@@ -0,0 +1,4 @@
+// Package authorizerpb contains the generated protobuf and gRPC code for the Authorizer service
+package authorizerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative authorizer.proto
@@ -0,0 +1,22 @@
+module github.com/3scale/3scale-authorizer/grpc
+
+go 1.25.0
+
+require (
+	github.com/3scale/3scale-authorizer v0.0.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/3scale/3scale-go-client v0.4.1-0.20200527144043-59f1bbdf5147 // indirect
+	github.com/3scale/3scale-porta-go-client v0.0.4-0.20200617082049-6c84693ca4c0 // indirect
+	github.com/orcaman/concurrent-map v0.0.0-20190314100340-2693aad1ed75 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+	gopkg.in/oleiade/lane.v1 v1.0.0 // indirect
+)
+
+replace github.com/3scale/3scale-authorizer => ../
@@ -0,0 +1,126 @@
+// Package grpc exposes the authorizer.Manager over gRPC so that it can be run as a sidecar alongside a gateway
+// It is a separate module so that the core library does not depend on gRPC
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/grpc/authorizerpb"
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimitResetHeader is set on the CheckResponse to the number of seconds until the limits of the request reset
+const RateLimitResetHeader = "X-RateLimit-Reset"
+
+const defaultMetric = "hits"
+
+// Server implements authorizerpb.AuthorizerServer by delegating to an authorizer.Manager
+type Server struct {
+	authorizerpb.UnimplementedAuthorizerServer
+	manager *authorizer.Manager
+}
+
+// NewServer returns a Server which authorizes requests using the provided Manager
+// The caller retains ownership of the Manager and is responsible for shutting it down
+func NewServer(manager *authorizer.Manager) *Server {
+	return &Server{manager: manager}
+}
+
+// Check maps the CheckRequest to an authorizer.BackendRequest and does an AuthRep using the Manager
+// A request which 3scale denies is not an error, the response will report it as not allowed
+func (s *Server) Check(ctx context.Context, request *authorizerpb.CheckRequest) (*authorizerpb.CheckResponse, error) {
+	if request.GetBackendUrl() == "" {
+		return nil, status.Error(codes.InvalidArgument, "backend url is required")
+	}
+	if request.GetServiceId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "service id is required")
+	}
+
+	backendRequest, err := toBackendRequest(request)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp, err := s.manager.AuthRep(request.GetBackendUrl(), backendRequest)
+	if err != nil {
+		return nil, status.Error(errorCode(err), err.Error())
+	}
+
+	return toCheckResponse(resp), nil
+}
+
+func toBackendRequest(request *authorizerpb.CheckRequest) (authorizer.BackendRequest, error) {
+	metrics := make(map[string]int, len(request.GetMetrics()))
+	for name, value := range request.GetMetrics() {
+		if int64(int(value)) != value {
+			return authorizer.BackendRequest{}, fmt.Errorf("usage %d of metric %s is out of range", value, name)
+		}
+		metrics[name] = int(value)
+	}
+	if len(metrics) == 0 {
+		metrics[defaultMetric] = 1
+	}
+
+	return authorizer.BackendRequest{
+		Auth: authorizer.BackendAuth{
+			Type:  request.GetAuthType(),
+			Value: request.GetAuthValue(),
+		},
+		Service: request.GetServiceId(),
+		Transactions: []authorizer.BackendTransaction{
+			{
+				Metrics: metrics,
+				Params: authorizer.BackendParams{
+					AppID:   request.GetAppId(),
+					AppKey:  request.GetAppKey(),
+					UserID:  request.GetUserId(),
+					UserKey: request.GetUserKey(),
+				},
+			},
+		},
+	}, nil
+}
+
+func toCheckResponse(resp *authorizer.BackendResponse) *authorizerpb.CheckResponse {
+	checkResponse := &authorizerpb.CheckResponse{
+		Allowed:   resp.Authorized,
+		ErrorCode: resp.ErrorCode,
+		Reason:    resp.RejectedReason,
+		Headers:   make(map[string]string),
+	}
+
+	if !resp.LimitReset.IsZero() {
+		reset := time.Until(resp.LimitReset).Seconds()
+		if reset < 0 {
+			reset = 0
+		}
+		checkResponse.Headers[RateLimitResetHeader] = strconv.FormatInt(int64(math.Ceil(reset)), 10)
+	}
+
+	return checkResponse
+}
+
+// errorCode maps errors returned by the Manager to the gRPC code a gateway can act on
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, authorizer.ErrInvalidAuthType),
+		errors.Is(err, authorizer.ErrTooManyMetrics),
+		errors.Is(err, authorizer.ErrUnknownMetric):
+		return codes.InvalidArgument
+	case errors.Is(err, authorizer.ErrBackendThrottled):
+		return codes.ResourceExhausted
+	case errors.Is(err, authorizer.ErrShuttingDown):
+		return codes.Unavailable
+	case authorizer.IsRetryableError(err):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,212 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/grpc/authorizerpb"
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer_Check(t *testing.T) {
+	const deniedUserKey = "denied"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/transactions/authrep.xml" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			return
+		}
+		if r.URL.Query().Get("service_id") != "1" {
+			t.Errorf("unexpected service id %s", r.URL.Query().Get("service_id"))
+		}
+		if r.URL.Query().Get("user_key") == deniedUserKey {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`<status><authorized>false</authorized><reason>usage limits are exceeded</reason></status>`))
+			return
+		}
+		w.Write([]byte(`<status><authorized>true</authorized><plan>Basic</plan></status>`))
+	}))
+	defer backend.Close()
+
+	manager := authorizer.NewManager(nil, nil, authorizer.BackendConfig{}, nil)
+	defer manager.Shutdown()
+
+	client := newTestClient(t, NewServer(manager))
+
+	inputs := []struct {
+		name          string
+		request       *authorizerpb.CheckRequest
+		expectAllowed bool
+		expectReason  string
+		expectCode    codes.Code
+	}{
+		{
+			name: "Test authorized request is allowed",
+			request: &authorizerpb.CheckRequest{
+				BackendUrl: backend.URL,
+				ServiceId:  "1",
+				AuthType:   authorizer.AuthTypeServiceToken,
+				AuthValue:  "token",
+				UserKey:    "allowed",
+				Metrics:    map[string]int64{"hits": 2},
+			},
+			expectAllowed: true,
+		},
+		{
+			name: "Test request without metrics is allowed",
+			request: &authorizerpb.CheckRequest{
+				BackendUrl: backend.URL,
+				ServiceId:  "1",
+				AuthType:   authorizer.AuthTypeProviderKey,
+				AuthValue:  "key",
+				AppId:      "app",
+				AppKey:     "secret",
+			},
+			expectAllowed: true,
+		},
+		{
+			name: "Test denied request is not allowed",
+			request: &authorizerpb.CheckRequest{
+				BackendUrl: backend.URL,
+				ServiceId:  "1",
+				AuthType:   authorizer.AuthTypeServiceToken,
+				AuthValue:  "token",
+				UserKey:    deniedUserKey,
+			},
+			expectReason: "usage limits are exceeded",
+		},
+		{
+			name: "Test invalid auth type is rejected",
+			request: &authorizerpb.CheckRequest{
+				BackendUrl: backend.URL,
+				ServiceId:  "1",
+				AuthType:   "unknown",
+				AuthValue:  "token",
+				UserKey:    "allowed",
+			},
+			expectCode: codes.InvalidArgument,
+		},
+		{
+			name: "Test missing service id is rejected",
+			request: &authorizerpb.CheckRequest{
+				BackendUrl: backend.URL,
+				AuthType:   authorizer.AuthTypeServiceToken,
+				AuthValue:  "token",
+			},
+			expectCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			resp, err := client.Check(context.Background(), input.request)
+			if input.expectCode != codes.OK {
+				if status.Code(err) != input.expectCode {
+					t.Fatalf("expected code %s but got %v", input.expectCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if resp.GetAllowed() != input.expectAllowed {
+				t.Errorf("expected allowed to be %t", input.expectAllowed)
+			}
+			if resp.GetReason() != input.expectReason {
+				t.Errorf("expected reason %q but got %q", input.expectReason, resp.GetReason())
+			}
+		})
+	}
+}
+
+func TestServer_CheckAfterShutdown(t *testing.T) {
+	manager := authorizer.NewManager(nil, nil, authorizer.BackendConfig{}, nil)
+	if err := manager.Drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error draining manager %v", err)
+	}
+	manager.Shutdown()
+
+	_, err := NewServer(manager).Check(context.Background(), &authorizerpb.CheckRequest{
+		BackendUrl: "http://127.0.0.1",
+		ServiceId:  "1",
+		AuthType:   authorizer.AuthTypeServiceToken,
+		AuthValue:  "token",
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected code %s but got %v", codes.Unavailable, err)
+	}
+}
+
+func TestToCheckResponse(t *testing.T) {
+	inputs := []struct {
+		name         string
+		resp         *authorizer.BackendResponse
+		expectHeader string
+	}{
+		{
+			name: "Test no limit reset sets no header",
+			resp: &authorizer.BackendResponse{Authorized: true},
+		},
+		{
+			name:         "Test limit reset is set in seconds",
+			resp:         &authorizer.BackendResponse{Authorized: true, LimitReset: time.Now().Add(time.Minute)},
+			expectHeader: "60",
+		},
+		{
+			name:         "Test limit reset in the past is zero",
+			resp:         &authorizer.BackendResponse{ErrorCode: "limits_exceeded", LimitReset: time.Now().Add(-time.Minute)},
+			expectHeader: "0",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			resp := toCheckResponse(input.resp)
+			if resp.GetAllowed() != input.resp.Authorized || resp.GetErrorCode() != input.resp.ErrorCode {
+				t.Errorf("unexpected response %v", resp)
+			}
+			header, ok := resp.GetHeaders()[RateLimitResetHeader]
+			if input.expectHeader == "" {
+				if ok {
+					t.Errorf("expected no %s header but got %s", RateLimitResetHeader, header)
+				}
+				return
+			}
+			if header != input.expectHeader {
+				t.Errorf("expected %s header %s but got %s", RateLimitResetHeader, input.expectHeader, header)
+			}
+		})
+	}
+}
+
+func newTestClient(t *testing.T, server *Server) authorizerpb.AuthorizerClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	authorizerpb.RegisterAuthorizerServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error dialing server %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return authorizerpb.NewAuthorizerClient(conn)
+}
@@ -1,8 +1,21 @@
 package authorizer
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
@@ -10,6 +23,7 @@ import (
 	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
+	apisonator "github.com/3scale/3scale-go-client/threescale/http"
 	"github.com/3scale/3scale-porta-go-client/client"
 )
 
@@ -21,11 +35,107 @@ type Manager struct {
 	systemCache    *SystemCache
 	backendConf    BackendConfig
 	cachedBackends map[string]cachedBackend
+	// cachedBackendsLock guards cachedBackends which may be accessed by concurrent requests
+	cachedBackendsLock *sync.RWMutex
 	// stopFlush controls the background process that periodically flushes the cache
 	stopFlush       chan struct{}
 	metricsReporter *MetricsReporter
+	// ctx is cancelled on Shutdown to abort in-flight background work
+	ctx    context.Context
+	cancel context.CancelFunc
+	// backgroundTasks tracks the background processes started by the Manager
+	backgroundTasks *sync.WaitGroup
+	// backgroundLock is held for writing while Shutdown cancels ctx, such that no optional background task is
+	// added to backgroundTasks once Shutdown has begun waiting on it
+	backgroundLock *sync.RWMutex
+	// noConfigOnNotFound returns ErrNoConfigPublished when system responds with 404 for a proxy config
+	noConfigOnNotFound bool
+	// serviceIDs caches the resolution of service system names to their ID
+	serviceIDs *serviceIDCache
+	// configVersions tracks the version of each fetched proxy config to detect when a service has been changed
+	configVersions *configVersionCache
+	// configKeys maps service IDs to the system cache key of the proxy config most recently served for them
+	configKeys *serviceIDCache
+	// flushGoroutines counts the running goroutines which flush cached backends
+	flushGoroutines *int64
+	// drain tracks in-flight calls to AuthRep and rejects new calls once draining has started
+	drain *drainState
+	// overrides are consulted before 3scale and may be replaced at runtime via Reconfigure
+	overrides *credentialOverrides
+	// onRequest is called with the details of each outgoing request
+	onRequest RequestHook
+	// redactRequests redacts credentials from the details passed to onRequest
+	redactRequests bool
+	// counters are read by MetricsSnapshot
+	counters *managerCounters
+	// serverless disables all background processing, see WithServerlessMode
+	serverless bool
+	// limiter bounds the passthrough calls in flight to each backend
+	limiter *concurrencyLimiter
+	// dialContext, if set, dials the connections made to 3scale, see WithDialContext
+	dialContext DialContextFunc
+	// defaultEnvironment is used for system requests which do not set an Environment, see WithDefaultEnvironment
+	defaultEnvironment string
+	// transportStats, if set, collects statistics on the connection pool, see WithTransportStats
+	transportStats *transportStats
+	// faults, if set, injects latency and errors into calls to 3scale, see WithFaultInjection
+	faults *faultTransport
 }
 
+// ManagerOption provides optional behaviour to the Manager
+type ManagerOption func(*Manager)
+
+// SystemError is returned, wrapped, by GetSystemConfiguration when 3scale system responds with an error status
+// It can be retrieved using errors.As to branch on the status code
+type SystemError struct {
+	// StatusCode is the HTTP status returned by 3scale system
+	StatusCode int
+	// Body is the reason for the error given by 3scale system, typically the body of the response
+	Body string
+	err  error
+}
+
+func (e SystemError) Error() string {
+	return fmt.Sprintf("3scale system responded with status %d - %s", e.StatusCode, e.Body)
+}
+
+// Unwrap returns the underlying error from the porta client
+func (e SystemError) Unwrap() error {
+	return e.err
+}
+
+// ErrLockConflict is returned if 3scale system repeatedly reports a lock version conflict when fetching a proxy config
+var ErrLockConflict = errors.New("lock version conflict")
+
+// ErrTooManyMetrics is returned if a transaction reports against more metrics than allowed by
+// BackendConfig.MaxMetricsPerTransaction
+var ErrTooManyMetrics = errors.New("too many metrics")
+
+// ErrShuttingDown is returned by AuthRep for calls made once the Manager has started draining
+var ErrShuttingDown = errors.New("manager is shutting down")
+
+// ErrUnknownMetric is returned if opted in via BackendConfig.ValidateMetrics and a request reports against
+// a metric which is not known to the service
+var ErrUnknownMetric = errors.New("unknown metric")
+
+// ErrBackendThrottled is returned, wrapped, by AuthRep if the call to 3scale backend exceeded
+// BackendConfig.MaxConcurrentPassthrough and the failure policy denied the request
+var ErrBackendThrottled = errors.New("too many concurrent calls to backend")
+
+// ErrInvalidAuthType is returned, wrapped, if BackendAuth.Type is not one of AuthTypeProviderKey or AuthTypeServiceToken
+var ErrInvalidAuthType = errors.New("invalid auth type")
+
+// ErrNoConfigPublished is returned if opted in via WithNoConfigOnNotFound and 3scale system has no proxy
+// config published for the requested service and environment
+var ErrNoConfigPublished = errors.New("no proxy config published")
+
+// ErrInsufficientScope is returned, wrapped, by GetSystemConfiguration when the scopes of the access token are
+// provided in the SystemRequest and do not include AccountManagementScope, which is required to read proxy configs
+var ErrInsufficientScope = errors.New("access token has insufficient scope")
+
+// AccountManagementScope is the access token scope required to read the proxy configs and services of 3scale system
+const AccountManagementScope = "account_management"
+
 // SystemCache wraps the caching implementation and its configuration for 3scale system
 type SystemCache struct {
 	cache.ConfigurationCache
@@ -33,19 +143,102 @@ type SystemCache struct {
 	stopRefreshingTask chan struct{}
 }
 
+// CacheEntryInfo describes an entry in the system cache without exposing the cached proxy config
+type CacheEntryInfo struct {
+	Key         string
+	ServiceID   string
+	Environment string
+	Version     int
+	// Age is the time elapsed since the entry was last fetched and written to the cache
+	Age time.Duration
+	// TTLRemaining is the time left before the entry expires, zero if already expired
+	TTLRemaining time.Duration
+}
+
+// CacheFreshness describes the freshness of a proxy config in the system cache
+type CacheFreshness struct {
+	// Age is the time elapsed since the entry was last fetched and written to the cache
+	Age time.Duration
+	// TTLRemaining is the time left before the entry expires, zero if already expired
+	TTLRemaining time.Duration
+	// LastRefreshSuccess is the time at which the entry was last successfully fetched
+	LastRefreshSuccess time.Time
+	// RefreshFailures is the number of consecutive failed attempts to refresh the entry
+	RefreshFailures int
+	// Fresh is true if the entry has not expired and the last attempt to refresh it did not fail
+	Fresh bool
+}
+
+// CacheMeta describes a proxy config returned by PeekSystemConfiguration
+type CacheMeta struct {
+	CacheFreshness
+	// Expired is true once the TTL of the entry has passed, regardless of whether a refresh has been attempted
+	Expired bool
+}
+
 // SystemCacheConfig holds the configuration for the cache
 type SystemCacheConfig struct {
 	MaxSize               int
 	NumRetryFailedRefresh int
 	RefreshInterval       time.Duration
 	TTL                   time.Duration
+	// ClockSkewTolerance pads the TTL so that entries are not considered expired until TTL + tolerance has passed
+	// This provides more consistent expiry across replicas with skewed clocks at the cost of a little staleness
+	ClockSkewTolerance time.Duration
+	// TTLJitterPercent randomly shortens the TTL of each entry by up to this percentage of the TTL, spreading out
+	// the expiry of entries which were cached at the same time, for example when warming the cache on startup
+	TTLJitterPercent int
+	// RetryableError, if set, overrides IsRetryableError in deciding whether a failed refresh is retried
+	RetryableError func(error) bool
+	// RefreshBackoff, if greater than zero, backs off the background refresh of a proxy config which keeps failing to
+	// refresh, rather than refreshing it every RefreshInterval. After n consecutive failures, the config is not refreshed
+	// again until RefreshBackoff * 2^(n-1), capped at MaxRefreshBackoff if set, has passed. The cadence is reset
+	// by a successful refresh
+	RefreshBackoff    time.Duration
+	MaxRefreshBackoff time.Duration
+	// OnServiceDeleted, if set, is called when refreshing a cached proxy config finds that its service has been
+	// deleted from 3scale system, just before the config is evicted. A service is only considered deleted when system
+	// responds with 404 for its proxy config and the service is missing from the list of services, such that a
+	// transient failure never evicts a config. It is called while the cache is being refreshed and must not modify it
+	OnServiceDeleted func(systemURL, serviceID string)
 }
 
 // SystemRequest provides the required input to request the latest configuration from 3scale system
 type SystemRequest struct {
+	// AccessToken is used to fetch, and later refresh, the proxy config. Proxy configs are cached per access token,
+	// such that a cached config is only served to requests made with the token it was fetched with. In multi-tenant
+	// deployments where many tokens read the same service, one entry is cached and refreshed per token, each of which
+	// counts towards SystemCacheConfig.MaxSize
 	AccessToken string
 	ServiceID   string
+	// SystemName identifies the service by its system name and is resolved to the ServiceID if ServiceID is not set
+	SystemName string
+	// Environment is required unless the Manager was created WithDefaultEnvironment, in which case it defaults to it
 	Environment string
+	// AccessTokenScopes are the scopes of AccessToken, as found in client.AccessToken, if known
+	// When set, the token is checked for the required scope before any call is made to 3scale system
+	AccessTokenScopes []string
+}
+
+// serviceIDCache maps service system names to their ID, per 3scale system
+// It is also used to map service IDs to the system cache key of their proxy config
+type serviceIDCache struct {
+	ids map[string]string
+	sync.RWMutex
+}
+
+// drainState tracks in-flight AuthRep calls so that they can be completed before shutting down
+type drainState struct {
+	// draining is guarded by the lock so no call is added to inFlight once waiting on it has begun
+	draining bool
+	inFlight sync.WaitGroup
+	sync.RWMutex
+}
+
+// configVersionCache records the last seen proxy config version, per 3scale system, service and environment
+type configVersionCache struct {
+	versions map[string]int
+	sync.Mutex
 }
 
 type BackendConfig struct {
@@ -56,14 +249,164 @@ type BackendConfig struct {
 	CacheFlushInterval time.Duration
 	Logger             core.Logger
 	Policy             backend.FailurePolicy
+	// RetryMaxAttempts is the number of times a failed call to 3scale is retried when caching is disabled
+	// Retries are disabled by default
+	RetryMaxAttempts int
+	// RetryBaseDelay is the base of the exponential backoff between retries, defaulting to 100ms
+	// Each retry waits for a random delay between zero and min(RetryMaxDelay, RetryBaseDelay * 2^attempt)
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the backoff between retries, defaulting to 2s
+	RetryMaxDelay time.Duration
+	// FlushEveryNTransactions, if greater than zero, flushes a cached backend once this many transactions have
+	// been accumulated since the last flush, in addition to flushing every CacheFlushInterval
+	FlushEveryNTransactions int
+	// MinFlushInterval is the minimum time between the start of a flush of a cached backend and a flush requested
+	// via TriggerFlush, which has no effect if requested sooner
+	MinFlushInterval time.Duration
+	// ProbeOnCreate checks that a backend is reachable before creating a cached backend for it, such that an
+	// unreachable backend is reported immediately rather than on the first flush
+	ProbeOnCreate bool
+	// EnableKeepAlive periodically pings cached backends which have not seen any traffic
+	// during the last KeepAliveInterval, keeping a connection to apisonator warm
+	EnableKeepAlive bool
+	// KeepAliveInterval is the period at which idle cached backends are pinged
+	// Defaults to 30 seconds if not set and keep alive is enabled
+	KeepAliveInterval time.Duration
+	// SegmentCacheByUser caches counters per end user, when a user id is provided in the request, such that
+	// limits defined for end users are enforced locally. This increases the cardinality of the cache.
+	SegmentCacheByUser bool
+	// MaxMetricsPerTransaction limits the number of metrics in each transaction, rejecting requests which
+	// exceed it with ErrTooManyMetrics. Defaults to 1000 if not set. A negative value removes the limit
+	MaxMetricsPerTransaction int
+	// ValidateMetrics rejects requests which report against metrics unknown to the service with ErrUnknownMetric
+	// Known metrics are 'hits' and those referenced by the mapping rules of the services proxy config.
+	// Validation relies on the proxy config for the service being present in the system cache and is skipped otherwise
+	ValidateMetrics bool
+	// ValidateMetricsWarnOnly logs unknown metrics rather than rejecting the request when ValidateMetrics is set.
+	// Metrics which are defined but not referenced by any mapping rule are otherwise rejected
+	ValidateMetricsWarnOnly bool
+	// CredentialOverrides are consulted before 3scale and the cache, allowing specific credentials to be blocked
+	// or let through immediately. Can be updated on a running Manager via Reconfigure
+	CredentialOverrides CredentialOverrides
+	// ClassifyResponse, if set, overrides the built-in classification of responses from apisonator
+	// It is not consulted for decisions served from the cache
+	ClassifyResponse ResponseClassifier
+	// MetricAggregations configures, per metric name, how values reported to cached backends are accumulated
+	// between flushes. Metrics which are not present are summed. Only applies when caching is enabled
+	MetricAggregations map[string]backend.Aggregation
+	// WindowAlignment configures how the period windows of the usage reports returned by cached backends are aligned
+	// to the calendar, and so the time at which each limit is reported to reset via BackendResponse.LimitReset
+	// The zero value aligns windows in UTC with weeks starting on Monday, matching apisonator
+	WindowAlignment backend.WindowAlignment
+	// BackendURLRewriter, if set, is applied to the backend URL of each request before the client for it is built
+	// or looked up, such that cached backends are keyed on the rewritten URL
+	BackendURLRewriter func(string) string
+	// FlushTimeout, if greater than zero, bounds each call made to 3scale when flushing a cached backend, such that
+	// a flush to a hung backend is abandoned, rather than blocking subsequent flushes. Calls exceeding it are
+	// reported via MetricsReporter.FlushTimeoutCB. Calls made on behalf of a request are unaffected
+	FlushTimeout time.Duration
+	// BackendClientMaxAge, if greater than zero, is the age after which a cached backend, along with its client and
+	// connections, is rebuilt on its next use, such that changes to DNS or TLS configuration are picked up.
+	// The counters of the expired backend are flushed in the background once it is replaced.
+	// Cached backends never expire by default
+	BackendClientMaxAge time.Duration
+	// OnReportsDropped, if set, is called with the usage of a cached backend which is discarded without having been
+	// reported to 3scale, along with the reason, one of ReportsDroppedTimeout, ReportsDroppedOverflow or
+	// ReportsDroppedShutdown. Usage is only discarded by the final flush of a cached backend, made on Shutdown or
+	// when the backend is rebuilt, since failed periodic flushes are retried on the next flush
+	OnReportsDropped func(backendURL string, dropped []BackendTransaction, reason string)
+	// AuthorizeThenReport replaces the single, atomic, AuthRep call made to 3scale by an Authorize call followed by a
+	// Report call for authorized requests only, such that usage of denied requests is never reported. This costs an
+	// additional round trip per authorized request and, since the calls are not atomic, concurrent requests may be
+	// authorized against the same remaining usage allowing limits to be exceeded slightly. A failed Report is logged
+	// but does not fail the request. Only applies when caching is disabled, as the cache only records usage for
+	// authorized requests
+	AuthorizeThenReport bool
+	// RetryableError, if set, overrides IsRetryableError in deciding whether a failed call to 3scale is retried
+	// Only applies when RetryMaxAttempts is greater than zero
+	RetryableError func(error) bool
+	// OnDenied, if set, is called with the request, with credentials redacted, and the raw body of the response from
+	// apisonator for each request which is not authorized, to aid diagnosing unexpected denials. Setting it retains
+	// a copy of every response body, so it is intended for debugging only. It is not called for decisions served
+	// from the cache and must be safe for concurrent use
+	OnDenied func(request BackendRequest, body []byte)
+	// MaxCachedApplications, if greater than zero, limits the number of applications, including per user segments,
+	// cached by each cached backend. Once exceeded, the least recently used applications are evicted and their
+	// pending usage reported to 3scale. Evictions are reported via MetricsReporter.CacheEvictionCB
+	MaxCachedApplications int
+	// MaxConcurrentPassthrough, if greater than zero, limits the number of calls in flight to each backend when
+	// caching is disabled, such that a flood of requests for one backend cannot overwhelm it. Calls beyond the limit
+	// wait for up to PassthroughQueueTimeout, if no more than MaxQueuedPassthrough calls are already waiting.
+	// Calls which are not let through are throttled, applying the failure Policy, and reported via
+	// MetricsReporter.ThrottledCB. If Policy denies the request, or is not set, ErrBackendThrottled is returned
+	MaxConcurrentPassthrough int
+	// MaxQueuedPassthrough is the number of calls to each backend which may wait for the MaxConcurrentPassthrough
+	// limit. Calls are throttled immediately by default
+	MaxQueuedPassthrough int
+	// PassthroughQueueTimeout is the longest a call waits for the MaxConcurrentPassthrough limit before it is throttled
+	PassthroughQueueTimeout time.Duration
+}
+
+// Reasons passed to BackendConfig.OnReportsDropped
+const (
+	// ReportsDroppedTimeout indicates that a call made by the final flush exceeded BackendConfig.FlushTimeout
+	ReportsDroppedTimeout = "timeout"
+	// ReportsDroppedOverflow indicates that the flush queue was full, so the final flush did not report the usage
+	ReportsDroppedOverflow = "overflow"
+	// ReportsDroppedShutdown indicates that the final flush failed to report the usage for any other reason
+	ReportsDroppedShutdown = "shutdown"
+)
+
+// CredentialOverrides lists credentials, user keys or application ids, for which a decision is made locally
+// If a credential is present in both lists, it is denied
+type CredentialOverrides struct {
+	// Deny results in requests with these credentials being denied with error code CredentialDeniedErrorCode
+	Deny []string
+	// Allow results in requests with these credentials being authorized without calling 3scale
+	// Usage for these requests is not reported to 3scale
+	Allow []string
+}
+
+// CredentialDeniedErrorCode is set on the BackendResponse for requests denied by CredentialOverrides
+const CredentialDeniedErrorCode = "credential_denied_locally"
+
+// credentialOverrides holds the overrides currently in effect for a Manager
+type credentialOverrides struct {
+	deny  map[string]bool
+	allow map[string]bool
+	sync.RWMutex
 }
 
+// ResponseClassifier classifies a response from apisonator using its HTTP status and raw body, returning the
+// result of the authorization and whether or not the response should be treated as a transient failure.
+// A transient response returns an error to the caller rather than a denial.
+type ResponseClassifier func(status int, body []byte) (authorized bool, errorCode, reason string, transient bool)
+
+const (
+	// AuthTypeProviderKey authenticates calls to apisonator with the provider key of the account
+	AuthTypeProviderKey = string(api.ProviderKey)
+	// AuthTypeServiceToken authenticates calls to apisonator with a service token of the service
+	AuthTypeServiceToken = string(api.ServiceToken)
+)
+
 // BackendAuth contains client authorization credentials for apisonator
+// Type must be one of AuthTypeProviderKey or AuthTypeServiceToken
 type BackendAuth struct {
 	Type  string
 	Value string
 }
 
+// ProviderKeyAuth returns a BackendAuth for the provider key of an account, which is valid for any of its services
+func ProviderKeyAuth(key string) BackendAuth {
+	return BackendAuth{Type: AuthTypeProviderKey, Value: key}
+}
+
+// ServiceTokenAuth returns a BackendAuth for a service token, which is only valid for the service it belongs to
+// Requests using a service token must set BackendRequest.Service
+func ServiceTokenAuth(token string) BackendAuth {
+	return BackendAuth{Type: AuthTypeServiceToken, Value: token}
+}
+
 // BackendRequest contains the data required to make an Auth/AuthRep request to apisonator
 type BackendRequest struct {
 	Auth         BackendAuth
@@ -78,6 +421,11 @@ type BackendResponse struct {
 	// RejectedReason should* be set in cases where Authorized is false
 	RejectedReason string
 	RawResponse    interface{}
+	// LimitReset is the time at which the most constrained usage limit resets, that is the limit with the least
+	// remaining usage, for example to set an 'X-RateLimit-Reset' header. Zero when no usage limits are known
+	LimitReset time.Time
+	// limitReset is the earliest time at which one of the reported usage limits resets, zero when unknown
+	limitReset time.Time
 }
 
 // BackendTransaction contains the metrics and end user auth required to make an Auth/AuthRep request to apisonator
@@ -97,8 +445,45 @@ type BackendParams struct {
 type cachedBackend struct {
 	backend   *backend.Backend
 	stopFlush chan struct{}
+	// lastSeen stores the unix nano timestamp of the last request handled by this backend
+	lastSeen *int64
+	// flushNow requests a flush ahead of the next periodic flush
+	flushNow chan struct{}
+	// flushTriggered requests a flush for which the gate has already been claimed by TriggerFlush
+	flushTriggered chan struct{}
+	// gate tracks whether a flush is running and when the last flush started
+	gate *flushGate
+	// flushes observes the calls made to 3scale when flushing
+	flushes *flushObservingClient
+	// createdAt is used to rebuild the backend once it is older than BackendConfig.BackendClientMaxAge
+	createdAt time.Time
+	// retire stops the flushing process of a backend which has been replaced, after a final flush
+	retire chan struct{}
 }
 
+const (
+	defaultKeepAliveInterval = time.Second * 30
+	backendStatusEndpoint    = "/status"
+	// defaultMetric is defined for every service by 3scale
+	defaultMetric = "hits"
+	// maxSystemURLKeyLength is the length above which system urls are hashed when generating system cache keys
+	maxSystemURLKeyLength = 128
+
+	defaultMaxMetricsPerTransaction = 1000
+	// defaultMaxBatchConcurrency bounds the number of services authorized concurrently by AuthRepBatch
+	defaultMaxBatchConcurrency = 8
+
+	defaultRetryBaseDelay = time.Millisecond * 100
+	defaultRetryMaxDelay  = time.Second * 2
+)
+
+// sleep and randInt63n can be replaced in tests to control retry backoff and timeNow to control the age of cached backends
+var (
+	sleep      = time.Sleep
+	randInt63n = rand.Int63n
+	timeNow    = time.Now
+)
+
 // NewManager returns an instance of Manager
 // Starts refreshing background process for underlying system cache if provided
 func NewManager(
@@ -106,53 +491,185 @@ func NewManager(
 	systemCache *SystemCache,
 	backendConfig BackendConfig,
 	reporter *MetricsReporter,
+	opts ...ManagerOption,
 ) *Manager {
 
-	builder := ClientBuilder{httpClient: http.DefaultClient}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	builder := ClientBuilder{httpClient: client}
 
 	if reporter == nil {
 		reporter = &MetricsReporter{}
 	}
 
+	if backendConfig.Logger == nil {
+		backendConfig.Logger = &core.NoOpLogger{}
+	}
+
 	if reporter.ReportMetrics && reporter.ResponseCB != nil {
-		builder.httpClient.Transport = &MetricsTransport{client: builder.httpClient}
+		builder.httpClient = withTransport(builder.httpClient, func(next http.RoundTripper) http.RoundTripper {
+			return &MetricsTransport{next: next, hook: reporter.ResponseCB}
+		})
 	}
 
-	if systemCache != nil {
-		go func() {
+	if backendConfig.ClassifyResponse != nil || backendConfig.OnDenied != nil {
+		// the body is consumed by the 3scale client so we must retain a copy for the classifier and denial hook
+		builder.httpClient = withTransport(builder.httpClient, func(next http.RoundTripper) http.RoundTripper {
+			return &bodyCapturingTransport{next: next}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		clientBuilder:   builder,
+		systemCache:     systemCache,
+		backendConf:     backendConfig,
+		stopFlush:       make(chan struct{}),
+		metricsReporter: reporter,
+		ctx:             ctx,
+		cancel:          cancel,
+		backgroundTasks: &sync.WaitGroup{},
+		backgroundLock:  &sync.RWMutex{},
+		serviceIDs:      &serviceIDCache{ids: make(map[string]string)},
+		configVersions:  &configVersionCache{versions: make(map[string]int)},
+		configKeys:      &serviceIDCache{ids: make(map[string]string)},
+		drain:           &drainState{},
+		flushGoroutines: new(int64),
+		overrides:       &credentialOverrides{},
+		counters:        &managerCounters{},
+		limiter:         newConcurrencyLimiter(),
+	}
+	m.overrides.set(backendConfig.CredentialOverrides)
+
+	if backendConfig.EnableCaching {
+		m.cachedBackends = make(map[string]cachedBackend)
+		m.cachedBackendsLock = &sync.RWMutex{}
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.dialContext != nil {
+		httpClient, err := withDialContext(builder.httpClient, m.dialContext)
+		if err != nil {
+			backendConfig.Logger.Errorf("unable to apply custom dialer, using the default - %s", err.Error())
+		} else {
+			builder.httpClient = httpClient
+			m.clientBuilder = builder
+		}
+	}
+
+	if m.transportStats != nil {
+		httpClient, err := withTransportStats(builder.httpClient, m.transportStats)
+		if err != nil {
+			backendConfig.Logger.Errorf("unable to count open connections - %s", err.Error())
+		}
+		builder.httpClient = httpClient
+		m.clientBuilder = builder
+	}
+
+	if m.faults != nil {
+		faults := *m.faults
+		builder.httpClient = withTransport(builder.httpClient, func(next http.RoundTripper) http.RoundTripper {
+			faults.next = next
+			return &faults
+		})
+		m.clientBuilder = builder
+	}
+
+	if m.onRequest != nil {
+		builder.httpClient = withTransport(builder.httpClient, func(next http.RoundTripper) http.RoundTripper {
+			return &requestObserverTransport{next: next, hook: m.onRequest, redact: m.redactRequests}
+		})
+		m.clientBuilder = builder
+	}
+
+	if systemCache != nil && !m.serverless {
+		m.runInBackground(func() {
 			ticker := time.NewTicker(systemCache.RefreshInterval)
+			defer ticker.Stop()
 			for {
 				select {
 				case <-ticker.C:
 					systemCache.Refresh()
 				case <-systemCache.stopRefreshingTask:
-					ticker.Stop()
+					return
+				case <-ctx.Done():
 					return
 				}
 			}
-		}()
+		})
+	}
+
+	return m
+}
 
+// WithNoConfigOnNotFound results in a 404 response from 3scale system, when fetching the proxy config,
+// being treated as a valid state in which no config has been published yet, rather than a generic failure
+// In such cases, GetSystemConfiguration returns an error which can be checked with errors.Is(err, ErrNoConfigPublished)
+func WithNoConfigOnNotFound() ManagerOption {
+	return func(m *Manager) {
+		m.noConfigOnNotFound = true
 	}
+}
 
-	m := &Manager{
-		clientBuilder:   builder,
-		systemCache:     systemCache,
-		backendConf:     backendConfig,
-		stopFlush:       make(chan struct{}),
-		metricsReporter: reporter,
+// WithServerlessMode results in the Manager starting no background goroutines, for environments such as serverless
+// functions where the process is frozen between invocations. Expired proxy configs in the system cache are refreshed
+// inline by GetSystemConfiguration rather than by a background process, with the expired config served if the
+// refresh fails. Calls to AuthRep are always passed through to 3scale, regardless of BackendConfig.EnableCaching,
+// since cached usage can only be reported by a background flush. As such, the benefits of caching are reduced to
+// the system cache only
+func WithServerlessMode() ManagerOption {
+	return func(m *Manager) {
+		m.serverless = true
+	}
+}
+
+// WithDefaultEnvironment sets the environment, for example "production", for which proxy configs are fetched
+// when SystemRequest.Environment is empty. An Environment set on the request always takes precedence
+func WithDefaultEnvironment(environment string) ManagerOption {
+	return func(m *Manager) {
+		m.defaultEnvironment = environment
 	}
+}
 
-	if backendConfig.EnableCaching {
-		m.cachedBackends = make(map[string]cachedBackend)
+// WithDialContext sets the function used to dial the connections made to 3scale, system and backend, for example to
+// route them through a bastion or resolve addresses with a custom resolver. It replaces the DialContext of the
+// *http.Transport at the base of the http client provided to NewManager, which must not be replaced by a custom
+// http.RoundTripper. Backends listening on a Unix domain socket are always dialed directly
+func WithDialContext(dial DialContextFunc) ManagerOption {
+	return func(m *Manager) {
+		m.dialContext = dial
 	}
+}
 
-	return m
+// WithRequestObserver calls the provided hook with the method, URL and parameters of each outgoing request to 3scale,
+// system and backend, just before it is sent. Credentials are redacted from the URL and parameters.
+func WithRequestObserver(hook RequestHook) ManagerOption {
+	return func(m *Manager) {
+		m.onRequest = hook
+		m.redactRequests = true
+	}
+}
+
+// WithUnredactedRequestObserver behaves as WithRequestObserver but does not redact credentials
+// It should only be used for debugging in trusted environments
+func WithUnredactedRequestObserver(hook RequestHook) ManagerOption {
+	return func(m *Manager) {
+		m.onRequest = hook
+		m.redactRequests = false
+	}
 }
 
 // NewSystemCache returns a system cache configured with an in-memory caching implementation
 // and sets some sensible defaults if zero values have been provided for the config
 func NewSystemCache(config SystemCacheConfig, stopRefreshing chan struct{}) *SystemCache {
-	c := cache.NewConfigCache(config.TTL, config.MaxSize)
+	c := cache.NewConfigCache(config.TTL, config.MaxSize).
+		SetClockSkewTolerance(config.ClockSkewTolerance).
+		SetTTLJitter(config.TTLJitterPercent).
+		SetRefreshBackoff(config.RefreshBackoff, config.MaxRefreshBackoff)
 
 	if config.RefreshInterval == time.Duration(0) {
 		config.RefreshInterval = cache.DefaultCacheRefreshInterval
@@ -169,15 +686,59 @@ func NewSystemCache(config SystemCacheConfig, stopRefreshing chan struct{}) *Sys
 	}
 }
 
+// Entries returns a snapshot of metadata for each entry currently stored in the cache
+// Entries which are evicted while the snapshot is being taken are omitted
+func (c *SystemCache) Entries() []CacheEntryInfo {
+	var entries []CacheEntryInfo
+	if c == nil || c.ConfigurationCache == nil {
+		return entries
+	}
+
+	now := time.Now()
+	for _, key := range c.Keys() {
+		value, ok := c.Get(key)
+		if !ok {
+			continue
+		}
+
+		ttlRemaining := value.Expiry().Sub(now)
+		if ttlRemaining < 0 {
+			ttlRemaining = 0
+		}
+
+		entries = append(entries, CacheEntryInfo{
+			Key:          key,
+			ServiceID:    strconv.FormatInt(value.Item.Content.ID, 10),
+			Environment:  value.Item.Environment,
+			Version:      value.Item.Version,
+			Age:          now.Sub(value.CachedAt()),
+			TTLRemaining: ttlRemaining,
+		})
+	}
+	return entries
+}
+
 // GetSystemConfiguration returns the configuration from 3scale system which can be used to fulfill and Auth request
 func (m Manager) GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
 	var config client.ProxyConfig
 	var err error
 
+	request = m.withDefaultEnvironment(request)
 	if err = validateSystemRequest(request); err != nil {
 		return config, err
 	}
 
+	if err = validateAccessTokenScopes(request.AccessTokenScopes); err != nil {
+		return config, fmt.Errorf("cannot get 3scale system config - %w", err)
+	}
+
+	if request.ServiceID == "" {
+		request.ServiceID, err = m.resolveServiceID(systemURL, request)
+		if err != nil {
+			return config, fmt.Errorf("cannot get 3scale system config - %w", err)
+		}
+	}
+
 	if m.systemCache != nil && m.systemCache.ConfigurationCache != nil {
 		config, err = m.fetchSystemConfigFromCache(systemURL, request)
 
@@ -186,176 +747,1431 @@ func (m Manager) GetSystemConfiguration(systemURL string, request SystemRequest)
 	}
 
 	if err != nil {
-		return config, fmt.Errorf("cannot get 3scale system config - %s", err.Error())
+		return config, fmt.Errorf("cannot get 3scale system config - %w", err)
 	}
 
 	return config, nil
 }
 
-// Shutdown stops running background process
-func (m Manager) Shutdown() {
-	close(m.stopFlush)
-	close(m.systemCache.stopRefreshingTask)
-}
+// SystemConfigFreshness reports on the freshness of the cached proxy config for the service and environment
+// It does not fetch the config or report a cache hit. Returns false if the config is not present in the cache
+// Proxy configs are cached per access token, so where the service is cached for more than one access token,
+// the freshness of the most recently cached proxy config is reported
+func (m Manager) SystemConfigFreshness(systemURL, serviceID, environment string) (CacheFreshness, bool) {
+	var freshness CacheFreshness
+	if m.systemCache == nil || m.systemCache.ConfigurationCache == nil {
+		return freshness, false
+	}
 
-// AuthRep does a Authorize and Report request into 3scale apisonator
-func (m Manager) AuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
-	if !m.backendConf.EnableCaching {
-		return m.passthroughAuthRep(backendURL, request)
+	var latest cache.Value
+	var found bool
+	for _, key := range m.systemConfigCacheKeys(systemURL, serviceID) {
+		value, ok := m.systemCache.Get(key)
+		if !ok || value.Item.Environment != environment {
+			continue
+		}
+		if !found || value.CachedAt().After(latest.CachedAt()) {
+			latest, found = value, true
+		}
 	}
 
-	return m.cachedAuthRep(backendURL, request)
+	if !found {
+		return freshness, false
+	}
+	return freshnessOf(latest, time.Now()), true
 }
 
-func (m Manager) passthroughAuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
-	client, err := m.clientBuilder.BuildBackendClient(backendURL)
-	if err != nil {
-		return nil, fmt.Errorf("unable to build required client for 3scale backend - %s", err.Error())
+// systemConfigFreshness reports on the freshness of the proxy config cached for the request
+func (m Manager) systemConfigFreshness(systemURL string, request SystemRequest) (CacheFreshness, bool) {
+	if m.systemCache == nil || m.systemCache.ConfigurationCache == nil {
+		return CacheFreshness{}, false
 	}
 
-	return m.authRep(client, request)
+	value, ok := m.systemCache.Get(generateSystemConfigCacheKey(systemURL, request.ServiceID, request.AccessToken))
+	if !ok || value.Item.Environment != request.Environment {
+		return CacheFreshness{}, false
+	}
+	return freshnessOf(value, time.Now()), true
 }
 
-func (m Manager) cachedAuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
-	var cb cachedBackend
-	var err error
-	cb, knownBackend := m.cachedBackends[backendURL]
-	if !knownBackend {
-		// try to create a cache if we haven't seen this backend before
-		cb, err = m.newCachedBackend(backendURL)
-		if err != nil {
-			//todo(pgough) - add logging when we accept a logger
-			return m.passthroughAuthRep(backendURL, request)
+// systemConfigCacheKeys returns the keys of the proxy configs cached for the service, one per access token
+func (m Manager) systemConfigCacheKeys(systemURL, serviceID string) []string {
+	prefix := generateSystemCacheKey(systemURL, serviceID) + "#"
+	var keys []string
+	for _, key := range m.systemCache.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
 		}
-		m.cachedBackends[backendURL] = cb
 	}
-
-	return m.authRep(cb.backend, request)
+	return keys
 }
 
-func (m Manager) authRep(client threescale.Client, request BackendRequest) (*BackendResponse, error) {
-	req, err := request.ToAPIRequest()
-	if err != nil {
-		return nil, fmt.Errorf("unable to build request to 3scale - %s", err)
+// PeekSystemConfiguration returns the proxy config cached for the request, even if it has expired, along with
+// metadata describing its staleness. It never fetches or refreshes the config, leaving it to the caller to decide
+// whether to do so, for example by calling GetSystemConfiguration or InvalidateSystemConfiguration.
+// A SystemName is only resolved if it has been resolved previously. Returns false if no config is cached
+func (m Manager) PeekSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, CacheMeta, bool) {
+	var meta CacheMeta
+	if m.systemCache == nil || m.systemCache.ConfigurationCache == nil {
+		return client.ProxyConfig{}, meta, false
 	}
 
-	res, err := client.AuthRep(*req)
-	if err != nil {
-		var rawResponse interface{}
-		if res != nil {
-			rawResponse = res.RawResponse
+	request = m.withDefaultEnvironment(request)
+	if request.ServiceID == "" {
+		var resolved bool
+		if request.ServiceID, resolved = m.serviceIDs.get(generateSystemCacheKey(systemURL, request.SystemName)); !resolved {
+			return client.ProxyConfig{}, meta, false
 		}
-		return &BackendResponse{
-			Authorized:  false,
-			RawResponse: rawResponse,
-		}, fmt.Errorf("error calling AuthRep - %s", err)
 	}
 
-	return &BackendResponse{
-		Authorized:     res.Authorized,
-		ErrorCode:      res.ErrorCode,
-		RejectedReason: res.RejectionReason,
-		RawResponse:    res.RawResponse,
-	}, nil
+	value, ok := m.systemCache.Get(generateSystemConfigCacheKey(systemURL, request.ServiceID, request.AccessToken))
+	if !ok || value.Item.Environment != request.Environment {
+		return client.ProxyConfig{}, meta, false
+	}
+
+	meta.CacheFreshness = freshnessOf(value, time.Now())
+	meta.Expired = value.Expired()
+	return value.Item, meta, true
 }
 
-// newCachedBackend creates a new backend and start the flushing process in the background
-func (m Manager) newCachedBackend(url string) (cachedBackend, error) {
-	httpClient := http.DefaultClient
-	if cb, ok := m.clientBuilder.(*ClientBuilder); ok {
-		httpClient = cb.httpClient
+// freshnessOf describes the freshness of the cached value at the provided time
+func freshnessOf(value cache.Value, now time.Time) CacheFreshness {
+	var freshness CacheFreshness
+	freshness.Age = now.Sub(value.CachedAt())
+	if ttlRemaining := value.Expiry().Sub(now); ttlRemaining > 0 {
+		freshness.TTLRemaining = ttlRemaining
 	}
-	backend, err := backend.NewBackend(url, httpClient, m.backendConf.Logger, m.backendConf.Policy)
-	if err != nil {
-		return cachedBackend{}, err
+	freshness.LastRefreshSuccess = value.CachedAt()
+	freshness.RefreshFailures = value.RefreshFailures()
+	freshness.Fresh = !value.Expired() && freshness.RefreshFailures == 0
+	return freshness
+}
+
+// InvalidateSystemConfiguration removes the cached configuration for the provided request, if any,
+// resulting in the next call to GetSystemConfiguration fetching it from 3scale system
+func (m Manager) InvalidateSystemConfiguration(systemURL string, request SystemRequest) {
+	if m.systemCache == nil || m.systemCache.ConfigurationCache == nil {
+		return
 	}
 
-	ticker := time.NewTicker(m.backendConf.CacheFlushInterval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				backend.Flush()
-			case <-m.stopFlush:
-				// allows us to drain the cache before shutting down
-				backend.Flush()
-				ticker.Stop()
-				return
-			}
+	if request.ServiceID == "" {
+		// only invalidate where we have previously resolved the system name, there is nothing cached otherwise
+		request.ServiceID, _ = m.serviceIDs.get(generateSystemCacheKey(systemURL, request.SystemName))
+	}
+	// the config is published for the service rather than the access token, so remove it for every access token
+	for _, key := range m.systemConfigCacheKeys(systemURL, request.ServiceID) {
+		m.systemCache.Delete(key)
+	}
+}
 
-		}
+// Drain stops accepting new calls to AuthRep, which fail with ErrShuttingDown, and blocks until in-flight calls
+// have completed and all cached backends have been flushed. It returns an error if the context expires first,
+// in which case in-flight calls and flushes continue in the background. Shutdown should be called once drained
+func (m Manager) Drain(ctx context.Context) error {
+	if m.drain == nil {
+		return nil
+	}
+
+	m.drain.Lock()
+	m.drain.draining = true
+	m.drain.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		m.drain.inFlight.Wait()
+		m.flushCachedBackends()
 	}()
-	m.backendConf.Logger.Infof("created new cached backend for %s", url)
-	return cachedBackend{
-		backend:   backend,
-		stopFlush: m.stopFlush,
-	}, nil
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("unable to drain manager - %w", ctx.Err())
+	}
 }
 
-func (m Manager) fetchSystemConfigFromCache(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
-	var config client.ProxyConfig
-	var err error
+// flushCachedBackends flushes each cached backend, blocking until complete
+func (m Manager) flushCachedBackends() {
+	for _, b := range m.snapshotCachedBackends() {
+		b.Flush()
+	}
+}
 
-	cacheKey := generateSystemCacheKey(systemURL, request.ServiceID)
-	cachedValue, found := m.systemCache.Get(cacheKey)
-	if !found {
-		config, err = m.fetchSystemConfigRemotely(systemURL, request)
-		if err != nil {
-			return config, err
-		}
+// snapshotCachedBackends returns the cached backends which currently exist, if caching is enabled
+func (m Manager) snapshotCachedBackends() []*backend.Backend {
+	if m.cachedBackendsLock == nil {
+		return nil
+	}
 
-		itemToCache := &cache.Value{Item: config}
-		itemToCache = m.setValueFromConfig(systemURL, request, itemToCache)
-		m.systemCache.Set(cacheKey, *itemToCache)
+	m.cachedBackendsLock.RLock()
+	defer m.cachedBackendsLock.RUnlock()
+	backends := make([]*backend.Backend, 0, len(m.cachedBackends))
+	for _, cb := range m.cachedBackends {
+		backends = append(backends, cb.backend)
+	}
+	return backends
+}
 
-	} else {
-		config = cachedValue.Item
-		if m.metricsReporter.CacheHitCB != nil {
-			m.metricsReporter.CacheHitCB(System)
-		}
+// ActiveFlushGoroutines returns the number of goroutines currently running to flush cached backends
+// Each cached backend runs a single long-lived goroutine, plus one per flush in progress, all of which exit on Shutdown
+func (m Manager) ActiveFlushGoroutines() int {
+	if m.flushGoroutines == nil {
+		return 0
 	}
+	return int(atomic.LoadInt64(m.flushGoroutines))
+}
 
-	return config, err
+// Shutdown stops running background processes and blocks until they have exited
+// Any in-flight refresh of the system cache is cancelled, while cached backends are flushed before exiting
+func (m Manager) Shutdown() {
+	close(m.stopFlush)
+	if m.backgroundLock != nil {
+		m.backgroundLock.Lock()
+	}
+	if m.cancel != nil {
+		m.cancel()
+	}
+	if m.backgroundLock != nil {
+		m.backgroundLock.Unlock()
+	}
+	if m.systemCache != nil && m.systemCache.stopRefreshingTask != nil {
+		close(m.systemCache.stopRefreshingTask)
+	}
+	if m.backgroundTasks != nil {
+		m.backgroundTasks.Wait()
+	}
 }
 
-func (m Manager) fetchSystemConfigRemotely(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
-	var config client.ProxyConfig
+// AuthRep does a Authorize and Report request into 3scale apisonator
+// Returns ErrShuttingDown once the Manager has started draining
+func (m Manager) AuthRep(backendURL string, request BackendRequest) (resp *BackendResponse, err error) {
+	if !m.drain.begin() {
+		return nil, ErrShuttingDown
+	}
+	defer m.drain.done()
+	defer func() {
+		m.counters.observeResponse(resp, err)
+		m.metricsReporter.observeDecision(request.Service, resp, err)
+	}()
 
-	systemClient, err := m.clientBuilder.BuildSystemClient(systemURL, request.AccessToken)
-	if err != nil {
-		return config, fmt.Errorf("unable to build system client for %s - %s", systemURL, err.Error())
+	if err := validateAuthType(request.Auth.Type); err != nil {
+		return nil, err
 	}
 
-	proxyConfElement, err := systemClient.GetLatestProxyConfig(request.ServiceID, request.Environment)
-	if err != nil {
-		return config, fmt.Errorf("unable to fetch required data from 3scale system - %s", err.Error())
+	if resp, ok := m.overrides.decide(request); ok {
+		return resp, nil
 	}
 
-	return proxyConfElement.ProxyConfig, nil
-}
+	if err := m.validateMetricsCount(request); err != nil {
+		return nil, err
+	}
 
-func (m Manager) refreshCallback(systemURL string, request SystemRequest, retryAttempts int) func() (client.ProxyConfig, error) {
-	return func() (client.ProxyConfig, error) {
-		config, err := m.fetchSystemConfigRemotely(systemURL, request)
-		if err != nil {
-			if retryAttempts > 0 {
-				retryAttempts--
-				return m.refreshCallback(systemURL, request, retryAttempts)()
-			}
+	if m.backendConf.ValidateMetrics {
+		if err := m.validateMetrics(request); err != nil {
+			return nil, err
 		}
-		return config, err
 	}
+
+	if rewrite := m.backendConf.BackendURLRewriter; rewrite != nil {
+		backendURL = rewrite(backendURL)
+	}
+
+	if !m.backendConf.EnableCaching || m.serverless {
+		return m.passthroughAuthRep(backendURL, request)
+	}
+
+	return m.cachedAuthRep(backendURL, request)
 }
 
-func (m Manager) setValueFromConfig(systemURL string, request SystemRequest, value *cache.Value) *cache.Value {
-	value.SetRefreshCallback(m.refreshCallback(systemURL, request, m.systemCache.NumRetryFailedRefresh))
-	return value
+// Reconfigure applies the subset of the provided config which can be updated on a running Manager
+// Currently this is limited to the CredentialOverrides, all other fields are ignored
+func (m Manager) Reconfigure(config BackendConfig) {
+	m.overrides.set(config.CredentialOverrides)
 }
 
-// ToAPIRequest transforms the BackendRequest into a request that is acceptable for the 3scale Client interface
-func (request BackendRequest) ToAPIRequest() (*threescale.Request, error) {
-	if request.Transactions == nil || len(request.Transactions) < 1 {
-		return nil, fmt.Errorf("cannot process emtpy transaction")
+// AuthRepBatch does an Authorize and Report request into 3scale apisonator for each of the provided requests
+// Apisonator authorizes a single transaction per call and has no batch endpoint for authrep, so one call is still
+// made per request. Requests are grouped by service, the requests of each service are made in order and services
+// are authorized concurrently, bounded by BackendConfig.MaxConcurrentPassthrough if set or
+// eight services otherwise. The returned responses are aligned to the order of the provided requests.
+// The batch is not atomic - each request is authorized and reported independently of the others, so a denial or
+// failure of one request has no effect on the rest and usage reported for authorized requests is never rolled back.
+// If any of the requests fail, an error listing the failures is returned alongside the responses.
+func (m Manager) AuthRepBatch(backendURL string, requests []BackendRequest) ([]*BackendResponse, error) {
+	responses := make([]*BackendResponse, len(requests))
+	errs := make([]error, len(requests))
+
+	var services []string
+	groups := make(map[string][]int)
+	for index, request := range requests {
+		if _, seen := groups[request.Service]; !seen {
+			services = append(services, request.Service)
+		}
+		groups[request.Service] = append(groups[request.Service], index)
+	}
+
+	workers := defaultMaxBatchConcurrency
+	if m.backendConf.MaxConcurrentPassthrough > 0 {
+		workers = m.backendConf.MaxConcurrentPassthrough
+	}
+	if workers > len(services) {
+		workers = len(services)
+	}
+
+	pending := make(chan []int, len(services))
+	for _, service := range services {
+		pending <- groups[service]
+	}
+	close(pending)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range pending {
+				for _, index := range group {
+					responses[index], errs[index] = m.AuthRep(backendURL, requests[index])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failures []string
+	for index, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("request %d: %s", index, err.Error()))
+		}
+	}
+
+	if len(failures) > 0 {
+		return responses, fmt.Errorf("%d of %d batched requests failed - %s", len(failures), len(requests), strings.Join(failures, ", "))
+	}
+
+	return responses, nil
+}
+
+func (m Manager) passthroughAuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
+	client, err := m.clientBuilder.BuildBackendClient(backendURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build required client for 3scale backend - %s", err.Error())
+	}
+	client = observeLatency(client, backendURL, m.metricsReporter)
+	if m.backendConf.AuthorizeThenReport {
+		client = &authorizeThenReportClient{Client: client, logger: m.backendConf.Logger}
+	}
+
+	for attempt := 0; ; attempt++ {
+		release, ok := m.limiter.acquire(backendURL, m.backendConf.MaxConcurrentPassthrough, m.backendConf.MaxQueuedPassthrough, m.backendConf.PassthroughQueueTimeout)
+		if !ok {
+			return m.throttled(backendURL)
+		}
+		resp, err := m.authRep(client, request)
+		release()
+		// a nil response means the request could not be built so there is no point in retrying
+		if err == nil || resp == nil || attempt >= m.backendConf.RetryMaxAttempts || !retryable(m.backendConf.RetryableError, err) {
+			return resp, err
+		}
+		sleep(m.retryDelay(attempt))
+	}
+}
+
+// throttled applies the failure policy to a call which exceeded the concurrency limit of the backend
+func (m Manager) throttled(backendURL string) (*BackendResponse, error) {
+	m.counters.add(countRequestsThrottled)
+	if m.metricsReporter != nil && m.metricsReporter.ThrottledCB != nil {
+		m.metricsReporter.ThrottledCB(backendURL)
+	}
+
+	if m.backendConf.Policy != nil && m.backendConf.Policy() {
+		return &BackendResponse{Authorized: true}, nil
+	}
+	return nil, fmt.Errorf("unable to call 3scale backend %s - %w", backendURL, ErrBackendThrottled)
+}
+
+// authorizeThenReportClient is a threescale.Client whose AuthRep authorizes the request and reports its usage
+// only if it was authorized
+type authorizeThenReportClient struct {
+	threescale.Client
+	logger core.Logger
+}
+
+func (ac *authorizeThenReportClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	res, err := ac.Authorize(request)
+	if err != nil || res == nil || !res.Authorized {
+		return res, err
+	}
+
+	if _, err := ac.Report(request); err != nil {
+		ac.logger.Errorf("failed to report usage of authorized request for service %s - %s", string(request.Service), err.Error())
+	}
+	return res, nil
+}
+
+// retryDelay returns the delay before the retry following the given attempt, using exponential backoff
+// with full jitter such that the delay is random(0, min(cap, base * 2^attempt))
+func (m Manager) retryDelay(attempt int) time.Duration {
+	base, ceiling := m.backendConf.RetryBaseDelay, m.backendConf.RetryMaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if ceiling <= 0 {
+		ceiling = defaultRetryMaxDelay
+	}
+
+	backoff := ceiling
+	// guard against overflow for large attempts
+	if attempt < 62 {
+		if exp := base << uint(attempt); exp > 0 && exp < ceiling {
+			backoff = exp
+		}
+	}
+	return time.Duration(randInt63n(int64(backoff) + 1))
+}
+
+// IsRetryableError is the default classification of errors which are worth retrying, returning true for timeouts,
+// connection errors and responses with a 5xx or 429 status from 3scale. Other errors, such as those caused by an
+// invalid request or credentials, are considered permanent
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var sysErr SystemError
+	if errors.As(err, &sysErr) {
+		return isRetryableStatus(sysErr.StatusCode)
+	}
+
+	var statusErr backendStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.transient || isRetryableStatus(statusErr.statusCode)
+	}
+	return false
+}
+
+func isRetryableStatus(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// retryable applies the provided predicate, falling back to IsRetryableError if it is nil
+func retryable(predicate func(error) bool, err error) bool {
+	if predicate == nil {
+		predicate = IsRetryableError
+	}
+	return predicate(err)
+}
+
+// backendStatusError annotates an error calling 3scale backend with the status of the response
+type backendStatusError struct {
+	statusCode int
+	// transient is set if the response was classified as transient by BackendConfig.ClassifyResponse
+	transient bool
+	err       error
+}
+
+func (e backendStatusError) Error() string {
+	return e.err.Error()
+}
+
+func (e backendStatusError) Unwrap() error {
+	return e.err
+}
+
+func (m Manager) cachedAuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
+	cb, err := m.loadCachedBackend(backendURL)
+	if err != nil {
+		m.backendConf.Logger.Errorf("unable to create cached backend for %s, falling back to passthrough - %s", backendURL, err.Error())
+		return m.passthroughAuthRep(backendURL, request)
+	}
+	cb.markSeen()
+
+	resp, recovered, err := m.tryCachedAuthRep(cb, request)
+	if recovered {
+		m.resetCachedBackend(backendURL, cb)
+		return m.passthroughAuthRep(backendURL, request)
+	}
+	return resp, err
+}
+
+// tryCachedAuthRep calls AuthRep on the cached backend, recovering from a panic caused by the backend having entered
+// a bad state. Returns true if a panic was recovered, in which case the response must not be used
+func (m Manager) tryCachedAuthRep(cb cachedBackend, request BackendRequest) (resp *BackendResponse, recovered bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.backendConf.Logger.Errorf("recovered from panic in cached backend, falling back to passthrough - %v", r)
+			resp, recovered, err = nil, true, nil
+		}
+	}()
+
+	resp, err = m.authRep(cb.backend, request)
+	if n := m.backendConf.FlushEveryNTransactions; n > 0 && cb.backend.PendingTransactions() >= int64(n) {
+		cb.requestFlush()
+	}
+	return resp, false, err
+}
+
+// resetCachedBackend removes the cached backend for backendURL, if it has not already been replaced, such that the
+// next call to AuthRep creates a new one. Its flushing process is retired, attempting a final flush
+func (m Manager) resetCachedBackend(backendURL string, cb cachedBackend) {
+	m.cachedBackendsLock.Lock()
+	defer m.cachedBackendsLock.Unlock()
+	if current, ok := m.cachedBackends[backendURL]; !ok || current.backend != cb.backend {
+		return
+	}
+
+	m.backendConf.Logger.Errorf("resetting cached backend for %s after it entered a bad state", backendURL)
+	delete(m.cachedBackends, backendURL)
+	if cb.retire != nil {
+		close(cb.retire)
+	}
+}
+
+func (m Manager) authRep(client threescale.Client, request BackendRequest) (resp *BackendResponse, err error) {
+	if m.backendConf.OnDenied != nil {
+		defer func() {
+			m.observeDenial(request, resp, err)
+		}()
+	}
+
+	req, err := request.ToAPIRequest()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build request to 3scale - %s", err)
+	}
+
+	res, err := client.AuthRep(*req)
+	if m.backendConf.ClassifyResponse != nil && res != nil {
+		if status, body, ok := capturedResponse(res.RawResponse); ok {
+			return m.classifyResponse(status, body, res)
+		}
+	}
+
+	if err != nil {
+		var rawResponse interface{}
+		if res != nil {
+			rawResponse = res.RawResponse
+			if httpRes, ok := rawResponse.(*http.Response); ok {
+				err = backendStatusError{statusCode: httpRes.StatusCode, err: err}
+			}
+		}
+		return &BackendResponse{
+			Authorized:  false,
+			RawResponse: rawResponse,
+		}, fmt.Errorf("error calling AuthRep - %w", err)
+	}
+
+	return &BackendResponse{
+		Authorized:     res.Authorized,
+		ErrorCode:      res.ErrorCode,
+		RejectedReason: res.RejectionReason,
+		RawResponse:    res.RawResponse,
+		LimitReset:     mostConstrainedLimitReset(res.UsageReports),
+		limitReset:     earliestLimitReset(res.UsageReports),
+	}, nil
+}
+
+// loadCachedBackend returns the cached backend for the provided url, creating it if we haven't seen this backend before
+// A backend older than BackendConfig.BackendClientMaxAge is flushed and replaced by a newly created backend
+func (m Manager) loadCachedBackend(backendURL string) (cachedBackend, error) {
+	m.cachedBackendsLock.RLock()
+	cb, knownBackend := m.cachedBackends[backendURL]
+	m.cachedBackendsLock.RUnlock()
+	if knownBackend && !m.expired(cb) {
+		return cb, nil
+	}
+
+	m.cachedBackendsLock.Lock()
+	defer m.cachedBackendsLock.Unlock()
+	// check again in case the backend was created or replaced while we were waiting on the lock
+	if cb, knownBackend = m.cachedBackends[backendURL]; knownBackend {
+		if !m.expired(cb) {
+			return cb, nil
+		}
+		// the expired backend is retired rather than flushed here, so that its final flush drains its counters in
+		// the background once, without holding up requests to other backends on the lock
+		m.backendConf.Logger.Infof("rebuilding cached backend for %s - max age exceeded", backendURL)
+		delete(m.cachedBackends, backendURL)
+		if cb.retire != nil {
+			close(cb.retire)
+		}
+	}
+
+	cb, err := m.newCachedBackend(backendURL)
+	if err != nil {
+		return cb, err
+	}
+	m.cachedBackends[backendURL] = cb
+	return cb, nil
+}
+
+// expired returns true if the cached backend is older than BackendConfig.BackendClientMaxAge
+func (m Manager) expired(cb cachedBackend) bool {
+	maxAge := m.backendConf.BackendClientMaxAge
+	return maxAge > 0 && !cb.createdAt.IsZero() && timeNow().Sub(cb.createdAt) >= maxAge
+}
+
+// validateMetricsCount ensures that no transaction in the request exceeds the max number of metrics
+func (m Manager) validateMetricsCount(request BackendRequest) error {
+	limit := m.backendConf.MaxMetricsPerTransaction
+	if limit == 0 {
+		limit = defaultMaxMetricsPerTransaction
+	}
+	if limit < 0 {
+		return nil
+	}
+
+	for index, transaction := range request.Transactions {
+		if len(transaction.Metrics) > limit {
+			return fmt.Errorf("%w - transaction %d has %d metrics, limit is %d", ErrTooManyMetrics, index, len(transaction.Metrics), limit)
+		}
+	}
+	return nil
+}
+
+// validateMetrics ensures that each metric reported in the request is known to the service
+// Unknown metrics are only logged if BackendConfig.ValidateMetricsWarnOnly is set
+func (m Manager) validateMetrics(request BackendRequest) error {
+	unknown := m.unknownMetrics(request)
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%w for service %s - %s", ErrUnknownMetric, request.Service, strings.Join(unknown, ","))
+	if m.backendConf.ValidateMetricsWarnOnly {
+		m.backendConf.Logger.Infof("%s", err.Error())
+		return nil
+	}
+	return err
+}
+
+// unknownMetrics returns the sorted metrics reported in the request which are not known to the service
+// Returns nil if the proxy config for the service is not cached
+func (m Manager) unknownMetrics(request BackendRequest) []string {
+	config, ok := m.cachedConfigForService(request.Service)
+	if !ok {
+		m.backendConf.Logger.Debugf("skipping metric validation for service %s - no cached config", request.Service)
+		return nil
+	}
+
+	known := map[string]bool{defaultMetric: true}
+	for _, rule := range config.Content.Proxy.ProxyRules {
+		known[rule.MetricSystemName] = true
+	}
+
+	var unknown []string
+	for _, transaction := range request.Transactions {
+		for metric := range transaction.Metrics {
+			if !known[metric] && !contains(metric, unknown) {
+				unknown = append(unknown, metric)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// cachedConfigForService returns the proxy config most recently served for the service if it is still cached
+func (m Manager) cachedConfigForService(serviceID string) (client.ProxyConfig, bool) {
+	if m.systemCache == nil || m.systemCache.ConfigurationCache == nil {
+		return client.ProxyConfig{}, false
+	}
+
+	key, ok := m.configKeys.get(serviceID)
+	if !ok {
+		return client.ProxyConfig{}, false
+	}
+	value, ok := m.systemCache.Get(key)
+	if !ok {
+		return client.ProxyConfig{}, false
+	}
+	return value.Item, true
+}
+
+// classifyResponse builds the response using the custom classifier provided in the backend config
+// The time at which limits reset is taken from the usage reports of the result, regardless of the classification
+func (m Manager) classifyResponse(status int, body []byte, res *threescale.AuthorizeResult) (*BackendResponse, error) {
+	authorized, errorCode, reason, transient := m.backendConf.ClassifyResponse(status, body)
+	response := &BackendResponse{
+		Authorized:     authorized && !transient,
+		ErrorCode:      errorCode,
+		RejectedReason: reason,
+		RawResponse:    res.RawResponse,
+		LimitReset:     mostConstrainedLimitReset(res.UsageReports),
+		limitReset:     earliestLimitReset(res.UsageReports),
+	}
+
+	if transient {
+		return response, backendStatusError{
+			statusCode: status,
+			transient:  true,
+			err:        fmt.Errorf("error calling AuthRep - transient response with status %d", status),
+		}
+	}
+	return response, nil
+}
+
+// newCachedBackend creates a new backend and start the flushing process in the background
+func (m Manager) newCachedBackend(url string) (cachedBackend, error) {
+	httpClient := http.DefaultClient
+	switch cb := m.clientBuilder.(type) {
+	case ClientBuilder:
+		httpClient = cb.httpClient
+	case *ClientBuilder:
+		httpClient = cb.httpClient
+	}
+
+	backendURL, httpClient, err := resolveBackendTransport(url, httpClient)
+	if err != nil {
+		return cachedBackend{}, err
+	}
+
+	if m.backendConf.ProbeOnCreate {
+		if err := pingBackend(httpClient, backendURL); err != nil {
+			return cachedBackend{}, fmt.Errorf("backend %s is unreachable - %s", url, err.Error())
+		}
+	}
+
+	backend, err := backend.NewBackend(backendURL, httpClient, m.backendConf.Logger, m.backendConf.Policy)
+	if err != nil {
+		return cachedBackend{}, err
+	}
+	backend.SetSegmentByUser(m.backendConf.SegmentCacheByUser)
+	backend.SetMetricAggregations(m.backendConf.MetricAggregations)
+	backend.SetWindowAlignment(m.backendConf.WindowAlignment)
+
+	flushHTTPClient := httpClient
+	if m.backendConf.FlushTimeout > 0 {
+		timeoutClient := *httpClient
+		timeoutClient.Timeout = m.backendConf.FlushTimeout
+		flushHTTPClient = &timeoutClient
+	}
+	flushClient, err := apisonator.NewClient(backendURL, flushHTTPClient)
+	if err != nil {
+		return cachedBackend{}, err
+	}
+	flushes := &flushObservingClient{next: flushClient, timeout: m.backendConf.FlushTimeout}
+	backend.SetFlushClient(flushes)
+	backend.WrapClient(func(client threescale.Client) threescale.Client {
+		return observeLatency(client, url, m.metricsReporter)
+	})
+	backend.SetCacheHitCallback(func() {
+		m.counters.add(countBackendCacheHits)
+		if m.metricsReporter != nil && m.metricsReporter.CacheHitCB != nil {
+			m.metricsReporter.CacheHitCB(Backend)
+		}
+	})
+	backend.SetCacheMissCallback(func() {
+		m.counters.add(countBackendCacheMisses)
+	})
+	backend.SetMaxCachedApplications(m.backendConf.MaxCachedApplications)
+	backend.SetEvictionCallback(func() {
+		m.counters.add(countBackendCacheEvictions)
+		if m.metricsReporter != nil && m.metricsReporter.CacheEvictionCB != nil {
+			m.metricsReporter.CacheEvictionCB(url)
+		}
+	})
+
+	cb := cachedBackend{
+		backend:        backend,
+		stopFlush:      m.stopFlush,
+		lastSeen:       new(int64),
+		flushNow:       make(chan struct{}, 1),
+		flushTriggered: make(chan struct{}, 1),
+		gate:           &flushGate{},
+		flushes:        flushes,
+		createdAt:      timeNow(),
+		retire:         make(chan struct{}),
+	}
+
+	keepAliveInterval := m.backendConf.KeepAliveInterval
+	if keepAliveInterval == time.Duration(0) {
+		keepAliveInterval = defaultKeepAliveInterval
+	}
+
+	// flush outside of the flushing loop so that we can detect and skip flushes
+	// which are requested while a slow flush is still in progress
+	var inFlight sync.WaitGroup
+	tryFlush := func(claimed bool) {
+		inFlight.Add(1)
+		m.runFlushInBackground(func() {
+			defer inFlight.Done()
+			defer m.recoverFlush(url, cb)
+			if !claimed && !cb.gate.begin(timeNow(), 0) {
+				m.flushSkipped(url)
+				return
+			}
+			defer cb.gate.end()
+
+			if cb.isStopping() {
+				// the final flush, which is waiting on us, reports the usage instead
+				return
+			}
+
+			start := time.Now()
+			if backend.TryFlush() {
+				m.metricsReporter.observeLatency(url, PhaseFlush, start)
+				m.observeFlush(url, flushes)
+			} else {
+				m.flushSkipped(url)
+			}
+		})
+	}
+
+	ticker := time.NewTicker(m.backendConf.CacheFlushInterval)
+	finalFlush := func() {
+		// serialize against periodic flushes, such that usage is reported exactly once while shutting down
+		ticker.Stop()
+		inFlight.Wait()
+		defer m.recoverFlush(url, cb)
+
+		start := time.Now()
+		backend.Flush()
+		m.metricsReporter.observeLatency(url, PhaseFlush, start)
+		timedOut := m.observeFlush(url, flushes)
+
+		reason := ReportsDroppedShutdown
+		switch {
+		case timedOut:
+			reason = ReportsDroppedTimeout
+		case backend.Overflowed():
+			reason = ReportsDroppedOverflow
+		}
+		m.reportsDropped(url, backend.UnreportedTransactions(), reason)
+	}
+
+	m.runFlushInBackground(func() {
+		// a nil channel blocks forever so the keep alive case is never selected when disabled
+		var keepAlive <-chan time.Time
+		if m.backendConf.EnableKeepAlive {
+			keepAliveTicker := time.NewTicker(keepAliveInterval)
+			defer keepAliveTicker.Stop()
+			keepAlive = keepAliveTicker.C
+		}
+
+		for {
+			select {
+			case <-ticker.C:
+				tryFlush(false)
+			case <-cb.flushNow:
+				tryFlush(false)
+			case <-cb.flushTriggered:
+				tryFlush(true)
+			case <-keepAlive:
+				if cb.isIdle(keepAliveInterval) {
+					if err := pingBackend(httpClient, backendURL); err != nil {
+						m.backendConf.Logger.Debugf("keep alive for backend %s failed - %s", url, err.Error())
+					}
+				}
+			case <-m.stopFlush:
+				// allows us to drain the cache before shutting down
+				finalFlush()
+				return
+			case <-cb.retire:
+				// reports any usage recorded by requests which loaded the backend before it was replaced
+				finalFlush()
+				return
+			}
+
+		}
+	})
+	m.backendConf.Logger.Infof("created new cached backend for %s", url)
+	return cb, nil
+}
+
+// recoverFlush recovers from a panic while flushing the cached backend for url and resets it, since its state may be
+// inconsistent. It must be deferred
+func (m Manager) recoverFlush(url string, cb cachedBackend) {
+	if r := recover(); r != nil {
+		m.backendConf.Logger.Errorf("recovered from panic while flushing backend %s - %v", url, r)
+		m.resetCachedBackend(url, cb)
+	}
+}
+
+// flushSkipped reports a flush of the backend at url which was skipped because a previous flush is in progress
+func (m Manager) flushSkipped(url string) {
+	m.backendConf.Logger.Debugf("skipped flush for backend %s - previous flush in progress", url)
+	m.counters.add(countFlushesSkipped)
+	if m.metricsReporter != nil && m.metricsReporter.FlushSkippedCB != nil {
+		m.metricsReporter.FlushSkippedCB(url)
+	}
+}
+
+// observeFlush records the outcome of a completed flush of the backend at url, reporting it if it timed out
+// Returns true if the flush timed out
+func (m Manager) observeFlush(url string, flushes *flushObservingClient) bool {
+	failed, timedOut := flushes.complete()
+	m.counters.add(countFlushes)
+	if failed {
+		m.counters.add(countFlushesFailed)
+	}
+	if !timedOut {
+		return false
+	}
+	m.counters.add(countFlushesTimedOut)
+	m.backendConf.Logger.Errorf("flush for backend %s timed out after %s", url, m.backendConf.FlushTimeout.String())
+	if m.metricsReporter != nil && m.metricsReporter.FlushTimeoutCB != nil {
+		m.metricsReporter.FlushTimeoutCB(url)
+	}
+	return true
+}
+
+// reportsDropped logs and passes the unreported usage of the backend at url to OnReportsDropped, if any
+func (m Manager) reportsDropped(url string, unreported map[api.Service][]api.Transaction, reason string) {
+	var dropped []BackendTransaction
+	for _, transactions := range unreported {
+		for _, transaction := range transactions {
+			dropped = append(dropped, BackendTransaction{
+				Metrics: transaction.Metrics,
+				Params: BackendParams{
+					AppID:   transaction.Params.AppID,
+					AppKey:  transaction.Params.AppKey,
+					UserID:  transaction.Params.UserID,
+					UserKey: transaction.Params.UserKey,
+				},
+			})
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	m.backendConf.Logger.Errorf("dropped unreported usage of %d transactions for backend %s - %s", len(dropped), url, reason)
+	if m.backendConf.OnReportsDropped != nil {
+		m.backendConf.OnReportsDropped(url, dropped, reason)
+	}
+}
+
+// flushObservingClient is a threescale.Client, used when flushing, which records whether calls made during the
+// current flush failed and whether they failed once the timeout of the underlying http client had elapsed
+type flushObservingClient struct {
+	next    threescale.Client
+	timeout time.Duration
+	// failed and timedOut are set by calls made during the current flush and cleared when it completes
+	failed   int32
+	timedOut int32
+	// lastFailed is set when a call made during the last completed flush failed
+	lastFailed int32
+}
+
+func (fc *flushObservingClient) Authorize(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	start := time.Now()
+	resp, err := fc.next.Authorize(request)
+	fc.observe(start, err)
+	return resp, err
+}
+
+func (fc *flushObservingClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	start := time.Now()
+	resp, err := fc.next.AuthRep(request)
+	fc.observe(start, err)
+	return resp, err
+}
+
+func (fc *flushObservingClient) Report(request threescale.Request) (*threescale.ReportResult, error) {
+	start := time.Now()
+	resp, err := fc.next.Report(request)
+	fc.observe(start, err)
+	return resp, err
+}
+
+func (fc *flushObservingClient) GetPeer() string {
+	return fc.next.GetPeer()
+}
+
+func (fc *flushObservingClient) observe(start time.Time, err error) {
+	if err == nil {
+		return
+	}
+	atomic.StoreInt32(&fc.failed, 1)
+	// the client wraps errors as strings so the timeout is detected by the time taken instead
+	if fc.timeout > 0 && time.Since(start) >= fc.timeout {
+		atomic.StoreInt32(&fc.timedOut, 1)
+	}
+}
+
+// complete marks the end of a flush, returning whether any call made during it failed or timed out
+func (fc *flushObservingClient) complete() (failed bool, timedOut bool) {
+	if fc == nil {
+		return false, false
+	}
+	failed = atomic.SwapInt32(&fc.failed, 0) == 1
+	timedOut = atomic.SwapInt32(&fc.timedOut, 0) == 1
+	var lastFailed int32
+	if failed {
+		lastFailed = 1
+	}
+	atomic.StoreInt32(&fc.lastFailed, lastFailed)
+	return failed, timedOut
+}
+
+// lastFlushFailed reports whether a call made during the last completed flush failed
+func (fc *flushObservingClient) lastFlushFailed() bool {
+	return fc != nil && atomic.LoadInt32(&fc.lastFailed) == 1
+}
+
+// requestFlush signals the flushing process to flush without waiting for the next interval
+// Requests made while a previous request is pending are coalesced
+func (cb cachedBackend) requestFlush() {
+	select {
+	case cb.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// isStopping returns true once the final flush of the backend has been requested, on shutdown or retirement
+func (cb cachedBackend) isStopping() bool {
+	select {
+	case <-cb.stopFlush:
+		return true
+	case <-cb.retire:
+		return true
+	default:
+		return false
+	}
+}
+
+// markSeen records that the backend has handled real traffic
+func (cb cachedBackend) markSeen() {
+	if cb.lastSeen != nil {
+		atomic.StoreInt64(cb.lastSeen, time.Now().UnixNano())
+	}
+}
+
+// isIdle returns true if the backend has not handled any traffic within the provided duration
+func (cb cachedBackend) isIdle(within time.Duration) bool {
+	if cb.lastSeen == nil {
+		return true
+	}
+	lastSeen := time.Unix(0, atomic.LoadInt64(cb.lastSeen))
+	return time.Since(lastSeen) >= within
+}
+
+// pingBackend makes a lightweight request to apisonator's status endpoint to keep a connection open
+func pingBackend(httpClient *http.Client, backendURL string) error {
+	resp, err := httpClient.Get(backendURL + backendStatusEndpoint)
+	if err != nil {
+		return err
+	}
+	// the body must be read to completion for the connection to be re-used
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (m Manager) fetchSystemConfigFromCache(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	var config client.ProxyConfig
+	var err error
+
+	cacheKey := generateSystemConfigCacheKey(systemURL, request.ServiceID, request.AccessToken)
+	cachedValue, found := m.systemCache.Get(cacheKey)
+	if !found {
+		m.counters.add(countSystemCacheMisses)
+		config, err = m.fetchSystemConfigRemotely(systemURL, request)
+		if err != nil {
+			return config, err
+		}
+
+		itemToCache := &cache.Value{Item: config}
+		itemToCache = m.setValueFromConfig(systemURL, request, itemToCache)
+		m.systemCache.Set(cacheKey, *itemToCache)
+
+	} else if m.serverless && cachedValue.Expired() {
+		// without a background refresh process, expired values are refreshed when they are read
+		m.counters.add(countSystemCacheMisses)
+		config, err = m.fetchSystemConfigRemotely(systemURL, request)
+		if err = m.checkServiceDeleted(context.Background(), systemURL, request, err); errors.Is(err, cache.ErrDeleted) {
+			m.systemCache.Delete(cacheKey)
+			return client.ProxyConfig{}, err
+		}
+		if err != nil {
+			m.backendConf.Logger.Errorf("failed to refresh expired config for service %s, serving expired config - %s", request.ServiceID, err.Error())
+			return cachedValue.Item, nil
+		}
+
+		itemToCache := &cache.Value{Item: config}
+		itemToCache = m.setValueFromConfig(systemURL, request, itemToCache)
+		m.systemCache.Set(cacheKey, *itemToCache)
+
+	} else {
+		config = cachedValue.Item
+		m.counters.add(countSystemCacheHits)
+		if m.metricsReporter.CacheHitCB != nil {
+			m.metricsReporter.CacheHitCB(System)
+		}
+	}
+
+	m.configKeys.set(request.ServiceID, cacheKey)
+	return config, err
+}
+
+func (m Manager) fetchSystemConfigRemotely(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	return m.fetchSystemConfigRemotelyWithContext(context.Background(), systemURL, request)
+}
+
+func (m Manager) fetchSystemConfigRemotelyWithContext(ctx context.Context, systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	var config client.ProxyConfig
+
+	systemClient, err := m.clientBuilder.BuildSystemClientWithContext(ctx, systemURL, request.AccessToken)
+	if err != nil {
+		return config, fmt.Errorf("unable to build system client for %s - %s", systemURL, err.Error())
+	}
+
+	proxyConfElement, err := systemClient.GetLatestProxyConfig(request.ServiceID, request.Environment)
+	if isLockConflict(err) {
+		// the config was modified while being fetched, a single retry picks up the latest lock version
+		proxyConfElement, err = systemClient.GetLatestProxyConfig(request.ServiceID, request.Environment)
+	}
+
+	if err != nil {
+		if isLockConflict(err) {
+			return config, fmt.Errorf("%w for service %s in %s", ErrLockConflict, request.ServiceID, request.Environment)
+		}
+		if m.noConfigOnNotFound && client.IsNotFound(err) {
+			return config, fmt.Errorf("%w for service %s in %s", ErrNoConfigPublished, request.ServiceID, request.Environment)
+		}
+		return config, fmt.Errorf("unable to fetch required data from 3scale system - %w", asSystemError(err))
+	}
+
+	config = proxyConfElement.ProxyConfig
+	versionKey := fmt.Sprintf("%s_%s", generateSystemCacheKey(systemURL, request.ServiceID), request.Environment)
+	if m.configVersions.observe(versionKey, config.Version) {
+		m.refreshCachedService(request.ServiceID)
+	}
+	return config, nil
+}
+
+// refreshCachedService refreshes the state of the service, including its limits, in each cached backend
+// Pending usage is reported before the state is refreshed so that it is not lost
+func (m Manager) refreshCachedService(serviceID string) {
+	backends := m.snapshotCachedBackends()
+	if len(backends) == 0 {
+		return
+	}
+
+	scheduled := m.runInBackgroundUnlessStopped(func() {
+		for _, b := range backends {
+			b.RefreshService(serviceID)
+		}
+	})
+	if !scheduled {
+		m.backendConf.Logger.Debugf("proxy config version changed for service %s, not refreshing cached limits while shutting down", serviceID)
+		return
+	}
+	m.backendConf.Logger.Debugf("proxy config version changed for service %s, refreshing cached limits", serviceID)
+}
+
+// resolveServiceID returns the ID of the service identified by the requests system name
+// Resolved IDs are cached for the lifetime of the Manager
+func (m Manager) resolveServiceID(systemURL string, request SystemRequest) (string, error) {
+	cacheKey := generateSystemCacheKey(systemURL, request.SystemName)
+	if id, ok := m.serviceIDs.get(cacheKey); ok {
+		return id, nil
+	}
+
+	systemClient, err := m.clientBuilder.BuildSystemClientWithContext(context.Background(), systemURL, request.AccessToken)
+	if err != nil {
+		return "", fmt.Errorf("unable to build system client for %s - %s", systemURL, err.Error())
+	}
+
+	services, err := systemClient.ListServices()
+	if err != nil {
+		return "", fmt.Errorf("unable to list services from 3scale system - %s", err.Error())
+	}
+
+	var matches []string
+	for _, service := range services.Services {
+		if service.SystemName == request.SystemName {
+			matches = append(matches, service.ID)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no service found with system name %s", request.SystemName)
+	case 1:
+		m.serviceIDs.set(cacheKey, matches[0])
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("system name %s is ambiguous, matching services %s", request.SystemName, strings.Join(matches, ","))
+	}
+}
+
+// decide returns a response for the request if its credentials are overridden
+func (co *credentialOverrides) decide(request BackendRequest) (*BackendResponse, bool) {
+	if co == nil || len(request.Transactions) < 1 {
+		return nil, false
+	}
+
+	params := request.Transactions[0].Params
+	credential := params.UserKey
+	if credential == "" {
+		credential = params.AppID
+	}
+
+	co.RLock()
+	defer co.RUnlock()
+	if co.deny[credential] {
+		return &BackendResponse{
+			Authorized:     false,
+			ErrorCode:      CredentialDeniedErrorCode,
+			RejectedReason: "credential has been denied by a local override",
+		}, true
+	}
+
+	if co.allow[credential] {
+		return &BackendResponse{Authorized: true}, true
+	}
+	return nil, false
+}
+
+func (co *credentialOverrides) set(overrides CredentialOverrides) {
+	if co == nil {
+		return
+	}
+
+	deny := make(map[string]bool, len(overrides.Deny))
+	for _, credential := range overrides.Deny {
+		deny[credential] = true
+	}
+
+	allow := make(map[string]bool, len(overrides.Allow))
+	for _, credential := range overrides.Allow {
+		allow[credential] = true
+	}
+
+	co.Lock()
+	defer co.Unlock()
+	co.deny, co.allow = deny, allow
+}
+
+// counts returns the number of denied and allowed credentials currently in effect
+func (co *credentialOverrides) counts() (denied, allowed int) {
+	if co == nil {
+		return 0, 0
+	}
+
+	co.RLock()
+	defer co.RUnlock()
+	return len(co.deny), len(co.allow)
+}
+
+// begin records an in-flight call, returning false if draining has started and the call must be rejected
+func (d *drainState) begin() bool {
+	if d == nil {
+		return true
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.draining {
+		return false
+	}
+	d.inFlight.Add(1)
+	return true
+}
+
+func (d *drainState) isDraining() bool {
+	if d == nil {
+		return false
+	}
+	d.RLock()
+	defer d.RUnlock()
+	return d.draining
+}
+
+func (d *drainState) done() {
+	if d != nil {
+		d.inFlight.Done()
+	}
+}
+
+// observe records the version for the key and returns true if a different version was previously recorded
+func (c *configVersionCache) observe(key string, version int) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	previous, seen := c.versions[key]
+	c.versions[key] = version
+	return seen && previous != version
+}
+
+func (c *serviceIDCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	id, ok := c.ids[key]
+	return id, ok
+}
+
+func (c *serviceIDCache) set(key, id string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.ids[key] = id
+}
+
+// asSystemError converts an error response from 3scale system into a SystemError, other errors are returned as is
+func asSystemError(err error) error {
+	var apiErr client.ApiErr
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	// the porta client does not expose the reason directly so it must be extracted from the message
+	body := apiErr.Error()
+	prefix, suffix := "error calling 3scale system - reason: ", fmt.Sprintf(" - code: %d", apiErr.Code())
+	if strings.HasPrefix(body, prefix) && strings.HasSuffix(body, suffix) {
+		body = strings.TrimSuffix(strings.TrimPrefix(body, prefix), suffix)
+	}
+	return SystemError{StatusCode: apiErr.Code(), Body: body, err: apiErr}
+}
+
+// isLockConflict returns true if the error is a response from 3scale system indicating a lock version conflict
+func isLockConflict(err error) bool {
+	var apiErr client.ApiErr
+	return errors.As(err, &apiErr) && apiErr.Code() == http.StatusConflict
+}
+
+func (m Manager) refreshCallback(systemURL string, request SystemRequest, retryAttempts int) func() (client.ProxyConfig, error) {
+	return func() (client.ProxyConfig, error) {
+		ctx := m.backgroundContext()
+		config, err := m.fetchSystemConfigRemotelyWithContext(ctx, systemURL, request)
+		if err = m.checkServiceDeleted(ctx, systemURL, request, err); errors.Is(err, cache.ErrDeleted) {
+			// the cache evicts the config rather than retrying
+			return config, err
+		}
+		if err != nil {
+			// there is no point retrying if we have been cancelled
+			if retryAttempts > 0 && ctx.Err() == nil && m.refreshRetryable(err) {
+				retryAttempts--
+				return m.refreshCallback(systemURL, request, retryAttempts)()
+			}
+		}
+		return config, err
+	}
+}
+
+// checkServiceDeleted returns an error wrapping cache.ErrDeleted if the error from fetching the proxy config is due
+// to the service having been deleted from 3scale system, calling OnServiceDeleted. Other errors are returned as is
+// Since a 404 may also mean that no config has been published to the environment, deletion is confirmed by the
+// absence of the service from the list of services, and a failure to list them is treated as transient
+func (m Manager) checkServiceDeleted(ctx context.Context, systemURL string, request SystemRequest, err error) error {
+	var sysErr SystemError
+	notFound := errors.Is(err, ErrNoConfigPublished) || (errors.As(err, &sysErr) && sysErr.StatusCode == http.StatusNotFound)
+	if !notFound {
+		return err
+	}
+
+	systemClient, buildErr := m.clientBuilder.BuildSystemClientWithContext(ctx, systemURL, request.AccessToken)
+	if buildErr != nil {
+		return err
+	}
+	services, listErr := systemClient.ListServices()
+	if listErr != nil {
+		m.backendConf.Logger.Debugf("unable to confirm deletion of service %s - %s", request.ServiceID, listErr.Error())
+		return err
+	}
+	for _, service := range services.Services {
+		if service.ID == request.ServiceID {
+			return err
+		}
+	}
+
+	m.backendConf.Logger.Infof("service %s has been deleted from 3scale system, evicting its cached config", request.ServiceID)
+	if m.systemCache != nil && m.systemCache.OnServiceDeleted != nil {
+		m.systemCache.OnServiceDeleted(systemURL, request.ServiceID)
+	}
+	return fmt.Errorf("%w - service %s no longer exists in 3scale system", cache.ErrDeleted, request.ServiceID)
+}
+
+// refreshRetryable reports whether a failed refresh should be retried
+func (m Manager) refreshRetryable(err error) bool {
+	var predicate func(error) bool
+	if m.systemCache != nil {
+		predicate = m.systemCache.RetryableError
+	}
+	return retryable(predicate, err)
+}
+
+// runInBackground runs the provided function in a new goroutine, tracking it as a background task
+func (m Manager) runInBackground(task func()) {
+	if m.backgroundTasks == nil {
+		go task()
+		return
+	}
+
+	m.backgroundTasks.Add(1)
+	go func() {
+		defer m.backgroundTasks.Done()
+		task()
+	}()
+}
+
+// runFlushInBackground runs the task as per runInBackground, counting it as an active flush goroutine while it runs
+func (m Manager) runFlushInBackground(task func()) {
+	if m.flushGoroutines == nil {
+		m.runInBackground(task)
+		return
+	}
+
+	atomic.AddInt64(m.flushGoroutines, 1)
+	m.runInBackground(func() {
+		defer atomic.AddInt64(m.flushGoroutines, -1)
+		task()
+	})
+}
+
+// runInBackgroundUnlessStopped runs the task as per runInBackground unless Shutdown has begun, returning false if the
+// task was not started. It is used for optional work which need not complete before shutting down
+func (m Manager) runInBackgroundUnlessStopped(task func()) bool {
+	if m.backgroundLock != nil {
+		m.backgroundLock.RLock()
+		defer m.backgroundLock.RUnlock()
+	}
+	if m.backgroundContext().Err() != nil {
+		return false
+	}
+	m.runInBackground(task)
+	return true
+}
+
+// backgroundContext returns the context which background work should be bound to
+func (m Manager) backgroundContext() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func (m Manager) setValueFromConfig(systemURL string, request SystemRequest, value *cache.Value) *cache.Value {
+	value.SetRefreshCallback(m.refreshCallback(systemURL, request, m.systemCache.NumRetryFailedRefresh))
+	return value
+}
+
+// ToAPIRequest transforms the BackendRequest into a request that is acceptable for the 3scale Client interface
+// Metrics are held in a map, so have no order, however the 3scale client encodes the parameters of each request sorted
+// by key, such that the same logical request is always serialized identically
+func (request BackendRequest) ToAPIRequest() (*threescale.Request, error) {
+	if request.Transactions == nil || len(request.Transactions) < 1 {
+		return nil, fmt.Errorf("cannot process emtpy transaction")
+	}
+
+	if err := validateAuthType(request.Auth.Type); err != nil {
+		return nil, err
+	}
+
+	if request.Auth.Type == AuthTypeServiceToken && request.Service == "" {
+		return nil, fmt.Errorf("service token auth requires a service, a provider key must be used otherwise")
 	}
 
 	return &threescale.Request{
@@ -382,14 +2198,62 @@ func (request BackendRequest) ToAPIRequest() (*threescale.Request, error) {
 	}, nil
 }
 
+// validateAuthType ensures that the auth type is known to apisonator, rather than sending a malformed request
+func validateAuthType(authType string) error {
+	switch authType {
+	case AuthTypeProviderKey, AuthTypeServiceToken:
+		return nil
+	default:
+		return fmt.Errorf("%w %q, expected %q or %q", ErrInvalidAuthType, authType, AuthTypeProviderKey, AuthTypeServiceToken)
+	}
+}
+
+// withDefaultEnvironment returns the request with its Environment set to the default, if it has none
+func (m Manager) withDefaultEnvironment(request SystemRequest) SystemRequest {
+	if request.Environment == "" {
+		request.Environment = m.defaultEnvironment
+	}
+	return request
+}
+
 // validateSystemRequest to avoid wasting compute time on invalid request
 func validateSystemRequest(request SystemRequest) error {
-	if request.Environment == "" || request.ServiceID == "" || request.AccessToken == "" {
+	if request.Environment == "" || (request.ServiceID == "" && request.SystemName == "") || request.AccessToken == "" {
 		return fmt.Errorf("invalid arguements provided")
 	}
 	return nil
 }
 
+// validateAccessTokenScopes ensures that the scopes, if known, include the scope required to read proxy configs
+func validateAccessTokenScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+	for _, scope := range scopes {
+		if scope == AccountManagementScope {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w - reading proxy configs requires scope %s but token has scopes %s",
+		ErrInsufficientScope, AccountManagementScope, strings.Join(scopes, ", "))
+}
+
+// generateSystemConfigCacheKey returns the key under which the proxy config of a service is cached for the access token
+// Configs are cached per access token so that a config is only served to, and refreshed with, the token it was fetched
+// with. The token is hashed such that it cannot be recovered from the key, which is exposed via SystemCache.Entries
+func generateSystemConfigCacheKey(systemURL, svcID, accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return fmt.Sprintf("%s#%x", generateSystemCacheKey(systemURL, svcID), hash[:8])
+}
+
+// generateSystemCacheKey returns the key under which config for a service is cached for the system url
+// The url is prefixed with its length so that keys are unambiguous regardless of the characters in either component.
+// Urls longer than maxSystemURLKeyLength are replaced with their hash, bounding the length of the key
 func generateSystemCacheKey(systemURL, svcID string) string {
-	return fmt.Sprintf("%s_%s", systemURL, svcID)
+	if len(systemURL) > maxSystemURLKeyLength {
+		hash := fnv.New64a()
+		hash.Write([]byte(systemURL))
+		return fmt.Sprintf("%d#%x_%s", len(systemURL), hash.Sum64(), svcID)
+	}
+	return fmt.Sprintf("%d:%s_%s", len(systemURL), systemURL, svcID)
 }
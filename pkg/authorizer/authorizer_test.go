@@ -1,11 +1,26 @@
 package authorizer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-authorizer/pkg/core"
 	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -32,7 +47,7 @@ func TestManager_GetSystemConfiguration(t *testing.T) {
 	const svcID = "any"
 	const env = "test"
 
-	var cacheKey = generateSystemCacheKey(systemURL, svcID)
+	var cacheKey = generateSystemConfigCacheKey(systemURL, svcID, token)
 
 	validRequest := SystemRequest{
 		AccessToken: token,
@@ -227,219 +242,3164 @@ func TestManager_GetSystemConfiguration(t *testing.T) {
 	}
 }
 
+func TestManager_GetSystemConfigurationBySystemName(t *testing.T) {
+	services := client.ServiceList{
+		Services: []client.Service{
+			{ID: "1", SystemName: "one"},
+			{ID: "2", SystemName: "two"},
+			{ID: "3", SystemName: "duplicate"},
+			{ID: "4", SystemName: "duplicate"},
+		},
+	}
+
+	inputs := []struct {
+		name      string
+		request   SystemRequest
+		expectErr bool
+	}{
+		{
+			name:    "Test system name is resolved",
+			request: SystemRequest{AccessToken: "any", SystemName: "two", Environment: "production"},
+		},
+		{
+			name:      "Test unknown system name",
+			request:   SystemRequest{AccessToken: "any", SystemName: "unknown", Environment: "production"},
+			expectErr: true,
+		},
+		{
+			name:      "Test ambiguous system name",
+			request:   SystemRequest{AccessToken: "any", SystemName: "duplicate", Environment: "production"},
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var listCalls int32
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+			m.clientBuilder = mockBuilder{
+				withSystemClient: mockSystemClient{
+					withConfig: client.ProxyConfigElement{
+						ProxyConfig: client.ProxyConfig{Content: client.Content{ID: 2}},
+					},
+					withServices:      services,
+					listServicesCalls: &listCalls,
+				},
+			}
+
+			for i := 0; i < 2; i++ {
+				config, err := m.GetSystemConfiguration("test", input.request)
+				if err != nil {
+					if !input.expectErr {
+						t.Errorf("unexpected error %v", err)
+					}
+					continue
+				}
+
+				if input.expectErr {
+					t.Errorf("expected an error")
+				}
+
+				if config.Content.ID != 2 {
+					t.Errorf("unexpected config returned")
+				}
+			}
+
+			if !input.expectErr && atomic.LoadInt32(&listCalls) != 1 {
+				t.Errorf("expected resolved system name to be cached, but services were listed %d times", listCalls)
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"Not found"}`))
+	}))
+	defer server.Close()
+
+	request := SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "any",
+		Environment: "production",
+	}
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+	m.clientBuilder = NewClientBuilder(http.DefaultClient)
+	_, err := m.GetSystemConfiguration(server.URL, request)
+	if err == nil {
+		t.Fatalf("expected 404 to result in an error by default")
+	}
+	if errors.Is(err, ErrNoConfigPublished) {
+		t.Errorf("expected generic error when not opted in")
+	}
+
+	m = NewManager(http.DefaultClient, nil, BackendConfig{}, nil, WithNoConfigOnNotFound())
+	m.clientBuilder = NewClientBuilder(http.DefaultClient)
+	_, err = m.GetSystemConfiguration(server.URL, request)
+	if !errors.Is(err, ErrNoConfigPublished) {
+		t.Errorf("expected ErrNoConfigPublished but got %v", err)
+	}
+}
+
+func TestManager_GetSystemConfigurationInsufficientScope(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"proxy_config":{"environment":"production","content":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	inputs := []struct {
+		name        string
+		scopes      []string
+		expectErr   bool
+		expectCalls int32
+	}{
+		{
+			name:        "Test unknown scopes are not checked",
+			expectCalls: 1,
+		},
+		{
+			name:        "Test token with required scope fetches config",
+			scopes:      []string{"stats", AccountManagementScope},
+			expectCalls: 1,
+		},
+		{
+			name:      "Test token lacking required scope is rejected up front",
+			scopes:    []string{"stats", "finance"},
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+			m.clientBuilder = NewClientBuilder(http.DefaultClient)
+
+			_, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+				AccessToken:       "any",
+				ServiceID:         "1",
+				Environment:       "production",
+				AccessTokenScopes: input.scopes,
+			})
+			if input.expectErr {
+				if !errors.Is(err, ErrInsufficientScope) {
+					t.Errorf("expected ErrInsufficientScope but got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+
+			if got := atomic.LoadInt32(&calls); got != input.expectCalls {
+				t.Errorf("expected %d calls to system, got %d", input.expectCalls, got)
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationSystemError(t *testing.T) {
+	inputs := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{
+			name:   "Test forbidden status is preserved",
+			status: http.StatusForbidden,
+			body:   `{"error":"Access denied"}`,
+		},
+		{
+			name:   "Test unprocessable entity status is preserved",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"errors":{"environment":["is invalid"]}}`,
+		},
+		{
+			name:   "Test internal server error status is preserved",
+			status: http.StatusInternalServerError,
+			body:   `internal error`,
+		},
+		{
+			name:   "Test service unavailable status is preserved",
+			status: http.StatusServiceUnavailable,
+			body:   `unavailable`,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(input.status)
+				w.Write([]byte(input.body))
+			}))
+			defer server.Close()
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+			_, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+				AccessToken: "any",
+				ServiceID:   "1",
+				Environment: "production",
+			})
+
+			var systemErr SystemError
+			if !errors.As(err, &systemErr) {
+				t.Fatalf("expected SystemError but got %v", err)
+			}
+
+			if systemErr.StatusCode != input.status {
+				t.Errorf("expected status %d but got %d", input.status, systemErr.StatusCode)
+			}
+
+			if systemErr.Body == "" || strings.Contains(systemErr.Body, "code:") {
+				t.Errorf("unexpected body %s", systemErr.Body)
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationLockConflict(t *testing.T) {
+	inputs := []struct {
+		name      string
+		conflicts int32
+		expectErr bool
+	}{
+		{
+			name:      "Test single conflict is retried",
+			conflicts: 1,
+		},
+		{
+			name:      "Test repeated conflict returns ErrLockConflict",
+			conflicts: 2,
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= input.conflicts {
+					w.WriteHeader(http.StatusConflict)
+					w.Write([]byte(`{"status":"Conflict"}`))
+					return
+				}
+				w.Write([]byte(`{"proxy_config":{"id":1,"version":2,"environment":"production","content":{"id":1,"proxy":{"lock_version":3}}}}`))
+			}))
+			defer server.Close()
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+			config, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+				AccessToken: "any",
+				ServiceID:   "1",
+				Environment: "production",
+			})
+
+			if input.expectErr {
+				if !errors.Is(err, ErrLockConflict) {
+					t.Errorf("expected ErrLockConflict but got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if config.Content.Proxy.LockVersion != 3 {
+				t.Errorf("expected latest config to be returned after retry")
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationDefaultEnvironment(t *testing.T) {
+	inputs := []struct {
+		name               string
+		defaultEnvironment string
+		environment        string
+		expectEnvironment  string
+		expectErr          bool
+	}{
+		{
+			name:      "Test environment is required without a default",
+			expectErr: true,
+		},
+		{
+			name:               "Test default is applied to a request without an environment",
+			defaultEnvironment: "production",
+			expectEnvironment:  "production",
+		},
+		{
+			name:               "Test environment on the request overrides the default",
+			defaultEnvironment: "production",
+			environment:        "staging",
+			expectEnvironment:  "staging",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var requestedPath string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestedPath = r.URL.Path
+				w.Write([]byte(`{"proxy_config":{"id":1,"version":2,"environment":"production","content":{"id":1}}}`))
+			}))
+			defer server.Close()
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil, WithDefaultEnvironment(input.defaultEnvironment))
+			_, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+				AccessToken: "any",
+				ServiceID:   "1",
+				Environment: input.environment,
+			})
+
+			if input.expectErr {
+				if err == nil {
+					t.Errorf("expected error for missing environment")
+				}
+				if requestedPath != "" {
+					t.Errorf("expected no call to system for invalid request")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !strings.Contains(requestedPath, "/configs/"+input.expectEnvironment+"/") {
+				t.Errorf("expected config to be fetched for %s but requested %s", input.expectEnvironment, requestedPath)
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationPerAccessToken(t *testing.T) {
+	var lock sync.Mutex
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, token, _ := r.BasicAuth()
+		lock.Lock()
+		calls[token]++
+		lock.Unlock()
+		w.Write([]byte(fmt.Sprintf(`{"proxy_config":{"id":1,"version":2,"environment":"production","content":{"id":1,"backend_version":"%s"}}}`, token)))
+	}))
+	defer server.Close()
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil)
+	defer m.Shutdown()
+
+	get := func(token string) string {
+		t.Helper()
+		config, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+			AccessToken: token,
+			ServiceID:   "1",
+			Environment: "production",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return config.Content.BackendVersion
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := get("tenant_a"); got != "tenant_a" {
+			t.Errorf("expected config fetched with tenant_a, got %s", got)
+		}
+		if got := get("tenant_b"); got != "tenant_b" {
+			t.Errorf("expected config fetched with tenant_b, got %s", got)
+		}
+	}
+
+	systemCache.Refresh()
+
+	lock.Lock()
+	defer lock.Unlock()
+	expect := map[string]int{"tenant_a": 2, "tenant_b": 2}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Errorf("expected each config to be fetched and refreshed with its own token, wanted %v but got %v", expect, calls)
+	}
+
+	for _, entry := range systemCache.Entries() {
+		if strings.Contains(entry.Key, "tenant_") {
+			t.Errorf("expected access token to be hashed in cache key %s", entry.Key)
+		}
+	}
+}
+
+func TestManager_ShutdownCancelsInFlightRefresh(t *testing.T) {
+	var requests int32
+	refreshStarted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write([]byte(`{"proxy_config":{"version":1,"environment":"production"}}`))
+			return
+		}
+		// simulate a slow upstream for every refresh
+		select {
+		case refreshStarted <- struct{}{}:
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second * 10):
+		}
+	}))
+	defer server.Close()
+
+	systemCache := NewSystemCache(SystemCacheConfig{
+		MaxSize:               cache.DefaultCacheLimit,
+		RefreshInterval:       time.Millisecond * 10,
+		NumRetryFailedRefresh: 5,
+		TTL:                   time.Minute,
+	}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil)
+
+	_, err := m.GetSystemConfiguration(server.URL, SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "any",
+		Environment: "production",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	select {
+	case <-refreshStarted:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected background refresh to have started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Errorf("expected shutdown to cancel the in-flight refresh and exit promptly")
+	}
+}
+
+func TestSystemCache_Entries(t *testing.T) {
+	sc := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+	if len(sc.Entries()) != 0 {
+		t.Errorf("expected no entries for empty cache")
+	}
+
+	sc.Set("one", cache.Value{Item: client.ProxyConfig{
+		Version:     2,
+		Environment: "production",
+		Content:     client.Content{ID: 10},
+	}})
+	expired := cache.Value{Item: client.ProxyConfig{Content: client.Content{ID: 11}}}
+	expired.SetExpiry(time.Now().Add(-time.Hour))
+	sc.Set("two", expired)
+
+	entries := sc.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected an entry per cached item, got %d", len(entries))
+	}
+
+	for _, entry := range entries {
+		switch entry.Key {
+		case "one":
+			if entry.ServiceID != "10" || entry.Environment != "production" || entry.Version != 2 {
+				t.Errorf("unexpected metadata for entry %v", entry)
+			}
+			if entry.TTLRemaining <= 0 || entry.TTLRemaining > time.Minute {
+				t.Errorf("unexpected ttl remaining %v", entry.TTLRemaining)
+			}
+		case "two":
+			if entry.TTLRemaining != 0 {
+				t.Errorf("expected expired entry to have no ttl remaining")
+			}
+		default:
+			t.Errorf("unexpected entry %s", entry.Key)
+		}
+	}
+
+	sc.FlushExpired()
+	sc.Delete("one")
+	if len(sc.Entries()) != 0 {
+		t.Errorf("expected entries to reflect evictions")
+	}
+}
+
 // This tests some internal behaviour but since it is critical it warrants its own test
-func TestManager_CacheRefreshCallback(t *testing.T) {
-	const systemURL = "test"
-	const token = "any"
-	const svcID = "any"
-	const env = "test"
+func TestGenerateSystemCacheKey(t *testing.T) {
+	inputs := []struct {
+		name                 string
+		systemURL, serviceID string
+		otherURL, otherID    string
+	}{
+		{
+			name:      "Test url ending in separator does not collide",
+			systemURL: "https://example.com_",
+			serviceID: "1",
+			otherURL:  "https://example.com",
+			otherID:   "_1",
+		},
+		{
+			name:      "Test service containing separator does not collide",
+			systemURL: "https://example.com",
+			serviceID: "a_b",
+			otherURL:  "https://example.com_a",
+			otherID:   "b",
+		},
+		{
+			name:      "Test long urls differing only in query do not collide",
+			systemURL: "https://example.com/?" + strings.Repeat("a", maxSystemURLKeyLength) + "=1",
+			serviceID: "1",
+			otherURL:  "https://example.com/?" + strings.Repeat("a", maxSystemURLKeyLength) + "=2",
+			otherID:   "1",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			key := generateSystemCacheKey(input.systemURL, input.serviceID)
+			other := generateSystemCacheKey(input.otherURL, input.otherID)
+			if key == other {
+				t.Errorf("expected distinct keys, both were %s", key)
+			}
+			if key != generateSystemCacheKey(input.systemURL, input.serviceID) {
+				t.Errorf("expected key to be stable")
+			}
+		})
+	}
+
+	longURL := "https://example.com/?" + strings.Repeat("a", 10*maxSystemURLKeyLength)
+	if key := generateSystemCacheKey(longURL, "1"); len(key) > maxSystemURLKeyLength {
+		t.Errorf("expected key length to be bounded, got %d", len(key))
+	}
+}
+
+func TestManager_SystemConfigFreshness(t *testing.T) {
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+	m := Manager{
+		systemCache: systemCache,
+		metricsReporter: &MetricsReporter{
+			CacheHitCB: func(cache Cache) {
+				t.Errorf("unexpected cache hit reported")
+			},
+		},
+	}
+
+	if _, ok := m.SystemConfigFreshness("test", "1", "production"); ok {
+		t.Errorf("expected missing entry to return false")
+	}
+
+	value := &cache.Value{Item: client.ProxyConfig{Environment: "production"}}
+	value.SetRefreshCallback(func() (client.ProxyConfig, error) {
+		return client.ProxyConfig{}, fmt.Errorf("arbitrary error")
+	})
+	systemCache.Set(generateSystemConfigCacheKey("test", "1", "any"), *value)
+
+	freshness, ok := m.SystemConfigFreshness("test", "1", "production")
+	if !ok {
+		t.Fatalf("expected entry to be present")
+	}
+	if !freshness.Fresh || freshness.TTLRemaining <= 0 || freshness.LastRefreshSuccess.IsZero() {
+		t.Errorf("expected newly cached entry to be fresh, got %+v", freshness)
+	}
+
+	if _, ok := m.SystemConfigFreshness("test", "1", "staging"); ok {
+		t.Errorf("expected entry for another environment to return false")
+	}
+
+	systemCache.Refresh()
+	freshness, _ = m.SystemConfigFreshness("test", "1", "production")
+	if freshness.Fresh || freshness.RefreshFailures != 1 {
+		t.Errorf("expected failed refresh to be reported, got %+v", freshness)
+	}
+}
+
+func TestManager_PeekSystemConfiguration(t *testing.T) {
+	inputs := []struct {
+		name          string
+		cached        bool
+		expired       bool
+		request       SystemRequest
+		expectFound   bool
+		expectExpired bool
+	}{
+		{
+			name:        "Test present config is returned",
+			cached:      true,
+			request:     SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"},
+			expectFound: true,
+		},
+		{
+			name:          "Test expired config is returned without a refresh",
+			cached:        true,
+			expired:       true,
+			request:       SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"},
+			expectFound:   true,
+			expectExpired: true,
+		},
+		{
+			name:        "Test previously resolved system name",
+			cached:      true,
+			request:     SystemRequest{AccessToken: "any", SystemName: "resolved", Environment: "production"},
+			expectFound: true,
+		},
+		{
+			name:    "Test unresolved system name is absent",
+			cached:  true,
+			request: SystemRequest{AccessToken: "any", SystemName: "unresolved", Environment: "production"},
+		},
+		{
+			name:    "Test config for another environment is absent",
+			cached:  true,
+			request: SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "staging"},
+		},
+		{
+			name:    "Test absent config",
+			request: SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+			m := Manager{
+				clientBuilder: mockBuilder{withBuildSystemClientErr: true},
+				systemCache:   systemCache,
+				serviceIDs:    &serviceIDCache{ids: map[string]string{generateSystemCacheKey("test", "resolved"): "1"}},
+				metricsReporter: &MetricsReporter{
+					CacheHitCB: func(cache Cache) {
+						t.Errorf("unexpected cache hit reported")
+					},
+				},
+			}
+
+			if input.cached {
+				value := &cache.Value{Item: client.ProxyConfig{ID: 1, Environment: "production"}}
+				value.SetRefreshCallback(func() (client.ProxyConfig, error) {
+					t.Errorf("unexpected refresh")
+					return client.ProxyConfig{}, fmt.Errorf("arbitrary error")
+				})
+				if input.expired {
+					value.SetExpiry(time.Now().Add(-time.Minute))
+				}
+				systemCache.Set(generateSystemConfigCacheKey("test", "1", "any"), *value)
+			}
+
+			config, meta, found := m.PeekSystemConfiguration("test", input.request)
+			if found != input.expectFound {
+				t.Fatalf("unexpected found result, wanted %t but got %t", input.expectFound, found)
+			}
+			if !found {
+				if config.ID != 0 || meta != (CacheMeta{}) {
+					t.Errorf("expected zero values for absent config")
+				}
+				return
+			}
+
+			if config.ID != 1 {
+				t.Errorf("unexpected config returned %+v", config)
+			}
+			if meta.Expired != input.expectExpired || meta.Fresh == input.expectExpired {
+				t.Errorf("unexpected staleness %+v", meta)
+			}
+			if input.expectExpired && meta.TTLRemaining != 0 {
+				t.Errorf("expected no TTL remaining for expired config, got %v", meta.TTLRemaining)
+			}
+		})
+	}
+
+	if _, _, found := (Manager{}).PeekSystemConfiguration("test", SystemRequest{ServiceID: "1"}); found {
+		t.Errorf("expected no config without a system cache")
+	}
+}
+
+func TestManager_CacheRefreshCallback(t *testing.T) {
+	const systemURL = "test"
+	const token = "any"
+	const svcID = "any"
+	const env = "test"
+
+	m := Manager{}
+	cacheKey := generateSystemConfigCacheKey(systemURL, svcID, token)
+
+	sc := SystemCache{ConfigurationCache: cache.NewDefaultConfigCache()}
+	value := cache.Value{
+		Item: client.ProxyConfig{
+			Environment: "cached",
+		},
+	}
+
+	validRequest := SystemRequest{
+		AccessToken: token,
+		ServiceID:   svcID,
+		Environment: env,
+	}
+
+	var refreshedConf client.ProxyConfig
+	var err error
+	// wrap the callback we know we use internally to provide a hook into whats returned
+	refreshWith := func() (client.ProxyConfig, error) {
+		refreshedConf, err = m.refreshCallback(systemURL, validRequest, 1)()
+		return refreshedConf, err
+	}
+
+	value.SetRefreshCallback(refreshWith)
+	sc.Set(cacheKey, value)
+
+	// inject a builder that fails when the client should be built and expect it to error
+	m.clientBuilder = newMockBuilderWithSystemClientBuildError(t)
+	sc.Refresh()
+
+	if err != nil {
+		fmt.Errorf("expected an error to have been returned")
+	}
+
+	// inject a builder that fails to make a remote connection and expect it to error
+	m.clientBuilder = mockBuilder{
+		withBuildSystemClientErr: false,
+		withSystemClient: mockSystemClient{
+			withErr: true,
+		},
+	}
+	sc.Refresh()
+	if err != nil {
+		fmt.Errorf("expected an error to have been returned")
+	}
+
+	// inject a builder that makes a remote connection and expect no error
+	m.clientBuilder = mockBuilder{
+		withBuildSystemClientErr: false,
+		withSystemClient: mockSystemClient{
+			withErr: false,
+		},
+	}
+	sc.Refresh()
+	if err == nil {
+		fmt.Errorf("unexpected error")
+	}
+
+}
+
+func TestManager_AuthRep(t *testing.T) {
+	inputs := []struct {
+		name             string
+		url              string
+		request          BackendRequest
+		builder          builder
+		expectErr        bool
+		expectAuthorized bool
+	}{
+		{
+			name: "Test expect fail when fail to build a client",
+			// we know we cannot build a client if we dont provide a valid URL
+			builder:   NewClientBuilder(http.DefaultClient),
+			expectErr: true,
+		},
+		{
+			name: "Test expect fail when a bad transaction is provided",
+			url:  "https://somewhere-valid.com",
+			// we can build a client here but expect not to use it
+			builder: NewClientBuilder(http.DefaultClient),
+			request: BackendRequest{
+				Auth: BackendAuth{
+					Type:  "provider_key",
+					Value: "any",
+				},
+				Service:      "any",
+				Transactions: nil,
+			},
+			expectErr: true,
+		},
+		{
+			name: "Test expect error when the client that gets built throws an error",
+			builder: mockBuilder{
+				withBackendClient: mockBackendClient{
+					withAuthRepErr: true,
+				},
+			},
+			request: BackendRequest{
+				Auth: BackendAuth{
+					Type:  "provider_key",
+					Value: "any",
+				},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 5},
+						Params: BackendParams{
+							AppID:  "yes",
+							AppKey: "no",
+							UserID: "maybe",
+						},
+					},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "Test expect end-to-end success and failed auth",
+			builder: mockBuilder{
+				withBackendClient: mockBackendClient{
+					withAuthRepErr: false,
+					withAuthResponse: &threescale.AuthorizeResult{
+						Authorized:          false,
+						ErrorCode:           "some_error",
+						AuthorizeExtensions: threescale.AuthorizeExtensions{},
+					},
+				},
+			},
+			request: BackendRequest{
+				Auth: BackendAuth{
+					Type:  "provider_key",
+					Value: "any",
+				},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 5},
+						Params: BackendParams{
+							AppID:  "yes",
+							AppKey: "no",
+							UserID: "maybe",
+						},
+					},
+				},
+			},
+			expectErr:        false,
+			expectAuthorized: false,
+		},
+		{
+			name: "Test expect end-to-end success",
+			builder: mockBuilder{
+				withBackendClient: mockBackendClient{
+					withAuthRepErr: false,
+					withAuthResponse: &threescale.AuthorizeResult{
+						Authorized: true,
+					},
+				},
+			},
+			request: BackendRequest{
+				Auth: BackendAuth{
+					Type:  "provider_key",
+					Value: "any",
+				},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 5},
+						Params: BackendParams{
+							AppID:  "yes",
+							AppKey: "no",
+							UserID: "maybe",
+						},
+					},
+				},
+			},
+			expectAuthorized: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := Manager{
+				clientBuilder: input.builder,
+			}
+
+			response, err := m.AuthRep(input.url, input.request)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if response.Authorized != input.expectAuthorized {
+				t.Errorf("unexpected auth result")
+			}
+		})
+
+	}
+}
+
+func TestManager_ValidateMetrics(t *testing.T) {
+	config := client.ProxyConfig{
+		Environment: "production",
+		Content: client.Content{
+			ID: 1,
+			Proxy: client.ContentProxy{
+				ProxyRules: []client.ProxyRule{{MetricSystemName: "foo"}},
+			},
+		},
+	}
+
+	newManager := func(warnOnly bool) Manager {
+		m := Manager{
+			clientBuilder: mockBuilder{
+				withSystemClient: mockSystemClient{withConfig: client.ProxyConfigElement{ProxyConfig: config}},
+				withBackendClient: mockBackendClient{
+					withAuthResponse: &threescale.AuthorizeResult{Authorized: true},
+				},
+			},
+			systemCache: NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil),
+			configKeys:  &serviceIDCache{ids: make(map[string]string)},
+			backendConf: BackendConfig{ValidateMetrics: true, ValidateMetricsWarnOnly: warnOnly, Logger: &core.NoOpLogger{}},
+		}
+		if _, err := m.GetSystemConfiguration("test", SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return m
+	}
+
+	inputs := []struct {
+		name          string
+		service       string
+		warnOnly      bool
+		metrics       map[string]int
+		expectUnknown bool
+	}{
+		{
+			name:    "Test known metrics are accepted",
+			service: "1",
+			metrics: map[string]int{"hits": 1, "foo": 1},
+		},
+		{
+			name:          "Test unknown metrics are rejected",
+			service:       "1",
+			metrics:       map[string]int{"hits": 1, "bar": 1, "baz": 1},
+			expectUnknown: true,
+		},
+		{
+			name:     "Test unknown metrics are accepted in warn only mode",
+			service:  "1",
+			warnOnly: true,
+			metrics:  map[string]int{"hits": 1, "bar": 1},
+		},
+		{
+			name:    "Test validation is skipped when config is not cached",
+			service: "2",
+			metrics: map[string]int{"bar": 1},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			resp, err := newManager(input.warnOnly).AuthRep("", BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: input.service,
+				Transactions: []BackendTransaction{
+					{
+						Metrics: input.metrics,
+						Params:  BackendParams{AppID: "any"},
+					},
+				},
+			})
+
+			if input.expectUnknown {
+				if !errors.Is(err, ErrUnknownMetric) {
+					t.Fatalf("expected ErrUnknownMetric but got %v", err)
+				}
+				if !strings.Contains(err.Error(), "bar,baz") {
+					t.Errorf("expected error to list the unknown metrics, got %s", err.Error())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !resp.Authorized {
+				t.Errorf("expected request to be authorized")
+			}
+		})
+	}
+}
+
+func TestManager_MaxMetricsPerTransaction(t *testing.T) {
+	metricsOfSize := func(n int) map[string]int {
+		metrics := make(map[string]int, n)
+		for i := 0; i < n; i++ {
+			metrics[fmt.Sprintf("metric_%d", i)] = 1
+		}
+		return metrics
+	}
+
+	inputs := []struct {
+		name      string
+		limit     int
+		metrics   int
+		expectErr bool
+	}{
+		{
+			name:    "Test default limit is generous",
+			metrics: 100,
+		},
+		{
+			name:      "Test default limit is enforced",
+			metrics:   defaultMaxMetricsPerTransaction + 1,
+			expectErr: true,
+		},
+		{
+			name:    "Test metrics within configured limit",
+			limit:   5,
+			metrics: 5,
+		},
+		{
+			name:      "Test metrics exceeding configured limit",
+			limit:     5,
+			metrics:   6,
+			expectErr: true,
+		},
+		{
+			name:    "Test negative limit disables the check",
+			limit:   -1,
+			metrics: defaultMaxMetricsPerTransaction + 1,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int32
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							atomic.AddInt32(&calls, 1)
+							return &threescale.AuthorizeResult{Authorized: true}, nil
+						},
+					},
+				},
+				backendConf: BackendConfig{MaxMetricsPerTransaction: input.limit},
+			}
+
+			_, err := m.AuthRep("", BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: metricsOfSize(input.metrics),
+						Params:  BackendParams{AppID: "any"},
+					},
+				},
+			})
+
+			if input.expectErr {
+				if !errors.Is(err, ErrTooManyMetrics) {
+					t.Errorf("expected ErrTooManyMetrics but got %v", err)
+				}
+				if calls != 0 {
+					t.Errorf("expected request not to be sent")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestManager_CredentialOverrides(t *testing.T) {
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		CredentialOverrides: CredentialOverrides{
+			Deny:  []string{"leaked", "both"},
+			Allow: []string{"trusted", "both"},
+		},
+	}, nil)
+	defer m.Shutdown()
+
+	var calls int32
+	m.clientBuilder = mockBuilder{
+		withBackendClient: mockBackendClient{
+			withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+				atomic.AddInt32(&calls, 1)
+				return &threescale.AuthorizeResult{Authorized: false, ErrorCode: "from_3scale"}, nil
+			},
+		},
+	}
+
+	requestWith := func(params BackendParams) BackendRequest {
+		return BackendRequest{
+			Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+			Service: "any",
+			Transactions: []BackendTransaction{
+				{
+					Metrics: map[string]int{"hits": 1},
+					Params:  params,
+				},
+			},
+		}
+	}
+
+	inputs := []struct {
+		name            string
+		params          BackendParams
+		reconfigure     *CredentialOverrides
+		expectAuth      bool
+		expectErrorCode string
+		expectRemote    bool
+	}{
+		{
+			name:            "Test denied user key is short circuited",
+			params:          BackendParams{UserKey: "leaked"},
+			expectErrorCode: CredentialDeniedErrorCode,
+		},
+		{
+			name:       "Test allowed app id is short circuited",
+			params:     BackendParams{AppID: "trusted"},
+			expectAuth: true,
+		},
+		{
+			name:            "Test deny takes precedence over allow",
+			params:          BackendParams{AppID: "both"},
+			expectErrorCode: CredentialDeniedErrorCode,
+		},
+		{
+			name:            "Test credentials without override are sent to 3scale",
+			params:          BackendParams{AppID: "other"},
+			expectErrorCode: "from_3scale",
+			expectRemote:    true,
+		},
+		{
+			name:            "Test overrides are replaced on reconfigure",
+			params:          BackendParams{UserKey: "leaked"},
+			reconfigure:     &CredentialOverrides{Deny: []string{"other"}},
+			expectErrorCode: "from_3scale",
+			expectRemote:    true,
+		},
+		{
+			name:            "Test reconfigured deny list is applied",
+			params:          BackendParams{AppID: "other"},
+			expectErrorCode: CredentialDeniedErrorCode,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if input.reconfigure != nil {
+				m.Reconfigure(BackendConfig{CredentialOverrides: *input.reconfigure})
+			}
+
+			before := atomic.LoadInt32(&calls)
+			resp, err := m.AuthRep("", requestWith(input.params))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if resp.Authorized != input.expectAuth || resp.ErrorCode != input.expectErrorCode {
+				t.Errorf("unexpected response %v", resp)
+			}
+
+			if remote := atomic.LoadInt32(&calls) > before; remote != input.expectRemote {
+				t.Errorf("unexpected call to 3scale - expected %t but got %t", input.expectRemote, remote)
+			}
+		})
+	}
+}
+
+func TestManager_PassthroughRetry(t *testing.T) {
+	defer func() { sleep = time.Sleep }()
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	inputs := []struct {
+		name        string
+		failures    int32
+		maxAttempts int
+		expectErr   bool
+		expectCalls int32
+	}{
+		{
+			name:        "Test no retries by default",
+			failures:    1,
+			expectErr:   true,
+			expectCalls: 1,
+		},
+		{
+			name:        "Test retried until success",
+			failures:    2,
+			maxAttempts: 3,
+			expectCalls: 3,
+		},
+		{
+			name:        "Test error returned once attempts are exhausted",
+			failures:    5,
+			maxAttempts: 2,
+			expectErr:   true,
+			expectCalls: 3,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			delays = nil
+			var calls int32
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							if atomic.AddInt32(&calls, 1) <= input.failures {
+								return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+							}
+							return &threescale.AuthorizeResult{Authorized: true}, nil
+						},
+					},
+				},
+				backendConf: BackendConfig{
+					RetryMaxAttempts: input.maxAttempts,
+					RetryBaseDelay:   time.Millisecond,
+					RetryMaxDelay:    time.Millisecond * 4,
+				},
+			}
+
+			_, err := m.AuthRep("", BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{AppID: "any"},
+					},
+				},
+			})
+
+			if (err != nil) != input.expectErr {
+				t.Errorf("unexpected error result %v", err)
+			}
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls but got %d", input.expectCalls, calls)
+			}
+			if len(delays) != int(input.expectCalls-1) {
+				t.Errorf("expected a backoff before each retry")
+			}
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	inputs := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{
+			name: "Test nil error is not retryable",
+		},
+		{
+			name:   "Test connection error is retryable",
+			err:    fmt.Errorf("error calling AuthRep - %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			expect: true,
+		},
+		{
+			name:   "Test timeout is retryable",
+			err:    context.DeadlineExceeded,
+			expect: true,
+		},
+		{
+			name:   "Test server error from backend is retryable",
+			err:    fmt.Errorf("error calling AuthRep - %w", backendStatusError{statusCode: http.StatusBadGateway, err: errors.New("bad gateway")}),
+			expect: true,
+		},
+		{
+			name:   "Test too many requests from system is retryable",
+			err:    fmt.Errorf("unable to fetch required data from 3scale system - %w", SystemError{StatusCode: http.StatusTooManyRequests}),
+			expect: true,
+		},
+		{
+			name:   "Test transient classified response is retryable",
+			err:    backendStatusError{statusCode: http.StatusOK, transient: true, err: errors.New("transient")},
+			expect: true,
+		},
+		{
+			name: "Test client error from system is not retryable",
+			err:  SystemError{StatusCode: http.StatusForbidden},
+		},
+		{
+			name: "Test arbitrary error is not retryable",
+			err:  errors.New("arbitrary error"),
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := IsRetryableError(input.err); got != input.expect {
+				t.Errorf("unexpected result for %v, wanted %t but got %t", input.err, input.expect, got)
+			}
+		})
+	}
+}
+
+func TestManager_RetryableError(t *testing.T) {
+	defer func() { sleep = time.Sleep }()
+	sleep = func(d time.Duration) {}
+
+	errPermanent := errors.New("permanent error")
+	inputs := []struct {
+		name        string
+		predicate   func(error) bool
+		expectCalls int32
+	}{
+		{
+			name:        "Test permanent error is not retried by default",
+			expectCalls: 1,
+		},
+		{
+			name: "Test predicate makes permanent error retryable",
+			predicate: func(err error) bool {
+				return errors.Is(err, errPermanent)
+			},
+			expectCalls: 3,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int32
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							if atomic.AddInt32(&calls, 1) < 3 {
+								return nil, errPermanent
+							}
+							return &threescale.AuthorizeResult{Authorized: true}, nil
+						},
+					},
+				},
+				backendConf: BackendConfig{
+					RetryMaxAttempts: 3,
+					RetryableError:   input.predicate,
+				},
+			}
+
+			_, err := m.AuthRep("", BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{AppID: "any"},
+					},
+				},
+			})
+
+			if (err != nil) != (input.predicate == nil) {
+				t.Errorf("unexpected error result %v", err)
+			}
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls but got %d", input.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestManager_RefreshRetryableError(t *testing.T) {
+	inputs := []struct {
+		name        string
+		predicate   func(error) bool
+		expectCalls int32
+	}{
+		{
+			name:        "Test forbidden is not retried by default",
+			expectCalls: 1,
+		},
+		{
+			name: "Test predicate makes forbidden retryable",
+			predicate: func(err error) bool {
+				var sysErr SystemError
+				return errors.As(err, &sysErr) && sysErr.StatusCode == http.StatusForbidden
+			},
+			expectCalls: 3,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer server.Close()
+
+			systemCache := NewSystemCache(SystemCacheConfig{
+				MaxSize:        cache.DefaultCacheLimit,
+				TTL:            time.Minute,
+				RetryableError: input.predicate,
+			}, nil)
+			m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil)
+			defer m.Shutdown()
+
+			_, err := m.refreshCallback(server.URL, SystemRequest{
+				AccessToken: "any",
+				ServiceID:   "any",
+				Environment: "production",
+			}, 2)()
+			if err == nil {
+				t.Errorf("expected refresh to fail")
+			}
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls but got %d", input.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestManager_RefreshEvictsDeletedService(t *testing.T) {
+	inputs := []struct {
+		name          string
+		configStatus  int
+		servicesXML   string
+		servicesFail  bool
+		expectEvicted bool
+	}{
+		{
+			name:          "Test deleted service is evicted",
+			configStatus:  http.StatusNotFound,
+			servicesXML:   `<services><service><id>2</id></service></services>`,
+			expectEvicted: true,
+		},
+		{
+			name:         "Test service with no config published is kept",
+			configStatus: http.StatusNotFound,
+			servicesXML:  `<services><service><id>1</id></service></services>`,
+		},
+		{
+			name:         "Test service is kept when deletion cannot be confirmed",
+			configStatus: http.StatusNotFound,
+			servicesFail: true,
+		},
+		{
+			name:         "Test service is kept on a transient error",
+			configStatus: http.StatusServiceUnavailable,
+			servicesXML:  `<services></services>`,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var deleted int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/admin/api/services.xml":
+					if input.servicesFail {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					w.Write([]byte(input.servicesXML))
+				case atomic.LoadInt32(&deleted) == 1:
+					w.WriteHeader(input.configStatus)
+					w.Write([]byte(`{"status":"Not found"}`))
+				default:
+					w.Write([]byte(`{"proxy_config":{"id":1,"version":1,"environment":"production","content":{"id":1}}}`))
+				}
+			}))
+			defer server.Close()
+
+			var notified []string
+			systemCache := NewSystemCache(SystemCacheConfig{
+				MaxSize: cache.DefaultCacheLimit,
+				TTL:     time.Minute,
+				OnServiceDeleted: func(systemURL, serviceID string) {
+					notified = append(notified, serviceID)
+				},
+			}, nil)
+			m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil)
+			defer m.Shutdown()
+
+			request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+			if _, err := m.GetSystemConfiguration(server.URL, request); err != nil {
+				t.Fatalf("unexpected error fetching config %v", err)
+			}
+
+			atomic.StoreInt32(&deleted, 1)
+			systemCache.Refresh()
+
+			_, cached := systemCache.Get(generateSystemConfigCacheKey(server.URL, "1", "any"))
+			if cached == input.expectEvicted {
+				t.Errorf("unexpected presence of cached config, wanted evicted %t", input.expectEvicted)
+			}
+			if input.expectEvicted && !reflect.DeepEqual(notified, []string{"1"}) {
+				t.Errorf("expected deletion of service 1 to be notified, got %v", notified)
+			}
+			if !input.expectEvicted && len(notified) > 0 {
+				t.Errorf("unexpected notification of deletion %v", notified)
+			}
+		})
+	}
+}
+
+func TestManager_RetryDelay(t *testing.T) {
+	const samples = 1000
+	base, ceiling := time.Millisecond*10, time.Millisecond*100
+	m := Manager{backendConf: BackendConfig{RetryBaseDelay: base, RetryMaxDelay: ceiling}}
+
+	for attempt := 0; attempt < 8; attempt++ {
+		bound := base * time.Duration(1<<uint(attempt))
+		if bound > ceiling {
+			bound = ceiling
+		}
+
+		var sum, max time.Duration
+		for i := 0; i < samples; i++ {
+			delay := m.retryDelay(attempt)
+			if delay < 0 || delay > bound {
+				t.Fatalf("delay %s for attempt %d outside of jitter bounds [0, %s]", delay, attempt, bound)
+			}
+			sum += delay
+			if delay > max {
+				max = delay
+			}
+		}
+
+		// with full jitter the delays are uniformly distributed so the mean should be close to half the bound
+		mean := sum / samples
+		if mean < bound*4/10 || mean > bound*6/10 {
+			t.Errorf("unexpected mean delay %s for attempt %d with bound %s", mean, attempt, bound)
+		}
+		if max < bound*9/10 {
+			t.Errorf("expected delays to span the jitter range for attempt %d", attempt)
+		}
+	}
+
+	if delay := m.retryDelay(1000); delay > ceiling {
+		t.Errorf("expected delay for large attempts to be capped, got %s", delay)
+	}
+}
+
+func TestManager_AuthRepBatch(t *testing.T) {
+	requestFor := func(service string) BackendRequest {
+		return BackendRequest{
+			Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+			Service: service,
+			Transactions: []BackendTransaction{
+				{
+					Metrics: map[string]int{"hits": 1},
+					Params:  BackendParams{AppID: "any"},
+				},
+			},
+		}
+	}
+
+	var calls int32
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{
+				withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+					atomic.AddInt32(&calls, 1)
+					switch request.Service {
+					case "denied":
+						return &threescale.AuthorizeResult{Authorized: false, ErrorCode: string(request.Service)}, nil
+					case "error":
+						return nil, fmt.Errorf("arbitrary error")
+					default:
+						return &threescale.AuthorizeResult{Authorized: true, ErrorCode: string(request.Service)}, nil
+					}
+				},
+			},
+		},
+	}
+
+	requests := []BackendRequest{requestFor("one"), requestFor("denied"), requestFor("two"), requestFor("one")}
+	responses, err := m.AuthRepBatch("", requests)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if len(responses) != len(requests) || atomic.LoadInt32(&calls) != int32(len(requests)) {
+		t.Fatalf("expected a call and a response per request")
+	}
+
+	for index, response := range responses {
+		if response.ErrorCode != requests[index].Service {
+			t.Errorf("expected response at index %d to be aligned with the request", index)
+		}
+		if response.Authorized != (requests[index].Service != "denied") {
+			t.Errorf("unexpected auth result at index %d", index)
+		}
+	}
+
+	responses, err = m.AuthRepBatch("", []BackendRequest{requestFor("one"), requestFor("error")})
+	if err == nil {
+		t.Errorf("expected error when a batched request fails")
+	}
+
+	if responses[0] == nil || !responses[0].Authorized {
+		t.Errorf("expected successful request to be unaffected by failure in the batch")
+	}
+
+	if responses[1] == nil || responses[1].Authorized {
+		t.Errorf("expected failed request to be unauthorized")
+	}
+}
+
+func TestManager_AuthRepBatchGroupsByService(t *testing.T) {
+	inputs := []struct {
+		name              string
+		maxConcurrent     int
+		services          []string
+		expectConcurrency int
+	}{
+		{
+			name:              "Test services are authorized concurrently",
+			services:          []string{"one", "two", "three", "one", "two", "three"},
+			expectConcurrency: 3,
+		},
+		{
+			name:              "Test concurrency is bounded by the passthrough limit",
+			maxConcurrent:     2,
+			services:          []string{"one", "two", "three", "one", "two", "three"},
+			expectConcurrency: 2,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var lock sync.Mutex
+			inFlight := make(map[string]int)
+			var total, maxTotal int
+			var order []string
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							lock.Lock()
+							inFlight[string(request.Service)]++
+							if inFlight[string(request.Service)] > 1 {
+								t.Errorf("expected the requests of service %s to be made one at a time", request.Service)
+							}
+							total++
+							if total > maxTotal {
+								maxTotal = total
+							}
+							order = append(order, request.Transactions[0].Params.AppID)
+							lock.Unlock()
+
+							time.Sleep(time.Millisecond * 20)
+
+							lock.Lock()
+							inFlight[string(request.Service)]--
+							total--
+							lock.Unlock()
+							return &threescale.AuthorizeResult{Authorized: true, ErrorCode: request.Transactions[0].Params.AppID}, nil
+						},
+					},
+				},
+				limiter:     newConcurrencyLimiter(),
+				backendConf: BackendConfig{MaxConcurrentPassthrough: input.maxConcurrent},
+			}
+
+			var requests []BackendRequest
+			for index, service := range input.services {
+				requests = append(requests, BackendRequest{
+					Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+					Service: service,
+					Transactions: []BackendTransaction{
+						{
+							Metrics: map[string]int{"hits": 1},
+							Params:  BackendParams{AppID: fmt.Sprintf("%s-%d", service, index)},
+						},
+					},
+				})
+			}
+
+			responses, err := m.AuthRepBatch("", requests)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for index, response := range responses {
+				if response.ErrorCode != requests[index].Transactions[0].Params.AppID {
+					t.Errorf("expected response at index %d to be aligned with the request", index)
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if maxTotal != input.expectConcurrency {
+				t.Errorf("expected %d services to be authorized concurrently, got %d", input.expectConcurrency, maxTotal)
+			}
+			seen := make(map[string]int)
+			for _, appID := range order {
+				service := strings.Split(appID, "-")[0]
+				var index int
+				fmt.Sscanf(strings.TrimPrefix(appID, service+"-"), "%d", &index)
+				if index < seen[service] {
+					t.Errorf("expected the requests of service %s to be made in order, got %v", service, order)
+				}
+				seen[service] = index
+			}
+		})
+	}
+}
+
+func TestManager_KeepAlive(t *testing.T) {
+	var pings int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == backendStatusEndpoint {
+			atomic.AddInt32(&pings, 1)
+		}
+	}))
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+		EnableKeepAlive:    true,
+		KeepAliveInterval:  time.Millisecond * 10,
+	}, nil)
+	defer m.Shutdown()
+
+	cb, err := m.newCachedBackend(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating cached backend - %v", err)
+	}
+
+	<-time.After(time.Millisecond * 100)
+	if atomic.LoadInt32(&pings) < 2 {
+		t.Errorf("expected idle backend to have been pinged periodically")
+	}
+
+	cb.markSeen()
+	if cb.isIdle(time.Minute) {
+		t.Errorf("expected backend with recent traffic not to be considered idle")
+	}
+}
+
+func TestManager_FlushEveryNTransactions(t *testing.T) {
+	reports := make(chan struct{}, 10)
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		reports <- struct{}{}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:           true,
+		CacheFlushInterval:      time.Hour,
+		FlushEveryNTransactions: 3,
+	}, nil)
+	defer m.Shutdown()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	authRep := func() {
+		t.Helper()
+		if _, err := m.AuthRep(server.URL, request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	authRep()
+	authRep()
+	select {
+	case <-reports:
+		t.Fatalf("unexpected flush before reaching the transaction threshold")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	authRep()
+	select {
+	case <-reports:
+	case <-time.After(time.Second):
+		t.Errorf("expected flush once the transaction threshold was reached")
+	}
+}
+
+func TestManager_ConfigVersionBumpRefreshesCachedLimits(t *testing.T) {
+	const timeLayout = "2006-01-02 15:04:05 -0700"
+	periodStart := time.Now().UTC().Truncate(time.Minute)
+	periodEnd := periodStart.Add(time.Minute)
+
+	var limit, reports int32 = 1, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/transactions/authorize.xml":
+			fmt.Fprintf(w, `<status><authorized>true</authorized><plan>Basic</plan><usage_reports>
+<usage_report metric="hits" period="minute">
+<period_start>%s</period_start>
+<period_end>%s</period_end>
+<max_value>%d</max_value>
+<current_value>%d</current_value>
+</usage_report></usage_reports></status>`,
+				periodStart.Format(timeLayout), periodEnd.Format(timeLayout),
+				atomic.LoadInt32(&limit), atomic.LoadInt32(&reports))
+		case "/transactions.xml":
+			atomic.AddInt32(&reports, 1)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+	}, nil)
+	defer m.Shutdown()
+
+	withVersion := func(version int) {
+		t.Helper()
+		m.clientBuilder = mockBuilder{withSystemClient: mockSystemClient{
+			withConfig: client.ProxyConfigElement{ProxyConfig: client.ProxyConfig{Version: version}},
+		}}
+		if _, err := m.GetSystemConfiguration("test", SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "1",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+	authorized := func() bool {
+		t.Helper()
+		resp, err := m.AuthRep(server.URL, request)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return resp.Authorized
+	}
+
+	withVersion(1)
+	if !authorized() {
+		t.Fatalf("expected first request to be authorized")
+	}
+	if authorized() {
+		t.Fatalf("expected request exceeding the cached limit to be denied")
+	}
+
+	// the plan limit is raised while requests are in flight
+	atomic.StoreInt32(&limit, 10)
+	withVersion(1)
+	if authorized() {
+		t.Errorf("expected cached limit to be retained while the config version is unchanged")
+	}
+
+	withVersion(2)
+	deadline := time.Now().Add(time.Second)
+	for !authorized() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the raised limit to be applied after the config version changed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if atomic.LoadInt32(&reports) == 0 {
+		t.Errorf("expected pending usage to be reported before refreshing the cached limits")
+	}
+}
+
+func TestManager_NoConfigVersionRefreshAfterShutdown(t *testing.T) {
+	var authorizations int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transactions/authorize.xml" {
+			atomic.AddInt32(&authorizations, 1)
+		}
+		fakeApisonatorHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})(w, r)
+	}))
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+	}, nil)
+
+	if _, err := m.AuthRep(server.URL, BackendRequest{
+		Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+		Service:      "1",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+	}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	m.Shutdown()
+
+	before := atomic.LoadInt32(&authorizations)
+	m.refreshCachedService("1")
+	if m.runInBackgroundUnlessStopped(func() {}) {
+		t.Errorf("expected no background work to be started once shutdown has begun")
+	}
+	<-time.After(time.Millisecond * 20)
+	if got := atomic.LoadInt32(&authorizations); got != before {
+		t.Errorf("expected cached limits not to be refreshed after shutdown, got %d new calls", got-before)
+	}
+}
+
+func TestManager_Drain(t *testing.T) {
+	newBlockingApisonator := func(entered chan struct{}, release chan struct{}, reports *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/transactions/authorize.xml", "/transactions/authrep.xml":
+				select {
+				case entered <- struct{}{}:
+				default:
+				}
+				<-release
+				w.Write([]byte(`<status><authorized>true</authorized><plan>Basic</plan></status>`))
+			case "/transactions.xml":
+				atomic.AddInt32(reports, 1)
+				w.WriteHeader(http.StatusAccepted)
+			}
+		}))
+	}
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	t.Run("Test in-flight calls complete and backends are flushed", func(t *testing.T) {
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		var reports int32
+		server := newBlockingApisonator(entered, release, &reports)
+		defer server.Close()
+
+		m := NewManager(http.DefaultClient, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour}, nil)
+		defer m.Shutdown()
+
+		inFlight := make(chan error, 1)
+		go func() {
+			_, err := m.AuthRep(server.URL, request)
+			inFlight <- err
+		}()
+		<-entered
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		drained := make(chan error, 1)
+		go func() { drained <- m.Drain(ctx) }()
+
+		// wait for draining to start, new calls then fail fast
+		deadline := time.Now().Add(time.Second)
+		for !m.drain.isDraining() {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected draining to start")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := m.AuthRep(server.URL, request); !errors.Is(err, ErrShuttingDown) {
+			t.Errorf("expected new calls to be rejected while draining, got %v", err)
+		}
+
+		select {
+		case err := <-drained:
+			t.Fatalf("expected drain to block on in-flight call, returned %v", err)
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		close(release)
+		if err := <-inFlight; err != nil {
+			t.Errorf("expected in-flight call to complete, got %v", err)
+		}
+		if err := <-drained; err != nil {
+			t.Errorf("unexpected error draining %v", err)
+		}
+		if atomic.LoadInt32(&reports) == 0 {
+			t.Errorf("expected cached backends to be flushed while draining")
+		}
+	})
+
+	t.Run("Test drain returns when the context expires", func(t *testing.T) {
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		var reports int32
+		server := newBlockingApisonator(entered, release, &reports)
+		defer server.Close()
+		defer close(release)
+
+		m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+		defer m.Shutdown()
+
+		go m.AuthRep(server.URL, request)
+		<-entered
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		if err := m.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded error, got %v", err)
+		}
+	})
+}
+
+func TestManager_ActiveFlushGoroutines(t *testing.T) {
+	const backends = 3
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+	}, nil)
+
+	if active := m.ActiveFlushGoroutines(); active != 0 {
+		t.Errorf("expected no flush goroutines before any backend is created, got %d", active)
+	}
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	for i := 0; i < backends; i++ {
+		server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+		defer server.Close()
+
+		// repeated requests reuse the cached backend and its goroutine
+		for j := 0; j < 2; j++ {
+			if _, err := m.AuthRep(server.URL, request); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	}
+
+	if active := m.ActiveFlushGoroutines(); active != backends {
+		t.Errorf("expected a flush goroutine per cached backend, got %d", active)
+	}
+
+	m.Shutdown()
+	if active := m.ActiveFlushGoroutines(); active != 0 {
+		t.Errorf("expected all flush goroutines to exit on shutdown, got %d", active)
+	}
+}
+
+func TestManager_BackendURLRewriter(t *testing.T) {
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	const publicURL = "https://public.apisonator.example.com"
+
+	normalize := func(url string) string {
+		url = strings.TrimSuffix(url, "/")
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		return url
+	}
+
+	inputs := []struct {
+		name          string
+		enableCaching bool
+		rewriter      func(string) string
+		backendURLs   []string
+		expectCached  []string
+	}{
+		{
+			name:          "Test scheme and trailing slash normalized before caching",
+			enableCaching: true,
+			rewriter:      normalize,
+			backendURLs: []string{
+				strings.TrimPrefix(server.URL, "http://") + "/",
+				server.URL + "/",
+				server.URL,
+			},
+			expectCached: []string{server.URL},
+		},
+		{
+			name:          "Test public host rewritten to internal host with caching",
+			enableCaching: true,
+			rewriter: func(url string) string {
+				return strings.Replace(url, publicURL, server.URL, 1)
+			},
+			backendURLs:  []string{publicURL},
+			expectCached: []string{server.URL},
+		},
+		{
+			name: "Test public host rewritten to internal host without caching",
+			rewriter: func(url string) string {
+				return strings.Replace(url, publicURL, server.URL, 1)
+			},
+			backendURLs: []string{publicURL},
+		},
+	}
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				EnableCaching:      input.enableCaching,
+				CacheFlushInterval: time.Hour,
+				BackendURLRewriter: input.rewriter,
+			}, nil)
+			defer m.Shutdown()
+
+			for _, backendURL := range input.backendURLs {
+				resp, err := m.AuthRep(backendURL, request)
+				if err != nil {
+					t.Fatalf("unexpected error for %s - %v", backendURL, err)
+				}
+				if !resp.Authorized {
+					t.Errorf("expected request to %s to be authorized", backendURL)
+				}
+			}
+
+			var cached []string
+			for url := range m.cachedBackends {
+				cached = append(cached, url)
+			}
+			if !reflect.DeepEqual(cached, input.expectCached) {
+				t.Errorf("expected cached backends %v but got %v", input.expectCached, cached)
+			}
+		})
+	}
+}
+
+func TestManager_ProbeOnCreate(t *testing.T) {
+	// grab a free port and release it so that nothing is listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find free port - %v", err)
+	}
+	unreachable := "http://" + listener.Addr().String()
+	listener.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+		ProbeOnCreate:      true,
+	}, nil)
+	defer m.Shutdown()
+
+	if _, err := m.newCachedBackend(unreachable); err == nil {
+		t.Errorf("expected error creating cached backend for unreachable url")
+	}
+
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+
+	if _, err := m.newCachedBackend(server.URL); err != nil {
+		t.Errorf("unexpected error creating cached backend for reachable url - %v", err)
+	}
+}
+
+func TestManager_FlushSkippedWhileInProgress(t *testing.T) {
+	var skipped int32
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		// simulate a slow report which will span multiple flush intervals
+		<-time.After(time.Millisecond * 200)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Millisecond * 10,
+	}, &MetricsReporter{
+		FlushSkippedCB: func(backendURL string) {
+			if backendURL != server.URL {
+				t.Errorf("unexpected backend url %s", backendURL)
+			}
+			atomic.AddInt32(&skipped, 1)
+		},
+	})
+	defer m.Shutdown()
+
+	_, err := m.AuthRep(server.URL, BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	<-time.After(time.Millisecond * 150)
+	if atomic.LoadInt32(&skipped) < 1 {
+		t.Errorf("expected overlapping flushes to have been skipped")
+	}
+}
+
+func TestManager_FlushTimeout(t *testing.T) {
+	var timedOut int32
+	release := make(chan struct{})
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		// simulate a hung apisonator which never responds to reports
+		<-release
+	})
+	defer server.Close()
+	defer close(release)
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Millisecond * 10,
+		FlushTimeout:       time.Millisecond * 50,
+	}, &MetricsReporter{
+		FlushTimeoutCB: func(backendURL string) {
+			if backendURL != server.URL {
+				t.Errorf("unexpected backend url %s", backendURL)
+			}
+			atomic.AddInt32(&timedOut, 1)
+		},
+	})
+	defer m.Shutdown()
+
+	_, err := m.AuthRep(server.URL, BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// a hung flush must be abandoned such that subsequent flushes proceed and time out in turn
+	deadline := time.After(time.Second * 2)
+	for atomic.LoadInt32(&timedOut) < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected consecutive flushes to time out, got %d", atomic.LoadInt32(&timedOut))
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestManager_ShutdownDuringEviction(t *testing.T) {
+	var lock sync.Mutex
+	reported := make(map[string]int)
+	evicting := make(chan struct{})
+	release := make(chan struct{})
+	var reports int32
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("unexpected error parsing report %v", err)
+		}
+		// the first report is that of the evicted application, which is held until shutdown has begun
+		if atomic.AddInt32(&reports, 1) == 1 {
+			close(evicting)
+			<-release
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		hits, _ := strconv.Atoi(r.Form.Get("transactions[0][usage][hits]"))
+		reported[r.Form.Get("transactions[0][app_id]")] += hits
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:         true,
+		CacheFlushInterval:    time.Hour,
+		MaxCachedApplications: 1,
+	}, nil)
+
+	for _, appID := range []string{"first", "second"} {
+		if _, err := m.AuthRep(server.URL, BackendRequest{
+			Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+			Service:      "any",
+			Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: appID}}},
+		}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	select {
+	case <-evicting:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the least recently used application to be evicted")
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+		t.Fatalf("expected shutdown to wait for the eviction")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected shutdown to complete once the eviction has been reported")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if reported["first"] != 1 || reported["second"] != 1 {
+		t.Errorf("expected the usage of every application to be reported exactly once, got %v", reported)
+	}
+}
+
+func TestManager_BackendClientMaxAge(t *testing.T) {
+	var reportedHits int64
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("unexpected error parsing report %v", err)
+		}
+		for key, values := range r.Form {
+			if strings.HasSuffix(key, "[usage][hits]") {
+				value, _ := strconv.ParseInt(values[0], 10, 64)
+				atomic.AddInt64(&reportedHits, value)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	current := time.Now()
+	timeNow = func() time.Time { return current }
+	defer func() { timeNow = time.Now }()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:       true,
+		CacheFlushInterval:  time.Hour,
+		BackendClientMaxAge: time.Minute,
+	}, nil)
+	defer m.Shutdown()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	// the retire channel identifies an instance of a cached backend
+	authRep := func() chan struct{} {
+		if _, err := m.AuthRep(server.URL, request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		m.cachedBackendsLock.RLock()
+		defer m.cachedBackendsLock.RUnlock()
+		return m.cachedBackends[server.URL].retire
+	}
+
+	original := authRep()
+	current = current.Add(time.Second * 30)
+	if authRep() != original {
+		t.Errorf("expected backend to be reused before max age")
+	}
+	if atomic.LoadInt64(&reportedHits) != 0 {
+		t.Errorf("unexpected report before max age")
+	}
+
+	current = current.Add(time.Second * 30)
+	if authRep() == original {
+		t.Errorf("expected backend to be rebuilt after max age")
+	}
+
+	// the expired backend is drained by its final flush in the background
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&reportedHits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if hits := atomic.LoadInt64(&reportedHits); hits != 2 {
+		t.Errorf("expected the usage of the expired backend to be reported once, got %d hits", hits)
+	}
+}
+
+func TestManager_ShutdownFlushesOnce(t *testing.T) {
+	const requests = 10
+
+	for i := 0; i < 20; i++ {
+		t.Run(fmt.Sprintf("Test shutdown with a due flush %d", i), func(t *testing.T) {
+			var reportsWithUsage, reportedHits int64
+			server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("unexpected error parsing report %v", err)
+				}
+				var hits int64
+				for key, values := range r.Form {
+					if strings.HasSuffix(key, "[usage][hits]") {
+						value, _ := strconv.ParseInt(values[0], 10, 64)
+						hits += value
+					}
+				}
+				if hits > 0 {
+					atomic.AddInt64(&reportsWithUsage, 1)
+					atomic.AddInt64(&reportedHits, hits)
+				}
+				w.WriteHeader(http.StatusAccepted)
+			})
+			defer server.Close()
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				EnableCaching:      true,
+				CacheFlushInterval: time.Hour,
+			}, nil)
+
+			for j := 0; j < requests; j++ {
+				_, err := m.AuthRep(server.URL, BackendRequest{
+					Auth:    BackendAuth{Type: "service_token", Value: "any"},
+					Service: "svc",
+					Transactions: []BackendTransaction{
+						{
+							Metrics: map[string]int{"hits": 1},
+							Params:  BackendParams{AppID: "app"},
+						},
+					},
+				})
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+
+			m.cachedBackendsLock.RLock()
+			cb := m.cachedBackends[server.URL]
+			m.cachedBackendsLock.RUnlock()
+
+			// a flush which is due while shutting down must not report the usage a second time
+			go cb.requestFlush()
+			m.Shutdown()
+
+			if hits := atomic.LoadInt64(&reportedHits); hits != requests {
+				t.Errorf("expected %d hits to be reported exactly once, got %d", requests, hits)
+			}
+			if reports := atomic.LoadInt64(&reportsWithUsage); reports != 1 {
+				t.Errorf("expected usage to be reported by a single flush, got %d", reports)
+			}
+		})
+	}
+}
+
+func TestManager_OnReportsDropped(t *testing.T) {
+	inputs := []struct {
+		name          string
+		apps          int
+		flushTimeout  time.Duration
+		reportHandler func(release chan struct{}) http.HandlerFunc
+		expectDropped int
+		expectReason  string
+	}{
+		{
+			name: "Test nothing dropped when the final flush succeeds",
+			apps: 1,
+			reportHandler: func(release chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusAccepted)
+				}
+			},
+		},
+		{
+			name: "Test usage dropped when the final flush fails on shutdown",
+			apps: 1,
+			reportHandler: func(release chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			},
+			expectDropped: 1,
+			expectReason:  ReportsDroppedShutdown,
+		},
+		{
+			name:         "Test usage dropped when the final flush times out",
+			apps:         1,
+			flushTimeout: time.Millisecond * 50,
+			reportHandler: func(release chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					<-release
+				}
+			},
+			expectDropped: 1,
+			expectReason:  ReportsDroppedTimeout,
+		},
+		{
+			name: "Test usage dropped when the flush queue overflows",
+			// the queue of a backend holds 100 applications
+			apps: 101,
+			reportHandler: func(release chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusAccepted)
+				}
+			},
+			expectDropped: 1,
+			expectReason:  ReportsDroppedOverflow,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := newFakeApisonator(t, input.reportHandler(release))
+			defer server.Close()
+			defer close(release)
+
+			var calls int
+			var dropped []BackendTransaction
+			var reason string
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				EnableCaching:      true,
+				CacheFlushInterval: time.Hour,
+				FlushTimeout:       input.flushTimeout,
+				OnReportsDropped: func(backendURL string, transactions []BackendTransaction, r string) {
+					if backendURL != server.URL {
+						t.Errorf("unexpected backend url %s", backendURL)
+					}
+					calls++
+					dropped = transactions
+					reason = r
+				},
+			}, nil)
+
+			for i := 0; i < input.apps; i++ {
+				_, err := m.AuthRep(server.URL, BackendRequest{
+					Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+					Service: "any",
+					Transactions: []BackendTransaction{
+						{
+							Metrics: map[string]int{"hits": 2},
+							Params:  BackendParams{AppID: strconv.Itoa(i)},
+						},
+					},
+				})
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			m.Shutdown()
+
+			if input.expectDropped == 0 {
+				if calls != 0 {
+					t.Errorf("unexpected call reporting %v dropped for %s", dropped, reason)
+				}
+				return
+			}
+
+			if calls != 1 {
+				t.Fatalf("expected a single call, got %d", calls)
+			}
+			if reason != input.expectReason {
+				t.Errorf("unexpected reason, wanted %s but got %s", input.expectReason, reason)
+			}
+			if len(dropped) != input.expectDropped {
+				t.Fatalf("unexpected number of dropped transactions %v", dropped)
+			}
+			if dropped[0].Metrics["hits"] != 2 || dropped[0].Params.AppID == "" {
+				t.Errorf("unexpected dropped transaction %+v", dropped[0])
+			}
+		})
+	}
+}
+
+func TestManager_AuthorizeThenReport(t *testing.T) {
+	const (
+		authorized = `<status><authorized>true</authorized><plan>Basic</plan></status>`
+		overLimit  = `<status><authorized>false</authorized><reason>usage limits are exceeded</reason><plan>Basic</plan></status>`
+	)
+
+	inputs := []struct {
+		name                string
+		authorizeThenReport bool
+		overLimit           bool
+		expectAuthorized    bool
+		expectCalls         map[string]int
+	}{
+		{
+			name:        "Test atomic AuthRep is used by default when over limit",
+			overLimit:   true,
+			expectCalls: map[string]int{"/transactions/authrep.xml": 1},
+		},
+		{
+			name:             "Test atomic AuthRep is used by default when authorized",
+			expectAuthorized: true,
+			expectCalls:      map[string]int{"/transactions/authrep.xml": 1},
+		},
+		{
+			name:                "Test usage is not reported when over limit",
+			authorizeThenReport: true,
+			overLimit:           true,
+			expectCalls:         map[string]int{"/transactions/authorize.xml": 1},
+		},
+		{
+			name:                "Test usage is reported when authorized",
+			authorizeThenReport: true,
+			expectAuthorized:    true,
+			expectCalls:         map[string]int{"/transactions/authorize.xml": 1, "/transactions.xml": 1},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var lock sync.Mutex
+			calls := make(map[string]int)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				calls[r.URL.Path]++
+				lock.Unlock()
+
+				switch r.URL.Path {
+				case "/transactions.xml":
+					w.WriteHeader(http.StatusAccepted)
+				case "/transactions/authorize.xml", "/transactions/authrep.xml":
+					if input.overLimit {
+						w.WriteHeader(http.StatusConflict)
+						w.Write([]byte(overLimit))
+						return
+					}
+					w.Write([]byte(authorized))
+				}
+			}))
+			defer server.Close()
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{AuthorizeThenReport: input.authorizeThenReport}, nil)
+			defer m.Shutdown()
+
+			resp, err := m.AuthRep(server.URL, BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{UserKey: "any"},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if resp.Authorized != input.expectAuthorized {
+				t.Errorf("unexpected authorization result %t", resp.Authorized)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(calls, input.expectCalls) {
+				t.Errorf("unexpected calls to 3scale, wanted %v but got %v", input.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestManager_ServerlessMode(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Millisecond,
+	}, nil, WithServerlessMode())
+	defer m.Shutdown()
+	m.clientBuilder = mockBuilder{
+		withSystemClient: mockSystemClient{
+			withConfig: client.ProxyConfigElement{ProxyConfig: client.ProxyConfig{Environment: "production"}},
+		},
+		withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+	}
+
+	systemRequest := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+	if _, err := m.GetSystemConfiguration("test", systemRequest); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	resp, err := m.AuthRep("test", BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	})
+	if err != nil || !resp.Authorized {
+		t.Fatalf("expected request to be authorized, got %v - %v", resp, err)
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected no goroutines to be spawned, had %d before and %d after", before, after)
+	}
+	if snapshot := m.MetricsSnapshot(); snapshot.CachedBackends != 0 || snapshot.ActiveFlushGoroutines != 0 {
+		t.Errorf("expected requests to be passed through, got %+v", snapshot)
+	}
+}
+
+func TestManager_ServerlessModeRefreshesInline(t *testing.T) {
+	var calls int32
+	var fail int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"proxy_config":{"environment":"production","content":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Millisecond * 20}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil, WithServerlessMode())
+	defer m.Shutdown()
+	m.clientBuilder = NewClientBuilder(http.DefaultClient)
+
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+	get := func() {
+		t.Helper()
+		if _, err := m.GetSystemConfiguration(server.URL, request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	get()
+	get()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected fresh config to be served from the cache, got %d calls", got)
+	}
+
+	<-time.After(time.Millisecond * 30)
+	get()
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("expected expired config to be refreshed inline, got %d calls", got)
+	}
+
+	<-time.After(time.Millisecond * 30)
+	atomic.StoreInt32(&fail, 1)
+	get()
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("expected failed refresh to be attempted, got %d calls", got)
+	}
+}
+
+func TestManager_ClockSkewToleranceDefersExpiry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"proxy_config":{"environment":"production","content":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	systemCache := NewSystemCache(SystemCacheConfig{
+		MaxSize:            cache.DefaultCacheLimit,
+		TTL:                time.Millisecond * 20,
+		ClockSkewTolerance: time.Hour,
+	}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{}, nil, WithServerlessMode())
+	defer m.Shutdown()
+	m.clientBuilder = NewClientBuilder(http.DefaultClient)
+
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+	if _, err := m.GetSystemConfiguration(server.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	<-time.After(time.Millisecond * 30)
+	if _, err := m.GetSystemConfiguration(server.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected config within the tolerance not to be refreshed, got %d calls", got)
+	}
+
+	_, meta, ok := m.PeekSystemConfiguration(server.URL, request)
+	if !ok {
+		t.Fatalf("expected config to be cached")
+	}
+	if meta.Expired || !meta.CacheFreshness.Fresh {
+		t.Errorf("expected config within the tolerance to be fresh, got %+v", meta)
+	}
+	if status := m.Health(); status.StaleConfigs != 0 {
+		t.Errorf("expected no stale configs, got %+v", status)
+	}
+}
 
-	m := Manager{}
-	cacheKey := generateSystemCacheKey(systemURL, svcID)
+func TestManager_ClassifyResponse(t *testing.T) {
+	const timeLayout = "2006-01-02 15:04:05 -0700"
+	periodStart := time.Now().UTC().Truncate(time.Minute)
+	periodEnd := periodStart.Add(time.Minute)
+	deniedBody := fmt.Sprintf(`<status><authorized>false</authorized><reason>usage limits are exceeded</reason><plan>Basic</plan><usage_reports>
+<usage_report metric="hits" period="minute">
+<period_start>%s</period_start>
+<period_end>%s</period_end>
+<max_value>1</max_value>
+<current_value>1</current_value>
+</usage_report></usage_reports></status>`, periodStart.Format(timeLayout), periodEnd.Format(timeLayout))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(deniedBody))
+	}))
+	defer server.Close()
 
-	sc := SystemCache{ConfigurationCache: cache.NewDefaultConfigCache()}
-	value := cache.Value{
-		Item: client.ProxyConfig{
-			Environment: "cached",
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{UserKey: "any"},
+			},
 		},
 	}
 
-	validRequest := SystemRequest{
-		AccessToken: token,
-		ServiceID:   svcID,
-		Environment: env,
+	inputs := []struct {
+		name          string
+		transient     bool
+		expectErr     bool
+		expectAuthRes bool
+	}{
+		{
+			name:          "Test custom classification overrides built-in classification",
+			expectAuthRes: true,
+		},
+		{
+			name:      "Test transient classification returns an error",
+			transient: true,
+			expectErr: true,
+		},
 	}
 
-	var refreshedConf client.ProxyConfig
-	var err error
-	// wrap the callback we know we use internally to provide a hook into whats returned
-	refreshWith := func() (client.ProxyConfig, error) {
-		refreshedConf, err = m.refreshCallback(systemURL, validRequest, 1)()
-		return refreshedConf, err
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				ClassifyResponse: func(status int, body []byte) (bool, string, string, bool) {
+					if status != http.StatusConflict {
+						t.Errorf("unexpected status %d", status)
+					}
+					if string(body) != deniedBody {
+						t.Errorf("expected raw body to be captured, got %s", string(body))
+					}
+					return true, "custom_code", "custom reason", input.transient
+				},
+			}, nil)
+			defer m.Shutdown()
+
+			resp, err := m.AuthRep(server.URL, request)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				if resp == nil || resp.Authorized {
+					t.Errorf("expected transient response to be unauthorized")
+				}
+				return
+			}
+
+			if input.expectErr {
+				t.Errorf("expected an error")
+			}
+
+			if resp.Authorized != input.expectAuthRes || resp.ErrorCode != "custom_code" || resp.RejectedReason != "custom reason" {
+				t.Errorf("unexpected response %v", resp)
+			}
+			if !resp.LimitReset.Equal(periodEnd) {
+				t.Errorf("expected limit reset %s to be copied from the usage reports, got %s", periodEnd, resp.LimitReset)
+			}
+		})
 	}
+}
 
-	value.SetRefreshCallback(refreshWith)
-	sc.Set(cacheKey, value)
+func TestManager_WithDialContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/api/") {
+			w.Write([]byte(`{"proxy_config":{"id":1,"version":2,"environment":"production","content":{"id":1}}}`))
+			return
+		}
+		fakeApisonatorHandler(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	}))
+	defer server.Close()
 
-	// inject a builder that fails when the client should be built and expect it to error
-	m.clientBuilder = newMockBuilderWithSystemClientBuildError(t)
-	sc.Refresh()
+	var lock sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, addr)
+		lock.Unlock()
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+	}
 
+	m := NewManager(&http.Client{Transport: &http.Transport{}}, nil, BackendConfig{}, nil, WithDialContext(dial))
+
+	_, err := m.GetSystemConfiguration("http://system.private", SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "1",
+		Environment: "production",
+	})
 	if err != nil {
-		fmt.Errorf("expected an error to have been returned")
+		t.Fatalf("unexpected error fetching config %v", err)
 	}
 
-	// inject a builder that fails to make a remote connection and expect it to error
-	m.clientBuilder = mockBuilder{
-		withBuildSystemClientErr: false,
-		withSystemClient: mockSystemClient{
-			withErr: true,
+	resp, err := m.AuthRep("http://backend.private:3000", BackendRequest{
+		Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+		Service:      "1",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+	})
+	if err != nil || !resp.Authorized {
+		t.Fatalf("expected request to be authorized via the custom dialer, got %v, %v", resp, err)
+	}
+
+	expect := []string{"system.private:80", "backend.private:3000"}
+	if !reflect.DeepEqual(dialed, expect) {
+		t.Errorf("unexpected addresses dialed, wanted %v but got %v", expect, dialed)
+	}
+}
+
+func TestManager_CachedAuthRepRecoversFromPanic(t *testing.T) {
+	var passthroughCalls int
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{
+				withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+					passthroughCalls++
+					return &threescale.AuthorizeResult{Authorized: true}, nil
+				},
+			},
 		},
+		backendConf: BackendConfig{EnableCaching: true, Logger: &core.NoOpLogger{}},
+		// a zero value backend has no cache and panics when used, simulating a backend in a bad state
+		cachedBackends:     map[string]cachedBackend{"test": {backend: &backend.Backend{}}},
+		cachedBackendsLock: &sync.RWMutex{},
 	}
-	sc.Refresh()
+
+	resp, err := m.AuthRep("test", BackendRequest{
+		Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+		Service:      "any",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+	})
 	if err != nil {
-		fmt.Errorf("expected an error to have been returned")
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !resp.Authorized || passthroughCalls != 1 {
+		t.Errorf("expected request to be authorized via passthrough, got %+v after %d calls", resp, passthroughCalls)
 	}
 
-	// inject a builder that makes a remote connection and expect no error
-	m.clientBuilder = mockBuilder{
-		withBuildSystemClientErr: false,
-		withSystemClient: mockSystemClient{
-			withErr: false,
+	if _, ok := m.cachedBackends["test"]; ok {
+		t.Errorf("expected the bad cached backend to be removed")
+	}
+}
+
+func TestManager_AuthRepOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apisonator")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "apisonator.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unable to listen on unix socket - %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(fakeApisonatorHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
 		},
 	}
-	sc.Refresh()
-	if err == nil {
-		fmt.Errorf("unexpected error")
+
+	for _, enableCaching := range []bool{false, true} {
+		m := NewManager(http.DefaultClient, nil, BackendConfig{
+			EnableCaching:      enableCaching,
+			CacheFlushInterval: time.Minute,
+		}, nil)
+
+		resp, err := m.AuthRep("unix://"+socketPath, request)
+		if err != nil {
+			t.Fatalf("unexpected error with caching enabled %t - %v", enableCaching, err)
+		}
+		if !resp.Authorized {
+			t.Errorf("expected request to be authorized over unix socket")
+		}
+		m.Shutdown()
 	}
 
+	m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+	if _, err := m.AuthRep("unix://"+filepath.Join(dir, "missing.sock"), request); err == nil {
+		t.Errorf("expected error when socket does not exist")
+	}
 }
 
-func TestManager_AuthRep(t *testing.T) {
+func TestManager_AuthRepInvalidAuthType(t *testing.T) {
 	inputs := []struct {
-		name             string
-		url              string
-		request          BackendRequest
-		builder          builder
-		expectErr        bool
-		expectAuthorized bool
+		name      string
+		authType  string
+		expectErr bool
 	}{
 		{
-			name: "Test expect fail when fail to build a client",
-			// we know we cannot build a client if we dont provide a valid URL
-			builder:   NewClientBuilder(http.DefaultClient),
-			expectErr: true,
+			name:     "Test provider key is valid",
+			authType: AuthTypeProviderKey,
 		},
 		{
-			name: "Test expect fail when a bad transaction is provided",
-			url:  "https://somewhere-valid.com",
-			// we can build a client here but expect not to use it
-			builder: NewClientBuilder(http.DefaultClient),
-			request: BackendRequest{
-				Auth: BackendAuth{
-					Type:  "any",
-					Value: "any",
-				},
-				Service:      "any",
-				Transactions: nil,
-			},
+			name:     "Test service token is valid",
+			authType: AuthTypeServiceToken,
+		},
+		{
+			name:      "Test typo is invalid",
+			authType:  "providerkey",
 			expectErr: true,
 		},
 		{
-			name: "Test expect error when the client that gets built throws an error",
-			builder: mockBuilder{
-				withBackendClient: mockBackendClient{
-					withAuthRepErr: true,
-				},
-			},
-			request: BackendRequest{
-				Auth: BackendAuth{
-					Type:  "any",
-					Value: "any",
-				},
-				Service: "any",
-				Transactions: []BackendTransaction{
-					{
-						Metrics: map[string]int{"hits": 5},
-						Params: BackendParams{
-							AppID:  "yes",
-							AppKey: "no",
-							UserID: "maybe",
-						},
-					},
-				},
-			},
+			name:      "Test type is case sensitive",
+			authType:  "Service_Token",
 			expectErr: true,
 		},
 		{
-			name: "Test expect end-to-end success and failed auth",
-			builder: mockBuilder{
-				withBackendClient: mockBackendClient{
-					withAuthRepErr: false,
-					withAuthResponse: &threescale.AuthorizeResult{
-						Authorized:          false,
-						ErrorCode:           "some_error",
-						AuthorizeExtensions: threescale.AuthorizeExtensions{},
-					},
-				},
-			},
-			request: BackendRequest{
-				Auth: BackendAuth{
-					Type:  "any",
-					Value: "any",
-				},
-				Service: "any",
-				Transactions: []BackendTransaction{
-					{
-						Metrics: map[string]int{"hits": 5},
-						Params: BackendParams{
-							AppID:  "yes",
-							AppKey: "no",
-							UserID: "maybe",
+			name:      "Test empty type is invalid",
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							calls++
+							return &threescale.AuthorizeResult{Authorized: true}, nil
 						},
 					},
 				},
-			},
-			expectErr:        false,
-			expectAuthorized: false,
+			}
+
+			request := BackendRequest{
+				Auth:         BackendAuth{Type: input.authType, Value: "any"},
+				Service:      "any",
+				Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+			}
+
+			_, err := m.AuthRep("", request)
+			_, toAPIErr := request.ToAPIRequest()
+			if !input.expectErr {
+				if err != nil || toAPIErr != nil {
+					t.Errorf("unexpected error %v, %v", err, toAPIErr)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidAuthType) || !errors.Is(toAPIErr, ErrInvalidAuthType) {
+				t.Errorf("expected ErrInvalidAuthType but got %v, %v", err, toAPIErr)
+			}
+			if calls != 0 {
+				t.Errorf("expected no call to be made to 3scale for an invalid auth type")
+			}
+		})
+	}
+}
+
+func TestBackendAuthConstructors(t *testing.T) {
+	if auth := ProviderKeyAuth("key"); auth != (BackendAuth{Type: "provider_key", Value: "key"}) {
+		t.Errorf("unexpected provider key auth %+v", auth)
+	}
+	if auth := ServiceTokenAuth("token"); auth != (BackendAuth{Type: "service_token", Value: "token"}) {
+		t.Errorf("unexpected service token auth %+v", auth)
+	}
+}
+
+func TestBackendRequest_ToAPIRequestServiceTokenRequiresService(t *testing.T) {
+	inputs := []struct {
+		name      string
+		auth      BackendAuth
+		service   string
+		expectErr bool
+	}{
+		{
+			name:    "Test service token with a service",
+			auth:    ServiceTokenAuth("token"),
+			service: "1",
 		},
 		{
-			name: "Test expect end-to-end success",
-			builder: mockBuilder{
-				withBackendClient: mockBackendClient{
-					withAuthRepErr: false,
-					withAuthResponse: &threescale.AuthorizeResult{
-						Authorized: true,
-					},
-				},
-			},
-			request: BackendRequest{
-				Auth: BackendAuth{
-					Type:  "any",
-					Value: "any",
-				},
-				Service: "any",
-				Transactions: []BackendTransaction{
-					{
-						Metrics: map[string]int{"hits": 5},
-						Params: BackendParams{
-							AppID:  "yes",
-							AppKey: "no",
-							UserID: "maybe",
-						},
-					},
-				},
-			},
-			expectAuthorized: true,
+			name:      "Test service token without a service",
+			auth:      ServiceTokenAuth("token"),
+			expectErr: true,
+		},
+		{
+			name: "Test provider key without a service",
+			auth: ProviderKeyAuth("key"),
 		},
 	}
 
 	for _, input := range inputs {
 		t.Run(input.name, func(t *testing.T) {
-			m := Manager{
-				clientBuilder: input.builder,
+			request := BackendRequest{
+				Auth:         input.auth,
+				Service:      input.service,
+				Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
 			}
 
-			response, err := m.AuthRep(input.url, input.request)
-			if err != nil {
-				if !input.expectErr {
-					t.Errorf("unexpected error %v", err)
+			apiReq, err := request.ToAPIRequest()
+			if input.expectErr {
+				if err == nil {
+					t.Errorf("expected an error for service token auth without a service")
 				}
 				return
 			}
 
-			if response.Authorized != input.expectAuthorized {
-				t.Errorf("unexpected auth result")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if string(apiReq.Auth.Type) != input.auth.Type || apiReq.Auth.Value != input.auth.Value {
+				t.Errorf("unexpected auth in request %+v", apiReq.Auth)
 			}
 		})
-
 	}
 }
 
 func TestBackendRequest_ToAPIRequest(t *testing.T) {
 	badRequestWithNilTransaction := BackendRequest{
 		Auth: BackendAuth{
-			Type:  "any",
+			Type:  "provider_key",
 			Value: "any",
 		},
 		Service:      "any",
@@ -453,7 +3413,7 @@ func TestBackendRequest_ToAPIRequest(t *testing.T) {
 
 	badRequestWithEmptyTransaction := BackendRequest{
 		Auth: BackendAuth{
-			Type:  "any",
+			Type:  "provider_key",
 			Value: "any",
 		},
 		Service:      "any",
@@ -466,7 +3426,7 @@ func TestBackendRequest_ToAPIRequest(t *testing.T) {
 
 	validRequest := BackendRequest{
 		Auth: BackendAuth{
-			Type:  "any",
+			Type:  "provider_key",
 			Value: "any",
 		},
 		Service: "any",
@@ -489,7 +3449,7 @@ func TestBackendRequest_ToAPIRequest(t *testing.T) {
 
 	expect := &threescale.Request{
 		Auth: api.ClientAuth{
-			Type:  api.AuthType("any"),
+			Type:  api.ProviderKey,
 			Value: "any",
 		},
 		Extensions: api.Extensions{
@@ -515,13 +3475,68 @@ func TestBackendRequest_ToAPIRequest(t *testing.T) {
 	}
 }
 
+func TestBackendRequest_ToAPIRequestSerializesDeterministically(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		fakeApisonatorHandler(nil)(w, r)
+	}))
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+	const builds = 10
+	for i := 0; i < builds; i++ {
+		// each build populates a new map so that iteration order is not carried over
+		metrics := make(map[string]int)
+		for j, metric := range []string{"zeta", "hits", "alpha", "beta", "hits_2", "omega"} {
+			metrics[metric] = j + 1
+		}
+		_, err := m.AuthRep(server.URL, BackendRequest{
+			Auth:         BackendAuth{Type: AuthTypeProviderKey, Value: "any"},
+			Service:      "any",
+			Transactions: []BackendTransaction{{Metrics: metrics, Params: BackendParams{AppID: "any", UserID: "user"}}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	if len(queries) != builds {
+		t.Fatalf("expected %d requests but got %d", builds, len(queries))
+	}
+	expect := "app_id=any&provider_key=any&service_id=any&usage%5Balpha%5D=3&usage%5Bbeta%5D=4&usage%5Bhits%5D=2&" +
+		"usage%5Bhits_2%5D=5&usage%5Bomega%5D=6&usage%5Bzeta%5D=1&user_id=user"
+	for i, query := range queries {
+		if query != expect {
+			t.Errorf("unexpected serialization of build %d, wanted %s but got %s", i, expect, query)
+		}
+	}
+}
+
+// newFakeApisonator returns a test server which authorizes all requests, delegating reports to the provided handler
+func newFakeApisonator(t *testing.T, reportHandler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(fakeApisonatorHandler(reportHandler))
+}
+
+func fakeApisonatorHandler(reportHandler http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/transactions/authorize.xml", "/transactions/authrep.xml":
+			w.Write([]byte(`<status><authorized>true</authorized><plan>Basic</plan></status>`))
+		case "/transactions.xml":
+			reportHandler(w, r)
+		}
+	})
+}
+
 type mockBuilder struct {
 	withBuildSystemClientErr bool
 	withSystemClient         mockSystemClient
 	withBackendClient        mockBackendClient
 }
 
-func (m mockBuilder) BuildSystemClient(systemURL, accessToken string) (SystemClient, error) {
+func (m mockBuilder) BuildSystemClientWithContext(ctx context.Context, systemURL, accessToken string) (SystemClient, error) {
 	if m.withBuildSystemClientErr {
 		return mockSystemClient{}, fmt.Errorf("arbitary error")
 	}
@@ -538,8 +3553,11 @@ func newMockBuilderWithSystemClientBuildError(t *testing.T) mockBuilder {
 }
 
 type mockSystemClient struct {
-	withErr    bool
-	withConfig client.ProxyConfigElement
+	withErr      bool
+	withConfig   client.ProxyConfigElement
+	withServices client.ServiceList
+	// listServicesCalls, if set, is incremented on each call to list services
+	listServicesCalls *int32
 }
 
 func (m mockSystemClient) GetLatestProxyConfig(serviceID, environment string) (client.ProxyConfigElement, error) {
@@ -549,9 +3567,21 @@ func (m mockSystemClient) GetLatestProxyConfig(serviceID, environment string) (c
 	return m.withConfig, nil
 }
 
+func (m mockSystemClient) ListServices() (client.ServiceList, error) {
+	if m.listServicesCalls != nil {
+		atomic.AddInt32(m.listServicesCalls, 1)
+	}
+	if m.withErr {
+		return client.ServiceList{}, fmt.Errorf("arbitrary error")
+	}
+	return m.withServices, nil
+}
+
 type mockBackendClient struct {
 	withAuthRepErr   bool
 	withAuthResponse *threescale.AuthorizeResult
+	// withAuthRepCb, if set, takes precedence over the static response and error
+	withAuthRepCb func(request threescale.Request) (*threescale.AuthorizeResult, error)
 }
 
 func (mbc mockBackendClient) Authorize(request threescale.Request) (*threescale.AuthorizeResult, error) {
@@ -559,6 +3589,9 @@ func (mbc mockBackendClient) Authorize(request threescale.Request) (*threescale.
 }
 
 func (mbc mockBackendClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	if mbc.withAuthRepCb != nil {
+		return mbc.withAuthRepCb(request)
+	}
 	if mbc.withAuthRepErr {
 		return nil, fmt.Errorf("arbitrary error")
 	}
@@ -1,9 +1,14 @@
 package authorizer
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 
 	"github.com/3scale/3scale-go-client/threescale"
@@ -11,15 +16,23 @@ import (
 	system "github.com/3scale/3scale-porta-go-client/client"
 )
 
+const (
+	// unixSocketScheme identifies a backend URL as the path to a Unix domain socket
+	unixSocketScheme = "unix"
+	// unixSocketHost is the host used in requests sent over a Unix domain socket
+	unixSocketHost = "localhost"
+)
+
 // builder provides an interface required by the adapter to complete authorization
 type builder interface {
-	BuildSystemClient(systemURL, accessToken string) (SystemClient, error)
+	BuildSystemClientWithContext(ctx context.Context, systemURL, accessToken string) (SystemClient, error)
 	BuildBackendClient(backendURL string) (threescale.Client, error)
 }
 
 // SystemClient provides a minimalist interface for the adapters requirements from 3scale system
 type SystemClient interface {
 	GetLatestProxyConfig(serviceID, environment string) (system.ProxyConfigElement, error)
+	ListServices() (system.ServiceList, error)
 }
 
 // ClientBuilder builds the 3scale clients, injecting the underlying HTTP client
@@ -35,6 +48,13 @@ func NewClientBuilder(httpClient *http.Client) *ClientBuilder {
 // BuildSystemClient builds a 3scale porta client from the provided URL(raw string)
 // The provided 'systemURL' must be prepended with a valid scheme
 func (cb ClientBuilder) BuildSystemClient(systemURL, accessToken string) (SystemClient, error) {
+	return cb.BuildSystemClientWithContext(context.Background(), systemURL, accessToken)
+}
+
+// BuildSystemClientWithContext builds a 3scale porta client from the provided URL(raw string)
+// All requests made by the client are bound to the provided context and are aborted when it is done
+// The provided 'systemURL' must be prepended with a valid scheme
+func (cb ClientBuilder) BuildSystemClientWithContext(ctx context.Context, systemURL, accessToken string) (SystemClient, error) {
 	var client SystemClient
 	sysURL, err := url.ParseRequestURI(systemURL)
 	if err != nil {
@@ -47,20 +67,208 @@ func (cb ClientBuilder) BuildSystemClient(systemURL, accessToken string) (System
 		return client, err
 	}
 
-	return system.NewThreeScale(ap, accessToken, cb.httpClient), nil
+	return system.NewThreeScale(ap, accessToken, cb.httpClientWithContext(ctx)), nil
 }
 
 // BuildBackendClient builds a 3scale apisonator http client
 // The provided 'backendURL' must be prepended with a valid scheme
+// A 'unix' scheme may be used to connect to a backend listening on a Unix domain socket, for example unix:///path/to/socket
 func (cb ClientBuilder) BuildBackendClient(backendURL string) (threescale.Client, error) {
-	return apisonator.NewClient(backendURL, cb.httpClient)
+	backendURL, httpClient, err := resolveBackendTransport(backendURL, cb.httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return apisonator.NewClient(backendURL, httpClient)
+}
+
+// resolveBackendTransport returns the URL and http client which should be used to connect to the backend
+// For backends listening on a Unix domain socket, the returned client dials the socket and the URL is rewritten
+// to a http URL which is suitable for building requests. Other backends are returned as is.
+func resolveBackendTransport(backendURL string, httpClient *http.Client) (string, *http.Client, error) {
+	parsed, err := url.Parse(backendURL)
+	if err != nil || parsed.Scheme != unixSocketScheme {
+		return backendURL, httpClient, nil
+	}
+
+	socketPath := parsed.Host + parsed.Path
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to use unix socket for backend - %s", err.Error())
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return "", nil, fmt.Errorf("unable to use unix socket for backend - %s is not a socket", socketPath)
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	transport, err := withBaseTransport(httpClient.Transport, func(base *http.Transport) http.RoundTripper {
+		unixTransport := base.Clone()
+		unixTransport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		return unixTransport
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	unixClient := *httpClient
+	unixClient.Transport = transport
+	return "http://" + unixSocketHost, &unixClient, nil
+}
+
+// DialContextFunc dials a connection to the provided address, with the same semantics as net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// withDialContext returns a copy of the provided http client which dials its connections via the provided function
+func withDialContext(httpClient *http.Client, dial DialContextFunc) (*http.Client, error) {
+	transport, err := withBaseTransport(httpClient.Transport, func(base *http.Transport) http.RoundTripper {
+		dialTransport := base.Clone()
+		dialTransport.DialContext = dial
+		return dialTransport
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dialClient := *httpClient
+	dialClient.Transport = transport
+	return &dialClient, nil
+}
+
+// withBaseTransport replaces the *http.Transport at the base of the provided chain of round trippers
+// The chain is copied and the original left unmodified
+func withBaseTransport(rt http.RoundTripper, replace func(base *http.Transport) http.RoundTripper) (http.RoundTripper, error) {
+	var err error
+	switch t := rt.(type) {
+	case nil:
+		return withBaseTransport(http.DefaultTransport, replace)
+	case *http.Transport:
+		return replace(t), nil
+	case *MetricsTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	case *bodyCapturingTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	case *contextTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	case *requestObserverTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	case *statsTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	case *faultTransport:
+		wrapped := *t
+		wrapped.next, err = withBaseTransport(t.next, replace)
+		return &wrapped, err
+	default:
+		return nil, fmt.Errorf("unsupported transport %T", rt)
+	}
+}
+
+// httpClientWithContext returns a copy of the underlying http client which binds its requests to the provided context
+func (cb ClientBuilder) httpClientWithContext(ctx context.Context) *http.Client {
+	httpClient := http.DefaultClient
+	if cb.httpClient != nil {
+		httpClient = cb.httpClient
+	}
+
+	if ctx == nil || ctx == context.Background() {
+		return httpClient
+	}
+
+	return withTransport(httpClient, func(next http.RoundTripper) http.RoundTripper {
+		return &contextTransport{ctx: ctx, next: next}
+	})
+}
+
+// withTransport returns a copy of the provided http client, with its transport wrapped by the provided function
+func withTransport(httpClient *http.Client, wrap func(next http.RoundTripper) http.RoundTripper) *http.Client {
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrapped := *httpClient
+	wrapped.Transport = wrap(transport)
+	return &wrapped
+}
+
+// contextTransport is a http.RoundTripper which binds every request made through it to a context
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (ct *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return ct.next.RoundTrip(req.WithContext(ct.ctx))
+}
+
+// bodyCapturingTransport is a http.RoundTripper which retains a copy of each response body
+// so that it remains available after the body has been consumed by the client
+type bodyCapturingTransport struct {
+	next http.RoundTripper
+}
+
+// capturedBody replaces a response body and holds a copy of its content
+type capturedBody struct {
+	*bytes.Reader
+	raw []byte
+}
+
+func (cb *capturedBody) Close() error {
+	return nil
+}
+
+func (ct *bodyCapturingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ct.next.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = newCapturedBody(raw)
+	return resp, nil
+}
+
+func newCapturedBody(raw []byte) *capturedBody {
+	return &capturedBody{Reader: bytes.NewReader(raw), raw: raw}
+}
+
+// capturedResponse returns the status code and body captured for a raw response returned by the 3scale client
+// Returns false if the raw response is not a http response
+func capturedResponse(rawResponse interface{}) (int, []byte, bool) {
+	resp, ok := rawResponse.(*http.Response)
+	if !ok || resp == nil {
+		return 0, nil, false
+	}
+
+	var body []byte
+	if captured, ok := resp.Body.(*capturedBody); ok {
+		body = captured.raw
+	}
+	return resp.StatusCode, body, true
 }
 
 func (cb ClientBuilder) parseURL(url *url.URL) (string, string, int) {
-	var scheme string
+	scheme := url.Scheme
 	host, port, _ := net.SplitHostPort(url.Host)
 	if port == "" {
-		scheme = url.Scheme
 		if scheme == "http" {
 			port = "80"
 		} else if scheme == "https" {
@@ -2,6 +2,7 @@ package authorizer
 
 import (
 	"net/http"
+	"net/url"
 	"testing"
 )
 
@@ -45,3 +46,57 @@ func TestClientBuilder_BuildBackendClient(t *testing.T) {
 	}
 
 }
+
+func TestClientBuilder_parseURL(t *testing.T) {
+	inputs := []struct {
+		name         string
+		url          string
+		expectScheme string
+		expectHost   string
+		expectPort   int
+	}{
+		{
+			name:         "Test http defaults to port 80",
+			url:          "http://expect.pass",
+			expectScheme: "http",
+			expectHost:   "expect.pass",
+			expectPort:   80,
+		},
+		{
+			name:         "Test https defaults to port 443",
+			url:          "https://expect.pass",
+			expectScheme: "https",
+			expectHost:   "expect.pass",
+			expectPort:   443,
+		},
+		{
+			name:         "Test scheme is kept with an explicit port",
+			url:          "http://127.0.0.1:3000",
+			expectScheme: "http",
+			expectHost:   "127.0.0.1",
+			expectPort:   3000,
+		},
+		{
+			name:         "Test https scheme is kept with an explicit port",
+			url:          "https://expect.pass:8443",
+			expectScheme: "https",
+			expectHost:   "expect.pass",
+			expectPort:   8443,
+		},
+	}
+
+	builder := NewClientBuilder(http.DefaultClient)
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, err := url.Parse(input.url)
+			if err != nil {
+				t.Fatalf("unexpected error parsing url %v", err)
+			}
+			scheme, host, port := builder.parseURL(u)
+			if scheme != input.expectScheme || host != input.expectHost || port != input.expectPort {
+				t.Errorf("expected %s %s %d but got %s %s %d",
+					input.expectScheme, input.expectHost, input.expectPort, scheme, host, port)
+			}
+		})
+	}
+}
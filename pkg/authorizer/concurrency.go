@@ -0,0 +1,83 @@
+package authorizer
+
+import (
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of calls in flight to each backend
+type concurrencyLimiter struct {
+	limits map[string]*backendLimit
+	sync.Mutex
+}
+
+// backendLimit holds a slot for each call in flight to a backend and counts the calls waiting for a slot
+type backendLimit struct {
+	slots   chan struct{}
+	waiting int
+	sync.Mutex
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{limits: make(map[string]*backendLimit)}
+}
+
+// acquire returns a function releasing a slot for a call to the backend, waiting up to timeout for one to be free
+// if no more than maxQueued calls are already waiting. Returns false if no slot was acquired
+// A nil limiter or a limit of zero or less does not limit calls
+func (cl *concurrencyLimiter) acquire(backendURL string, limit, maxQueued int, timeout time.Duration) (func(), bool) {
+	if cl == nil || limit <= 0 {
+		return func() {}, true
+	}
+
+	bl := cl.limitFor(backendURL, limit)
+	release := func() { <-bl.slots }
+
+	select {
+	case bl.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if timeout <= 0 || !bl.beginWaiting(maxQueued) {
+		return nil, false
+	}
+	defer bl.doneWaiting()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case bl.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+func (cl *concurrencyLimiter) limitFor(backendURL string, limit int) *backendLimit {
+	cl.Lock()
+	defer cl.Unlock()
+
+	bl, ok := cl.limits[backendURL]
+	if !ok {
+		bl = &backendLimit{slots: make(chan struct{}, limit)}
+		cl.limits[backendURL] = bl
+	}
+	return bl
+}
+
+func (bl *backendLimit) beginWaiting(maxQueued int) bool {
+	bl.Lock()
+	defer bl.Unlock()
+	if bl.waiting >= maxQueued {
+		return false
+	}
+	bl.waiting++
+	return true
+}
+
+func (bl *backendLimit) doneWaiting() {
+	bl.Lock()
+	bl.waiting--
+	bl.Unlock()
+}
@@ -0,0 +1,149 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-go-client/threescale"
+)
+
+func TestManager_MaxConcurrentPassthrough(t *testing.T) {
+	const saturated = "http://saturated"
+
+	inputs := []struct {
+		name            string
+		backendURL      string
+		policy          backend.FailurePolicy
+		maxQueued       int
+		queueTimeout    time.Duration
+		expectAuth      bool
+		expectErr       error
+		expectThrottled bool
+	}{
+		{
+			name:            "Test call beyond the limit is denied by default",
+			backendURL:      saturated,
+			expectErr:       ErrBackendThrottled,
+			expectThrottled: true,
+		},
+		{
+			name:            "Test call beyond the limit applies the failure policy",
+			backendURL:      saturated,
+			policy:          backend.FailOpenPolicy,
+			expectAuth:      true,
+			expectThrottled: true,
+		},
+		{
+			name:         "Test queued call proceeds once a slot is free",
+			backendURL:   saturated,
+			maxQueued:    1,
+			queueTimeout: time.Second * 5,
+			expectAuth:   true,
+		},
+		{
+			name:            "Test queued call is throttled on timeout",
+			backendURL:      saturated,
+			maxQueued:       1,
+			queueTimeout:    time.Millisecond * 10,
+			expectErr:       ErrBackendThrottled,
+			expectThrottled: true,
+		},
+		{
+			name:       "Test other backends are unaffected",
+			backendURL: "http://other",
+			expectAuth: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			inFlight := make(chan struct{})
+			release := make(chan struct{})
+			var throttled []string
+			var lock sync.Mutex
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				Policy:                   input.policy,
+				MaxConcurrentPassthrough: 1,
+				MaxQueuedPassthrough:     input.maxQueued,
+				PassthroughQueueTimeout:  input.queueTimeout,
+			}, &MetricsReporter{
+				ThrottledCB: func(backendURL string) {
+					lock.Lock()
+					defer lock.Unlock()
+					throttled = append(throttled, backendURL)
+				},
+			})
+			defer m.Shutdown()
+			m.clientBuilder = mockBuilder{
+				withBackendClient: mockBackendClient{
+					withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+						if request.Service == "blocking" {
+							close(inFlight)
+							<-release
+						}
+						return &threescale.AuthorizeResult{Authorized: true}, nil
+					},
+				},
+			}
+
+			requestFor := func(service string) BackendRequest {
+				return BackendRequest{
+					Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+					Service: service,
+					Transactions: []BackendTransaction{
+						{
+							Metrics: map[string]int{"hits": 1},
+							Params:  BackendParams{AppID: "any"},
+						},
+					},
+				}
+			}
+
+			// saturate the limit of one backend
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if _, err := m.AuthRep(saturated, requestFor("blocking")); err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+			}()
+			<-inFlight
+
+			var once sync.Once
+			unblock := func() { once.Do(func() { close(release) }) }
+			defer func() {
+				unblock()
+				<-done
+			}()
+			if input.queueTimeout > time.Second {
+				time.AfterFunc(time.Millisecond*10, unblock)
+			}
+
+			resp, err := m.AuthRep(input.backendURL, requestFor("any"))
+			if !errors.Is(err, input.expectErr) {
+				t.Errorf("unexpected error, wanted %v but got %v", input.expectErr, err)
+			}
+			if (resp != nil && resp.Authorized) != input.expectAuth {
+				t.Errorf("unexpected authorization result %+v", resp)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if input.expectThrottled {
+				if len(throttled) != 1 || throttled[0] != input.backendURL {
+					t.Errorf("expected throttled call to be reported, got %v", throttled)
+				}
+				if m.MetricsSnapshot().RequestsThrottled != 1 {
+					t.Errorf("expected throttled call to be counted")
+				}
+			} else if len(throttled) != 0 {
+				t.Errorf("unexpected throttled calls %v", throttled)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package authorizer
+
+import (
+	"time"
+)
+
+// ManagerConfigSummary describes the effective configuration of a Manager, with defaults applied, for example to
+// confirm what is running when debugging. It holds no secrets, credentials are reported as counts and callbacks
+// as whether or not they are set, so it is safe to log or serialize.
+type ManagerConfigSummary struct {
+	// SystemCache is nil when the Manager was created without a system cache
+	SystemCache *SystemCacheSummary
+	Backend     BackendConfigSummary
+	// ReportMetrics is true if the MetricsReporter reports HTTP metrics and latency
+	ReportMetrics      bool
+	DefaultEnvironment string
+	NoConfigOnNotFound bool
+	Serverless         bool
+	// RequestObserver is true if outgoing requests are observed, RedactRequests if credentials are redacted from them
+	RequestObserver bool
+	RedactRequests  bool
+	// CustomDialer is true if connections are dialed via WithDialContext
+	CustomDialer bool
+	// TransportStats is true if statistics on the connection pool are collected via WithTransportStats
+	TransportStats bool
+	// FaultInjection is true if latency or errors are injected into calls to 3scale via WithFaultInjection
+	FaultInjection bool
+}
+
+// SystemCacheSummary describes the effective configuration of the system cache
+type SystemCacheSummary struct {
+	MaxSize               int
+	NumRetryFailedRefresh int
+	RefreshInterval       time.Duration
+	TTL                   time.Duration
+	ClockSkewTolerance    time.Duration
+	TTLJitterPercent      int
+	CustomRetryableError  bool
+	OnServiceDeleted      bool
+	RefreshBackoff        time.Duration
+	MaxRefreshBackoff     time.Duration
+}
+
+// BackendConfigSummary describes the effective BackendConfig of a Manager
+type BackendConfigSummary struct {
+	EnableCaching      bool
+	CacheFlushInterval time.Duration
+	// FailurePolicy is true if a failure policy is set, it is not called to determine whether it fails open
+	FailurePolicy            bool
+	RetryMaxAttempts         int
+	RetryBaseDelay           time.Duration
+	RetryMaxDelay            time.Duration
+	FlushEveryNTransactions  int
+	MinFlushInterval         time.Duration
+	FlushTimeout             time.Duration
+	ProbeOnCreate            bool
+	EnableKeepAlive          bool
+	KeepAliveInterval        time.Duration
+	SegmentCacheByUser       bool
+	MaxMetricsPerTransaction int
+	ValidateMetrics          bool
+	ValidateMetricsWarnOnly  bool
+	// DeniedCredentials and AllowedCredentials are the number of credentials in the CredentialOverrides in effect
+	DeniedCredentials        int
+	AllowedCredentials       int
+	MetricAggregations       map[string]string
+	WindowLocation           string
+	WeekStartsOnSunday       bool
+	BackendClientMaxAge      time.Duration
+	AuthorizeThenReport      bool
+	MaxCachedApplications    int
+	MaxConcurrentPassthrough int
+	MaxQueuedPassthrough     int
+	PassthroughQueueTimeout  time.Duration
+	CustomClassifier         bool
+	CustomRetryableError     bool
+	BackendURLRewriter       bool
+	OnReportsDropped         bool
+	OnDenied                 bool
+}
+
+// Config returns a summary of the effective configuration of the Manager
+func (m Manager) Config() ManagerConfigSummary {
+	summary := ManagerConfigSummary{
+		Backend:            m.backendConfigSummary(),
+		ReportMetrics:      m.metricsReporter != nil && m.metricsReporter.ReportMetrics,
+		DefaultEnvironment: m.defaultEnvironment,
+		NoConfigOnNotFound: m.noConfigOnNotFound,
+		Serverless:         m.serverless,
+		RequestObserver:    m.onRequest != nil,
+		RedactRequests:     m.onRequest != nil && m.redactRequests,
+		CustomDialer:       m.dialContext != nil,
+		TransportStats:     m.transportStats != nil,
+		FaultInjection:     m.faults != nil,
+	}
+
+	if sc := m.systemCache; sc != nil {
+		summary.SystemCache = &SystemCacheSummary{
+			MaxSize:               sc.MaxSize,
+			NumRetryFailedRefresh: sc.NumRetryFailedRefresh,
+			RefreshInterval:       sc.RefreshInterval,
+			TTL:                   sc.TTL,
+			ClockSkewTolerance:    sc.ClockSkewTolerance,
+			TTLJitterPercent:      sc.TTLJitterPercent,
+			CustomRetryableError:  sc.RetryableError != nil,
+			OnServiceDeleted:      sc.OnServiceDeleted != nil,
+			RefreshBackoff:        sc.RefreshBackoff,
+			MaxRefreshBackoff:     sc.MaxRefreshBackoff,
+		}
+	}
+	return summary
+}
+
+func (m Manager) backendConfigSummary() BackendConfigSummary {
+	conf := m.backendConf
+	summary := BackendConfigSummary{
+		EnableCaching:            conf.EnableCaching,
+		CacheFlushInterval:       conf.CacheFlushInterval,
+		FailurePolicy:            conf.Policy != nil,
+		RetryMaxAttempts:         conf.RetryMaxAttempts,
+		RetryBaseDelay:           conf.RetryBaseDelay,
+		RetryMaxDelay:            conf.RetryMaxDelay,
+		FlushEveryNTransactions:  conf.FlushEveryNTransactions,
+		MinFlushInterval:         conf.MinFlushInterval,
+		FlushTimeout:             conf.FlushTimeout,
+		ProbeOnCreate:            conf.ProbeOnCreate,
+		EnableKeepAlive:          conf.EnableKeepAlive,
+		KeepAliveInterval:        conf.KeepAliveInterval,
+		SegmentCacheByUser:       conf.SegmentCacheByUser,
+		MaxMetricsPerTransaction: conf.MaxMetricsPerTransaction,
+		ValidateMetrics:          conf.ValidateMetrics,
+		ValidateMetricsWarnOnly:  conf.ValidateMetricsWarnOnly,
+		BackendClientMaxAge:      conf.BackendClientMaxAge,
+		AuthorizeThenReport:      conf.AuthorizeThenReport,
+		MaxCachedApplications:    conf.MaxCachedApplications,
+		WindowLocation:           time.UTC.String(),
+		WeekStartsOnSunday:       conf.WindowAlignment.WeekStartsOnSunday,
+		MaxConcurrentPassthrough: conf.MaxConcurrentPassthrough,
+		MaxQueuedPassthrough:     conf.MaxQueuedPassthrough,
+		PassthroughQueueTimeout:  conf.PassthroughQueueTimeout,
+		CustomClassifier:         conf.ClassifyResponse != nil,
+		CustomRetryableError:     conf.RetryableError != nil,
+		BackendURLRewriter:       conf.BackendURLRewriter != nil,
+		OnReportsDropped:         conf.OnReportsDropped != nil,
+		OnDenied:                 conf.OnDenied != nil,
+	}
+	summary.DeniedCredentials, summary.AllowedCredentials = m.overrides.counts()
+
+	if summary.RetryBaseDelay <= 0 {
+		summary.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	if summary.RetryMaxDelay <= 0 {
+		summary.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if summary.KeepAliveInterval == 0 {
+		summary.KeepAliveInterval = defaultKeepAliveInterval
+	}
+	if summary.MaxMetricsPerTransaction == 0 {
+		summary.MaxMetricsPerTransaction = defaultMaxMetricsPerTransaction
+	}
+	if loc := conf.WindowAlignment.Location; loc != nil {
+		summary.WindowLocation = loc.String()
+	}
+
+	if len(conf.MetricAggregations) > 0 {
+		summary.MetricAggregations = make(map[string]string, len(conf.MetricAggregations))
+		for metric, aggregation := range conf.MetricAggregations {
+			summary.MetricAggregations[metric] = string(aggregation)
+		}
+	}
+	return summary
+}
@@ -0,0 +1,84 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+func TestManager_Config(t *testing.T) {
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: 10, TTLJitterPercent: 5, RefreshBackoff: time.Second}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{
+		EnableCaching:            true,
+		CacheFlushInterval:       time.Second * 15,
+		Policy:                   func() bool { return true },
+		RetryMaxAttempts:         2,
+		RetryMaxDelay:            time.Second,
+		MaxConcurrentPassthrough: 5,
+		MetricAggregations:       map[string]backend.Aggregation{"connections": backend.AggregateMax},
+		WindowAlignment:          backend.WindowAlignment{WeekStartsOnSunday: true},
+		CredentialOverrides:      CredentialOverrides{Deny: []string{"secret-key"}, Allow: []string{"other-key", "another-key"}},
+	}, &MetricsReporter{ReportMetrics: true}, WithDefaultEnvironment("production"), WithRequestObserver(func(method, url string, params map[string]string) {}))
+	defer m.Shutdown()
+
+	expect := ManagerConfigSummary{
+		SystemCache: &SystemCacheSummary{
+			MaxSize:          10,
+			RefreshInterval:  cache.DefaultCacheRefreshInterval,
+			TTL:              cache.DefaultCacheTTL,
+			TTLJitterPercent: 5,
+			RefreshBackoff:   time.Second,
+		},
+		Backend: BackendConfigSummary{
+			EnableCaching:            true,
+			CacheFlushInterval:       time.Second * 15,
+			FailurePolicy:            true,
+			RetryMaxAttempts:         2,
+			RetryBaseDelay:           defaultRetryBaseDelay,
+			RetryMaxDelay:            time.Second,
+			KeepAliveInterval:        defaultKeepAliveInterval,
+			MaxMetricsPerTransaction: defaultMaxMetricsPerTransaction,
+			DeniedCredentials:        1,
+			AllowedCredentials:       2,
+			MetricAggregations:       map[string]string{"connections": "max"},
+			WindowLocation:           "UTC",
+			WeekStartsOnSunday:       true,
+			MaxConcurrentPassthrough: 5,
+		},
+		ReportMetrics:      true,
+		DefaultEnvironment: "production",
+		RequestObserver:    true,
+		RedactRequests:     true,
+	}
+
+	summary := m.Config()
+	if !reflect.DeepEqual(summary, expect) {
+		t.Errorf("unexpected summary, wanted %+v but got %+v", expect, summary)
+	}
+	if !reflect.DeepEqual(summary.SystemCache, expect.SystemCache) {
+		t.Errorf("unexpected system cache summary, wanted %+v but got %+v", expect.SystemCache, summary.SystemCache)
+	}
+
+	m.Reconfigure(BackendConfig{})
+	if summary := m.Config(); summary.Backend.DeniedCredentials != 0 || summary.Backend.AllowedCredentials != 0 {
+		t.Errorf("expected summary to reflect reconfigured overrides, got %+v", summary.Backend)
+	}
+
+	serialized, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("unexpected error serializing summary %v", err)
+	}
+	if strings.Contains(string(serialized), "secret-key") || strings.Contains(string(serialized), "other-key") {
+		t.Errorf("expected credentials to be redacted from %s", serialized)
+	}
+
+	if summary := (Manager{}).Config(); summary.SystemCache != nil || summary.Backend.EnableCaching {
+		t.Errorf("unexpected summary for zero value manager %+v", summary)
+	}
+}
@@ -0,0 +1,85 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// Supported values for the 'credentials_location' field of a proxy config
+const (
+	CredentialsLocationQuery   = "query"
+	CredentialsLocationHeaders = "headers"
+)
+
+// Default parameter names used by 3scale when a service has not customised them
+const (
+	defaultUserKeyParam = "user_key"
+	defaultAppIDParam   = "app_id"
+	defaultAppKeyParam  = "app_key"
+)
+
+// ExtractCredentials reads the application credentials from the provided request using the location and
+// parameter names defined in the services proxy config. Where the proxy config does not define a parameter name,
+// the 3scale defaults are used. A user key is prioritised over an application id and key pair.
+// Returns an error if the location is unsupported or if no credentials could be found.
+func ExtractCredentials(config client.ProxyConfig, request *http.Request) (BackendParams, error) {
+	return ExtractCredentialsFrom(config, request, config.Content.Proxy.CredentialsLocation)
+}
+
+// ExtractCredentialsFrom behaves as ExtractCredentials but tries each of the provided locations in order,
+// ignoring the location defined in the proxy config, and returns the credentials from the first location which
+// yields any. This allows credentials to be accepted from more than one location, for example while clients
+// migrate from sending them in the query to sending them in headers.
+// Returns an error if any location is unsupported or if no credentials could be found in any of them.
+func ExtractCredentialsFrom(config client.ProxyConfig, request *http.Request, locations ...string) (BackendParams, error) {
+	var params BackendParams
+	proxy := config.Content.Proxy
+
+	lookups := make([]func(name string) string, 0, len(locations))
+	for _, location := range locations {
+		lookup, err := credentialsLookupFor(location, request)
+		if err != nil {
+			return params, err
+		}
+		lookups = append(lookups, lookup)
+	}
+
+	for _, lookup := range lookups {
+		if userKey := lookup(paramNameOrDefault(proxy.AuthUserKey, defaultUserKeyParam)); userKey != "" {
+			params.UserKey = userKey
+			return params, nil
+		}
+
+		if appID := lookup(paramNameOrDefault(proxy.AuthAppID, defaultAppIDParam)); appID != "" {
+			params.AppID = appID
+			params.AppKey = lookup(paramNameOrDefault(proxy.AuthAppKey, defaultAppKeyParam))
+			return params, nil
+		}
+	}
+
+	return params, fmt.Errorf("no credentials found in %s", strings.Join(locations, ", "))
+}
+
+// credentialsLookupFor returns a function which reads the value for a named parameter from the given location
+// An empty location defaults to the query string
+func credentialsLookupFor(location string, request *http.Request) (func(name string) string, error) {
+	switch location {
+	case "", CredentialsLocationQuery:
+		query := request.URL.Query()
+		return query.Get, nil
+	case CredentialsLocationHeaders:
+		return request.Header.Get, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials location %s", location)
+	}
+}
+
+func paramNameOrDefault(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
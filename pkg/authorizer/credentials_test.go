@@ -0,0 +1,178 @@
+package authorizer
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestExtractCredentials(t *testing.T) {
+	configWithProxy := func(proxy client.ContentProxy) client.ProxyConfig {
+		return client.ProxyConfig{Content: client.Content{Proxy: proxy}}
+	}
+
+	inputs := []struct {
+		name      string
+		config    client.ProxyConfig
+		target    string
+		headers   map[string]string
+		expectErr bool
+		expect    BackendParams
+	}{
+		{
+			name:   "Test default user key parameter name in query",
+			config: configWithProxy(client.ContentProxy{CredentialsLocation: CredentialsLocationQuery}),
+			target: "/?user_key=secret",
+			expect: BackendParams{UserKey: "secret"},
+		},
+		{
+			name: "Test custom user key parameter name in query",
+			config: configWithProxy(client.ContentProxy{
+				CredentialsLocation: CredentialsLocationQuery,
+				AuthUserKey:         "api_key",
+			}),
+			target: "/?api_key=secret&user_key=ignored",
+			expect: BackendParams{UserKey: "secret"},
+		},
+		{
+			name: "Test custom app id and app key parameter names in query",
+			config: configWithProxy(client.ContentProxy{
+				CredentialsLocation: CredentialsLocationQuery,
+				AuthAppID:           "id",
+				AuthAppKey:          "key",
+			}),
+			target: "/?id=app&key=secret",
+			expect: BackendParams{AppID: "app", AppKey: "secret"},
+		},
+		{
+			name: "Test custom user key parameter name in headers",
+			config: configWithProxy(client.ContentProxy{
+				CredentialsLocation: CredentialsLocationHeaders,
+				AuthUserKey:         "api_key",
+			}),
+			target:  "/",
+			headers: map[string]string{"api_key": "secret"},
+			expect:  BackendParams{UserKey: "secret"},
+		},
+		{
+			name: "Test default parameter name is not used when customised",
+			config: configWithProxy(client.ContentProxy{
+				CredentialsLocation: CredentialsLocationQuery,
+				AuthUserKey:         "api_key",
+			}),
+			target:    "/?user_key=secret",
+			expectErr: true,
+		},
+		{
+			name:      "Test unsupported location",
+			config:    configWithProxy(client.ContentProxy{CredentialsLocation: "authorization"}),
+			target:    "/?user_key=secret",
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", input.target, nil)
+			for k, v := range input.headers {
+				req.Header.Set(k, v)
+			}
+
+			params, err := ExtractCredentials(input.config, req)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if input.expectErr {
+				t.Errorf("expected an error")
+			}
+
+			if params != input.expect {
+				t.Errorf("unexpected credentials, wanted %v but got %v", input.expect, params)
+			}
+		})
+	}
+}
+
+func TestExtractCredentialsFrom(t *testing.T) {
+	config := client.ProxyConfig{Content: client.Content{Proxy: client.ContentProxy{
+		CredentialsLocation: CredentialsLocationQuery,
+	}}}
+
+	inputs := []struct {
+		name      string
+		locations []string
+		target    string
+		headers   map[string]string
+		expectErr bool
+		expect    BackendParams
+	}{
+		{
+			name:      "Test credentials read from header when present",
+			locations: []string{CredentialsLocationHeaders, CredentialsLocationQuery},
+			target:    "/?user_key=from-query",
+			headers:   map[string]string{"user_key": "from-header"},
+			expect:    BackendParams{UserKey: "from-header"},
+		},
+		{
+			name:      "Test fallback to query when header is missing",
+			locations: []string{CredentialsLocationHeaders, CredentialsLocationQuery},
+			target:    "/?user_key=from-query",
+			expect:    BackendParams{UserKey: "from-query"},
+		},
+		{
+			name:      "Test fallback order is configurable",
+			locations: []string{CredentialsLocationQuery, CredentialsLocationHeaders},
+			target:    "/?user_key=from-query",
+			headers:   map[string]string{"user_key": "from-header"},
+			expect:    BackendParams{UserKey: "from-query"},
+		},
+		{
+			name:      "Test app id found in a later location",
+			locations: []string{CredentialsLocationHeaders, CredentialsLocationQuery},
+			target:    "/?app_id=app&app_key=secret",
+			expect:    BackendParams{AppID: "app", AppKey: "secret"},
+		},
+		{
+			name:      "Test error when credentials are in neither location",
+			locations: []string{CredentialsLocationHeaders, CredentialsLocationQuery},
+			target:    "/",
+			expectErr: true,
+		},
+		{
+			name:      "Test error for unsupported location",
+			locations: []string{CredentialsLocationHeaders, "authorization"},
+			target:    "/?user_key=secret",
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", input.target, nil)
+			for k, v := range input.headers {
+				req.Header.Set(k, v)
+			}
+
+			params, err := ExtractCredentialsFrom(config, req, input.locations...)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if input.expectErr {
+				t.Errorf("expected an error")
+			}
+
+			if params != input.expect {
+				t.Errorf("unexpected credentials, wanted %v but got %v", input.expect, params)
+			}
+		})
+	}
+}
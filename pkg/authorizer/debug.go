@@ -0,0 +1,97 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redactedValue replaces the value of sensitive parameters passed to a RequestHook
+const redactedValue = "REDACTED"
+
+// sensitiveParams are the parameters which carry credentials in requests to 3scale
+var sensitiveParams = []string{"access_token", "provider_key", "service_token", "user_key", "app_key"}
+
+// RequestHook is a callback function which is called with the details of each outgoing request to 3scale,
+// system and backend, just before it is sent. It is intended to aid debugging and must be safe for concurrent use.
+type RequestHook func(method, url string, params map[string]string)
+
+// requestObserverTransport is a http.RoundTripper which calls the hook before sending each request
+type requestObserverTransport struct {
+	next   http.RoundTripper
+	hook   RequestHook
+	redact bool
+}
+
+func (rt *requestObserverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	if rt.redact {
+		for key := range query {
+			if isSensitiveParam(key) {
+				query.Set(key, redactedValue)
+			}
+		}
+	}
+
+	params := make(map[string]string, len(query))
+	for key, values := range query {
+		params[key] = strings.Join(values, ",")
+	}
+
+	// the query is not escaped so that it is readable when logged
+	resolved := url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: req.URL.Path}
+	target := resolved.String()
+	if len(query) > 0 {
+		if unescaped, err := url.QueryUnescape(query.Encode()); err == nil {
+			target += "?" + unescaped
+		}
+	}
+
+	rt.hook(req.Method, target, params)
+	return rt.next.RoundTrip(req)
+}
+
+// isSensitiveParam returns true if the parameter carries a credential, either directly or nested, as is the case for
+// the parameters of each transaction in a report, for example transactions[0][user_key]
+func isSensitiveParam(key string) bool {
+	for _, param := range sensitiveParams {
+		if key == param || strings.HasSuffix(key, "["+param+"]") {
+			return true
+		}
+	}
+	return false
+}
+
+// observeDenial calls the OnDenied hook with the captured response body if the response is a denial from apisonator
+// Failed calls are not denials and are ignored
+func (m Manager) observeDenial(request BackendRequest, resp *BackendResponse, err error) {
+	if err != nil || resp == nil || resp.Authorized {
+		return
+	}
+
+	_, body, ok := capturedResponse(resp.RawResponse)
+	if !ok {
+		return
+	}
+	m.backendConf.OnDenied(redactBackendRequest(request), body)
+}
+
+// redactBackendRequest returns a copy of the request with its credentials redacted
+func redactBackendRequest(request BackendRequest) BackendRequest {
+	redact := func(value string) string {
+		if value == "" {
+			return value
+		}
+		return redactedValue
+	}
+
+	request.Auth.Value = redact(request.Auth.Value)
+	transactions := make([]BackendTransaction, len(request.Transactions))
+	for i, transaction := range request.Transactions {
+		transaction.Params.AppKey = redact(transaction.Params.AppKey)
+		transaction.Params.UserKey = redact(transaction.Params.UserKey)
+		transactions[i] = transaction
+	}
+	request.Transactions = transactions
+	return request
+}
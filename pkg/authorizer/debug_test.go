@@ -0,0 +1,246 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager_RequestObserver(t *testing.T) {
+	backend := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer backend.Close()
+
+	system := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxy_config":{"id":1,"version":1,"environment":"production","content":{"id":1}}}`))
+	}))
+	defer system.Close()
+
+	type observed struct {
+		method string
+		url    string
+		params map[string]string
+	}
+
+	inputs := []struct {
+		name   string
+		option func(hook RequestHook) ManagerOption
+		expect string
+	}{
+		{
+			name:   "Test credentials are redacted by default",
+			option: WithRequestObserver,
+			expect: redactedValue,
+		},
+		{
+			name:   "Test credentials are not redacted when opted out",
+			option: WithUnredactedRequestObserver,
+			expect: "secret",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var requests []observed
+			m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil, input.option(func(method, url string, params map[string]string) {
+				lock.Lock()
+				defer lock.Unlock()
+				requests = append(requests, observed{method: method, url: url, params: params})
+			}))
+			defer m.Shutdown()
+
+			_, err := m.AuthRep(backend.URL, BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "secret"},
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{AppID: "app"},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			_, err = m.GetSystemConfiguration(system.URL, SystemRequest{
+				AccessToken: "secret",
+				ServiceID:   "1",
+				Environment: "production",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if len(requests) != 2 {
+				t.Fatalf("expected hook to observe backend and system requests, got %d", len(requests))
+			}
+
+			authRep := requests[0]
+			if authRep.method != http.MethodGet || !strings.HasPrefix(authRep.url, backend.URL+"/transactions/authrep.xml") {
+				t.Errorf("unexpected backend request %s %s", authRep.method, authRep.url)
+			}
+
+			expectParams := map[string]string{
+				"service_id":   "svc",
+				"app_id":       "app",
+				"usage[hits]":  "1",
+				"provider_key": input.expect,
+			}
+			for key, value := range expectParams {
+				if authRep.params[key] != value {
+					t.Errorf("unexpected value for param %s, wanted %s but got %s", key, value, authRep.params[key])
+				}
+			}
+
+			if !strings.Contains(authRep.url, "provider_key="+input.expect) {
+				t.Errorf("unexpected url %s", authRep.url)
+			}
+
+			if !strings.HasPrefix(requests[1].url, system.URL) {
+				t.Errorf("unexpected system request %s", requests[1].url)
+			}
+		})
+	}
+}
+
+func TestManager_RequestObserverRedactsFlushedReports(t *testing.T) {
+	backend := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer backend.Close()
+
+	var lock sync.Mutex
+	var reports []map[string]string
+	m := NewManager(http.DefaultClient, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour}, nil,
+		WithRequestObserver(func(method, url string, params map[string]string) {
+			lock.Lock()
+			defer lock.Unlock()
+			if strings.Contains(url, "/transactions.xml") {
+				reports = append(reports, params)
+			}
+		}))
+
+	_, err := m.AuthRep(backend.URL, BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "secret"},
+		Service: "svc",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{UserKey: "secret-user-key", AppKey: "secret-app-key"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// shutting down flushes the cached usage
+	m.Shutdown()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(reports) == 0 {
+		t.Fatalf("expected hook to observe the flushed report")
+	}
+
+	var sawUserKey bool
+	for _, params := range reports {
+		for key, value := range params {
+			if strings.Contains(value, "secret") {
+				t.Errorf("expected param %s of flushed report to be redacted, got %s", key, value)
+			}
+		}
+		if value, ok := params["transactions[0][user_key]"]; ok {
+			sawUserKey = true
+			if value != redactedValue {
+				t.Errorf("unexpected value for transactions[0][user_key], wanted %s but got %s", redactedValue, value)
+			}
+		}
+	}
+	if !sawUserKey {
+		t.Errorf("expected flushed report to carry the user key, got %v", reports)
+	}
+}
+
+func TestManager_OnDenied(t *testing.T) {
+	const denied = `<status><authorized>false</authorized><reason>application key is missing</reason><plan>Basic</plan></status>`
+
+	inputs := []struct {
+		name         string
+		response     string
+		status       int
+		expectCalled bool
+	}{
+		{
+			name:         "Test body is captured on denial",
+			response:     denied,
+			status:       http.StatusConflict,
+			expectCalled: true,
+		},
+		{
+			name:     "Test hook is not called when authorized",
+			response: `<status><authorized>true</authorized><plan>Basic</plan></status>`,
+			status:   http.StatusOK,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(input.status)
+				w.Write([]byte(input.response))
+			}))
+			defer backend.Close()
+
+			var lock sync.Mutex
+			var called bool
+			var gotRequest BackendRequest
+			var gotBody []byte
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				OnDenied: func(request BackendRequest, body []byte) {
+					lock.Lock()
+					defer lock.Unlock()
+					called, gotRequest, gotBody = true, request, body
+				},
+			}, nil)
+			defer m.Shutdown()
+
+			resp, err := m.AuthRep(backend.URL, BackendRequest{
+				Auth:    BackendAuth{Type: "service_token", Value: "secret"},
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{AppID: "app", AppKey: "key"},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if called != input.expectCalled {
+				t.Fatalf("expected hook called to be %t for authorized %t", input.expectCalled, resp.Authorized)
+			}
+			if !called {
+				return
+			}
+			if string(gotBody) != denied {
+				t.Errorf("unexpected body %s", string(gotBody))
+			}
+			if gotRequest.Auth.Value != redactedValue || gotRequest.Transactions[0].Params.AppKey != redactedValue {
+				t.Errorf("expected credentials to be redacted, got %+v", gotRequest)
+			}
+			if gotRequest.Transactions[0].Params.AppID != "app" {
+				t.Errorf("expected app id to be retained, got %+v", gotRequest)
+			}
+		})
+	}
+}
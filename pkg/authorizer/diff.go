@@ -0,0 +1,128 @@
+package authorizer
+
+import (
+	"fmt"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// ProxyConfigDiff summarises the changes between two versions of a proxy config
+type ProxyConfigDiff struct {
+	OldVersion int
+	NewVersion int
+	// AddedMappingRules are present in the new config only
+	// A modified mapping rule is reported as both removed and added
+	AddedMappingRules []client.ProxyRule
+	// RemovedMappingRules are present in the old config only
+	RemovedMappingRules []client.ProxyRule
+	// AddedMetrics are the system names of metrics which are referenced by mapping rules in the new config only
+	AddedMetrics []string
+	// RemovedMetrics are the system names of metrics which are referenced by mapping rules in the old config only
+	RemovedMetrics []string
+	// AddedPolicies are the names of policies present in the new policy chain only
+	AddedPolicies []string
+	// RemovedPolicies are the names of policies present in the old policy chain only
+	RemovedPolicies []string
+	// PolicyChainChanged is true if policies have been added, removed, reordered or had their version changed
+	PolicyChainChanged bool
+}
+
+// HasChanges returns true if the diff contains any changes to mapping rules, metrics or the policy chain
+func (d ProxyConfigDiff) HasChanges() bool {
+	return len(d.AddedMappingRules) > 0 || len(d.RemovedMappingRules) > 0 || d.PolicyChainChanged
+}
+
+// DiffProxyConfig compares two proxy configs and returns a summary of the changes to mapping rules,
+// the metrics referenced by them and the policy chain
+func DiffProxyConfig(old, new client.ProxyConfig) ProxyConfigDiff {
+	diff := ProxyConfigDiff{
+		OldVersion: old.Version,
+		NewVersion: new.Version,
+	}
+
+	oldProxy, newProxy := old.Content.Proxy, new.Content.Proxy
+	diff.RemovedMappingRules = proxyRulesNotIn(oldProxy.ProxyRules, newProxy.ProxyRules)
+	diff.AddedMappingRules = proxyRulesNotIn(newProxy.ProxyRules, oldProxy.ProxyRules)
+
+	oldMetrics, newMetrics := metricsFromProxyRules(oldProxy.ProxyRules), metricsFromProxyRules(newProxy.ProxyRules)
+	diff.RemovedMetrics = stringsNotIn(oldMetrics, newMetrics)
+	diff.AddedMetrics = stringsNotIn(newMetrics, oldMetrics)
+
+	oldPolicies, newPolicies := policyNames(oldProxy.PolicyChain), policyNames(newProxy.PolicyChain)
+	diff.RemovedPolicies = stringsNotIn(oldPolicies, newPolicies)
+	diff.AddedPolicies = stringsNotIn(newPolicies, oldPolicies)
+	diff.PolicyChainChanged = !policyChainsEqual(oldProxy.PolicyChain, newProxy.PolicyChain)
+
+	return diff
+}
+
+// proxyRulesNotIn returns the rules from src which have no equivalent rule in dst
+func proxyRulesNotIn(src, dst []client.ProxyRule) []client.ProxyRule {
+	known := make(map[string]bool, len(dst))
+	for _, rule := range dst {
+		known[proxyRuleKey(rule)] = true
+	}
+
+	var rules []client.ProxyRule
+	for _, rule := range src {
+		if !known[proxyRuleKey(rule)] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// proxyRuleKey identifies a mapping rule by the fields which affect its behaviour
+func proxyRuleKey(rule client.ProxyRule) string {
+	return fmt.Sprintf("%s %s %s %d %t", rule.HTTPMethod, rule.Pattern, rule.MetricSystemName, rule.Delta, rule.Last)
+}
+
+func metricsFromProxyRules(rules []client.ProxyRule) []string {
+	var metrics []string
+	for _, rule := range rules {
+		if !contains(rule.MetricSystemName, metrics) {
+			metrics = append(metrics, rule.MetricSystemName)
+		}
+	}
+	return metrics
+}
+
+func policyNames(chain []client.PolicyChain) []string {
+	var names []string
+	for _, policy := range chain {
+		names = append(names, policy.Name)
+	}
+	return names
+}
+
+func policyChainsEqual(a, b []client.PolicyChain) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Version != b[i].Version {
+			return false
+		}
+	}
+	return true
+}
+
+// stringsNotIn returns the elements of src which are not present in dst
+func stringsNotIn(src, dst []string) []string {
+	var diff []string
+	for _, s := range src {
+		if !contains(s, dst) {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
+
+func contains(key string, in []string) bool {
+	for _, s := range in {
+		if s == key {
+			return true
+		}
+	}
+	return false
+}
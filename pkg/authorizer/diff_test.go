@@ -0,0 +1,115 @@
+package authorizer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestDiffProxyConfig(t *testing.T) {
+	configWith := func(version int, rules []client.ProxyRule, chain []client.PolicyChain) client.ProxyConfig {
+		return client.ProxyConfig{
+			Version: version,
+			Content: client.Content{
+				Proxy: client.ContentProxy{ProxyRules: rules, PolicyChain: chain},
+			},
+		}
+	}
+
+	hitsRule := client.ProxyRule{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1}
+	fooRule := client.ProxyRule{HTTPMethod: "POST", Pattern: "/foo", MetricSystemName: "foo", Delta: 1}
+	apicast := client.PolicyChain{Name: "apicast", Version: "builtin"}
+	cors := client.PolicyChain{Name: "cors", Version: "builtin"}
+
+	inputs := []struct {
+		name          string
+		old           client.ProxyConfig
+		new           client.ProxyConfig
+		expectChanges bool
+		expect        ProxyConfigDiff
+	}{
+		{
+			name:   "Test no changes",
+			old:    configWith(1, []client.ProxyRule{hitsRule}, []client.PolicyChain{apicast}),
+			new:    configWith(2, []client.ProxyRule{hitsRule}, []client.PolicyChain{apicast}),
+			expect: ProxyConfigDiff{OldVersion: 1, NewVersion: 2},
+		},
+		{
+			name:          "Test mapping rule and metric added",
+			old:           configWith(1, []client.ProxyRule{hitsRule}, nil),
+			new:           configWith(2, []client.ProxyRule{hitsRule, fooRule}, nil),
+			expectChanges: true,
+			expect: ProxyConfigDiff{
+				OldVersion:        1,
+				NewVersion:        2,
+				AddedMappingRules: []client.ProxyRule{fooRule},
+				AddedMetrics:      []string{"foo"},
+			},
+		},
+		{
+			name:          "Test mapping rule and metric removed",
+			old:           configWith(1, []client.ProxyRule{hitsRule, fooRule}, nil),
+			new:           configWith(2, []client.ProxyRule{hitsRule}, nil),
+			expectChanges: true,
+			expect: ProxyConfigDiff{
+				OldVersion:          1,
+				NewVersion:          2,
+				RemovedMappingRules: []client.ProxyRule{fooRule},
+				RemovedMetrics:      []string{"foo"},
+			},
+		},
+		{
+			name: "Test mapping rule metric changed",
+			old:  configWith(1, []client.ProxyRule{hitsRule}, nil),
+			new: configWith(2, []client.ProxyRule{
+				{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "foo", Delta: 1},
+			}, nil),
+			expectChanges: true,
+			expect: ProxyConfigDiff{
+				OldVersion:          1,
+				NewVersion:          2,
+				AddedMappingRules:   []client.ProxyRule{{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "foo", Delta: 1}},
+				RemovedMappingRules: []client.ProxyRule{hitsRule},
+				AddedMetrics:        []string{"foo"},
+				RemovedMetrics:      []string{"hits"},
+			},
+		},
+		{
+			name:          "Test policy added",
+			old:           configWith(1, nil, []client.PolicyChain{apicast}),
+			new:           configWith(2, nil, []client.PolicyChain{cors, apicast}),
+			expectChanges: true,
+			expect: ProxyConfigDiff{
+				OldVersion:         1,
+				NewVersion:         2,
+				AddedPolicies:      []string{"cors"},
+				PolicyChainChanged: true,
+			},
+		},
+		{
+			name:          "Test policy chain reordered",
+			old:           configWith(1, nil, []client.PolicyChain{apicast, cors}),
+			new:           configWith(2, nil, []client.PolicyChain{cors, apicast}),
+			expectChanges: true,
+			expect: ProxyConfigDiff{
+				OldVersion:         1,
+				NewVersion:         2,
+				PolicyChainChanged: true,
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			diff := DiffProxyConfig(input.old, input.new)
+			if diff.HasChanges() != input.expectChanges {
+				t.Errorf("unexpected result for HasChanges")
+			}
+
+			if !reflect.DeepEqual(diff, input.expect) {
+				t.Errorf("unexpected diff, wanted %+v but got %+v", input.expect, diff)
+			}
+		})
+	}
+}
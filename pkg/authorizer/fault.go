@@ -0,0 +1,87 @@
+package authorizer
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Phases passed to a FaultInjector, identifying the 3scale component being called
+const (
+	FaultPhaseSystem  = "system"
+	FaultPhaseBackend = "backend"
+)
+
+// systemAPIPrefix is the path prefix of the 3scale system APIs called by the Manager
+const systemAPIPrefix = "/admin/api/"
+
+// FaultInjector is consulted before each call to 3scale when fault injection is enabled via WithFaultInjection
+// The phase is FaultPhaseSystem or FaultPhaseBackend. Returning an error fails the call without it being sent.
+// It must be safe for concurrent use.
+type FaultInjector func(phase string) error
+
+// WithFaultInjection injects latency and errors into the calls made to 3scale, system and backend, to validate the
+// failure policy, retry and timeout configuration without a flaky upstream. It is intended for testing only.
+// Each call is delayed by latency, or until its context is done, before the injector, if set, is consulted.
+// Errors returned by the injector are surfaced as temporary network errors, such that they are subject to the
+// failure Policy and retries in the same way as a real connection failure. Fault injection is disabled by default
+func WithFaultInjection(injector FaultInjector, latency time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.faults = &faultTransport{injector: injector, latency: latency}
+	}
+}
+
+// faultTransport is a http.RoundTripper which delays and fails requests as configured by WithFaultInjection
+type faultTransport struct {
+	next     http.RoundTripper
+	injector FaultInjector
+	latency  time.Duration
+}
+
+func (ft *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ft.latency > 0 {
+		timer := time.NewTimer(ft.latency)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	if ft.injector != nil {
+		phase := FaultPhaseBackend
+		if strings.HasPrefix(req.URL.Path, systemAPIPrefix) {
+			phase = FaultPhaseSystem
+		}
+		if err := ft.injector(phase); err != nil {
+			return nil, injectedFault{err: err}
+		}
+	}
+	return ft.next.RoundTrip(req)
+}
+
+// injectedFault wraps an error returned by a FaultInjector as a temporary net.Error
+// It is a timeout only if the injected error is itself a timeout
+type injectedFault struct {
+	err error
+}
+
+func (f injectedFault) Error() string {
+	return "injected fault - " + f.err.Error()
+}
+
+func (f injectedFault) Unwrap() error {
+	return f.err
+}
+
+func (f injectedFault) Timeout() bool {
+	var netErr net.Error
+	return errors.As(f.err, &netErr) && netErr.Timeout()
+}
+
+func (f injectedFault) Temporary() bool {
+	return true
+}
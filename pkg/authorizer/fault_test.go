@@ -0,0 +1,170 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManager_FaultInjectionRetries(t *testing.T) {
+	inputs := []struct {
+		name            string
+		failures        int32
+		expectAuthorize bool
+		expectCalls     int32
+	}{
+		{
+			name:            "Test injected faults are retried",
+			failures:        2,
+			expectAuthorize: true,
+			expectCalls:     3,
+		},
+		{
+			name:        "Test injected faults exhaust retries",
+			failures:    3,
+			expectCalls: 3,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {})
+			defer server.Close()
+
+			var calls int32
+			injector := func(phase string) error {
+				if phase != FaultPhaseBackend {
+					t.Errorf("unexpected phase %s", phase)
+				}
+				if atomic.AddInt32(&calls, 1) <= input.failures {
+					return errors.New("connection refused")
+				}
+				return nil
+			}
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				RetryMaxAttempts: 2,
+				RetryBaseDelay:   time.Millisecond,
+			}, nil, WithFaultInjection(injector, 0))
+
+			resp, err := m.AuthRep(server.URL, BackendRequest{
+				Auth:         BackendAuth{Type: AuthTypeProviderKey, Value: "any"},
+				Service:      "1",
+				Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+			})
+			if input.expectAuthorize && (err != nil || !resp.Authorized) {
+				t.Errorf("expected request to be authorized after retries, got %v, %v", resp, err)
+			}
+			if !input.expectAuthorize && (err == nil || !strings.Contains(err.Error(), "injected fault")) {
+				t.Errorf("expected injected fault to be returned, got %v, %v", resp, err)
+			}
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls but got %d", input.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestManager_FaultInjectionFailurePolicy(t *testing.T) {
+	inputs := []struct {
+		name      string
+		policy    func() bool
+		expectErr bool
+	}{
+		{
+			name:   "Test failure policy lets request through",
+			policy: func() bool { return true },
+		},
+		{
+			name:      "Test failure policy rejects request",
+			policy:    func() bool { return false },
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {})
+			defer server.Close()
+
+			injector := func(phase string) error {
+				return errors.New("connection reset by peer")
+			}
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				EnableCaching:      true,
+				CacheFlushInterval: time.Hour,
+				Policy:             input.policy,
+			}, nil, WithFaultInjection(injector, 0))
+			defer m.Shutdown()
+
+			resp, err := m.AuthRep(server.URL, BackendRequest{
+				Auth:         BackendAuth{Type: AuthTypeProviderKey, Value: "any"},
+				Service:      "1",
+				Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+			})
+			if input.expectErr {
+				if err == nil && resp.Authorized {
+					t.Errorf("expected request to be rejected, got %v", resp)
+				}
+				return
+			}
+			if err != nil || !resp.Authorized {
+				t.Errorf("expected failure policy to authorize the request, got %v, %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestManager_FaultInjectionSystem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxy_config":{"id":1,"version":1,"environment":"production","content":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+
+	var phases []string
+	injector := func(phase string) error {
+		phases = append(phases, phase)
+		return errors.New("service unavailable")
+	}
+	m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil, WithFaultInjection(injector, 0))
+	if _, err := m.GetSystemConfiguration(server.URL, request); err == nil || !strings.Contains(err.Error(), "injected fault") {
+		t.Errorf("expected injected fault, got %v", err)
+	}
+	if len(phases) != 1 || phases[0] != FaultPhaseSystem {
+		t.Errorf("unexpected phases %v", phases)
+	}
+
+	m = NewManager(&http.Client{Timeout: time.Millisecond * 10}, nil, BackendConfig{}, nil, WithFaultInjection(nil, time.Second))
+	start := time.Now()
+	_, err := m.GetSystemConfiguration(server.URL, request)
+	if err == nil {
+		t.Fatalf("expected injected latency to exceed the client timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected injected latency to be abandoned at the timeout, took %s", elapsed)
+	}
+
+	if _, err := NewManager(http.DefaultClient, nil, BackendConfig{}, nil).GetSystemConfiguration(server.URL, request); err != nil {
+		t.Errorf("expected no faults unless enabled, got %v", err)
+	}
+}
+
+func TestInjectedFault(t *testing.T) {
+	cause := errors.New("arbitrary error")
+	err := injectedFault{err: cause}
+	if !errors.Is(err, cause) {
+		t.Errorf("expected injected fault to wrap its cause")
+	}
+	if !err.Temporary() || err.Timeout() {
+		t.Errorf("expected a temporary fault which is not a timeout")
+	}
+	if !IsRetryableError(err) {
+		t.Errorf("expected injected fault to be retryable")
+	}
+}
@@ -0,0 +1,73 @@
+package authorizer
+
+import (
+	"sync"
+	"time"
+)
+
+// TriggerFlush requests an immediate flush of the cached backend for backendURL, for example when a burst of traffic
+// is detected, and returns whether a flush was started. Triggers are coalesced, such that no flush is started if a
+// flush of the backend is already running or one started less than BackendConfig.MinFlushInterval ago.
+// Returns false if caching is disabled or the backend has not been cached by a call to AuthRep
+func (m Manager) TriggerFlush(backendURL string) bool {
+	if m.cachedBackendsLock == nil || m.serverless {
+		return false
+	}
+
+	if rewrite := m.backendConf.BackendURLRewriter; rewrite != nil {
+		backendURL = rewrite(backendURL)
+	}
+
+	m.cachedBackendsLock.RLock()
+	cb, ok := m.cachedBackends[backendURL]
+	m.cachedBackendsLock.RUnlock()
+	if !ok || cb.isStopping() {
+		return false
+	}
+
+	if !cb.gate.begin(timeNow(), m.backendConf.MinFlushInterval) {
+		return false
+	}
+
+	select {
+	case cb.flushTriggered <- struct{}{}:
+		return true
+	default:
+		cb.gate.end()
+		return false
+	}
+}
+
+// flushGate allows a single flush of a cached backend to run at a time and records when the last flush started
+type flushGate struct {
+	running   bool
+	lastStart time.Time
+	sync.Mutex
+}
+
+// begin claims the gate for a flush starting at now, unless a flush is running or the last flush started less
+// than minInterval before now. The gate must be released with end if claimed
+func (fg *flushGate) begin(now time.Time, minInterval time.Duration) bool {
+	if fg == nil {
+		return false
+	}
+
+	fg.Lock()
+	defer fg.Unlock()
+	if fg.running || (!fg.lastStart.IsZero() && now.Sub(fg.lastStart) < minInterval) {
+		return false
+	}
+	fg.running = true
+	fg.lastStart = now
+	return true
+}
+
+// end releases the gate once a flush has completed
+func (fg *flushGate) end() {
+	if fg == nil {
+		return
+	}
+	fg.Lock()
+	fg.running = false
+	fg.Unlock()
+}
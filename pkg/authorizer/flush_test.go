@@ -0,0 +1,123 @@
+package authorizer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushGate(t *testing.T) {
+	start := time.Now()
+	fg := &flushGate{}
+
+	if !fg.begin(start, time.Minute) {
+		t.Fatalf("expected first flush to claim the gate")
+	}
+	if fg.begin(start.Add(time.Hour), 0) {
+		t.Errorf("expected gate to be held while a flush is running")
+	}
+
+	fg.end()
+	if fg.begin(start.Add(time.Second), time.Minute) {
+		t.Errorf("expected flush within the minimum interval to be refused")
+	}
+	if !fg.begin(start.Add(time.Minute), time.Minute) {
+		t.Errorf("expected flush after the minimum interval to claim the gate")
+	}
+	fg.end()
+
+	var nilGate *flushGate
+	if nilGate.begin(start, 0) {
+		t.Errorf("expected nil gate to refuse flushes")
+	}
+	nilGate.end()
+}
+
+func TestManager_TriggerFlush(t *testing.T) {
+	var offset int64
+	timeNow = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+	defer func() { timeNow = time.Now }()
+
+	reportStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case reportStarted <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	m := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Hour,
+		MinFlushInterval:   time.Minute,
+	}, nil)
+	defer m.Shutdown()
+
+	if m.TriggerFlush(server.URL) {
+		t.Errorf("expected no flush for a backend which has not been cached")
+	}
+
+	_, err := m.AuthRep(server.URL, BackendRequest{
+		Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+		Service:      "any",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !m.TriggerFlush(server.URL) {
+		t.Fatalf("expected flush to be started")
+	}
+	select {
+	case <-reportStarted:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected triggered flush to report usage")
+	}
+
+	atomic.StoreInt64(&offset, int64(time.Hour))
+	if m.TriggerFlush(server.URL) {
+		t.Errorf("expected trigger to be coalesced with the running flush")
+	}
+	close(release)
+
+	m.cachedBackendsLock.RLock()
+	gate := m.cachedBackends[server.URL].gate
+	m.cachedBackendsLock.RUnlock()
+	waitForFlush := func() {
+		t.Helper()
+		running := func() bool {
+			gate.Lock()
+			defer gate.Unlock()
+			return gate.running
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for running() {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected triggered flush to complete")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	waitForFlush()
+
+	if !m.TriggerFlush(server.URL) {
+		t.Fatalf("expected flush to be started once the previous flush completed")
+	}
+	waitForFlush()
+
+	atomic.StoreInt64(&offset, int64(time.Hour+time.Second))
+	if m.TriggerFlush(server.URL) {
+		t.Errorf("expected trigger within the minimum interval of the last flush to be ignored")
+	}
+
+	atomic.StoreInt64(&offset, int64(time.Hour+time.Minute))
+	if !m.TriggerFlush(server.URL) {
+		t.Errorf("expected flush to be started once the minimum interval elapsed")
+	}
+}
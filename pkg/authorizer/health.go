@@ -0,0 +1,85 @@
+package authorizer
+
+import (
+	"sort"
+)
+
+// HealthState is the overall state of a Manager as reported by Health
+type HealthState string
+
+const (
+	// Healthy indicates that every cached proxy config is fresh and the last flush of every cached backend succeeded
+	Healthy HealthState = "healthy"
+	// Degraded indicates that some, but not all, cached proxy configs are stale or cached backends are failing
+	// to flush, or that the Manager is draining
+	Degraded HealthState = "degraded"
+	// Unhealthy indicates that the Manager has been shut down, or that every cached proxy config is stale or
+	// every cached backend failed to flush
+	Unhealthy HealthState = "unhealthy"
+)
+
+// HealthStatus describes the health of a Manager along with the details from which its State is derived
+type HealthStatus struct {
+	State HealthState
+	// CachedConfigs is the number of proxy configs in the system cache
+	CachedConfigs int
+	// StaleConfigs is the number of cached proxy configs which have expired or have failed to refresh
+	StaleConfigs int
+	// CachedBackends is the number of cached backends
+	CachedBackends int
+	// FailingBackends lists the urls of the cached backends for which a call to 3scale failed during the last flush
+	FailingBackends []string
+	// Draining is true once Drain has been called
+	Draining bool
+}
+
+// Health reports the health of the Manager, aggregated from the freshness of the system cache and the outcome of
+// the last flush of each cached backend. It does not make any calls to 3scale and is suitable for use in a health
+// check handler.
+func (m Manager) Health() HealthStatus {
+	status := HealthStatus{Draining: m.drain.isDraining()}
+
+	if m.systemCache != nil && m.systemCache.ConfigurationCache != nil {
+		for _, key := range m.systemCache.Keys() {
+			value, ok := m.systemCache.Get(key)
+			if !ok {
+				continue
+			}
+			status.CachedConfigs++
+			if value.RefreshFailures() > 0 || value.Expired() {
+				status.StaleConfigs++
+			}
+		}
+	}
+
+	if m.cachedBackendsLock != nil {
+		m.cachedBackendsLock.RLock()
+		for url, cb := range m.cachedBackends {
+			status.CachedBackends++
+			if cb.flushes.lastFlushFailed() {
+				status.FailingBackends = append(status.FailingBackends, url)
+			}
+		}
+		m.cachedBackendsLock.RUnlock()
+		sort.Strings(status.FailingBackends)
+	}
+
+	status.State = status.state(m.ctx != nil && m.ctx.Err() != nil)
+	return status
+}
+
+func (hs HealthStatus) state(shutdown bool) HealthState {
+	failing := len(hs.FailingBackends)
+	switch {
+	case shutdown:
+		return Unhealthy
+	case hs.CachedConfigs > 0 && hs.StaleConfigs == hs.CachedConfigs:
+		return Unhealthy
+	case hs.CachedBackends > 0 && failing == hs.CachedBackends:
+		return Unhealthy
+	case hs.StaleConfigs > 0 || failing > 0 || hs.Draining:
+		return Degraded
+	default:
+		return Healthy
+	}
+}
@@ -0,0 +1,155 @@
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestManager_Health(t *testing.T) {
+	inputs := []struct {
+		name            string
+		freshConfigs    int
+		staleConfigs    int
+		healthyBackends int
+		failingBackends int
+		draining        bool
+		shutdown        bool
+		expect          HealthState
+	}{
+		{
+			name:   "Test empty manager is healthy",
+			expect: Healthy,
+		},
+		{
+			name:            "Test fresh configs and successful flushes are healthy",
+			freshConfigs:    2,
+			healthyBackends: 2,
+			expect:          Healthy,
+		},
+		{
+			name:            "Test some stale configs are degraded",
+			freshConfigs:    1,
+			staleConfigs:    1,
+			healthyBackends: 1,
+			expect:          Degraded,
+		},
+		{
+			name:            "Test some failing backends are degraded",
+			freshConfigs:    1,
+			healthyBackends: 1,
+			failingBackends: 1,
+			expect:          Degraded,
+		},
+		{
+			name:            "Test draining is degraded",
+			freshConfigs:    1,
+			healthyBackends: 1,
+			draining:        true,
+			expect:          Degraded,
+		},
+		{
+			name:            "Test all stale configs are unhealthy",
+			staleConfigs:    2,
+			healthyBackends: 1,
+			expect:          Unhealthy,
+		},
+		{
+			name:            "Test all failing backends are unhealthy",
+			freshConfigs:    1,
+			failingBackends: 2,
+			expect:          Unhealthy,
+		},
+		{
+			name:            "Test shutdown is unhealthy",
+			freshConfigs:    1,
+			healthyBackends: 1,
+			shutdown:        true,
+			expect:          Unhealthy,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+			for i := 0; i < input.freshConfigs; i++ {
+				systemCache.Set(fmt.Sprintf("fresh_%d", i), cache.Value{Item: client.ProxyConfig{}})
+			}
+			for i := 0; i < input.staleConfigs; i++ {
+				value := &cache.Value{Item: client.ProxyConfig{}}
+				value.SetExpiry(time.Now().Add(-time.Minute))
+				systemCache.Set(fmt.Sprintf("stale_%d", i), *value)
+			}
+
+			cachedBackends := make(map[string]cachedBackend)
+			var expectFailing []string
+			for i := 0; i < input.healthyBackends; i++ {
+				cachedBackends[fmt.Sprintf("healthy_%d", i)] = cachedBackend{flushes: &flushObservingClient{}}
+			}
+			for i := 0; i < input.failingBackends; i++ {
+				url := fmt.Sprintf("failing_%d", i)
+				cachedBackends[url] = cachedBackend{flushes: &flushObservingClient{lastFailed: 1}}
+				expectFailing = append(expectFailing, url)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if input.shutdown {
+				cancel()
+			}
+
+			m := Manager{
+				systemCache:        systemCache,
+				cachedBackends:     cachedBackends,
+				cachedBackendsLock: &sync.RWMutex{},
+				ctx:                ctx,
+				drain:              &drainState{draining: input.draining},
+			}
+
+			status := m.Health()
+			if status.State != input.expect {
+				t.Errorf("unexpected state, wanted %s but got %s - %+v", input.expect, status.State, status)
+			}
+			if status.CachedConfigs != input.freshConfigs+input.staleConfigs || status.StaleConfigs != input.staleConfigs {
+				t.Errorf("unexpected config counts %+v", status)
+			}
+			if status.CachedBackends != input.healthyBackends+input.failingBackends {
+				t.Errorf("unexpected backend count %+v", status)
+			}
+			if !reflect.DeepEqual(status.FailingBackends, expectFailing) {
+				t.Errorf("unexpected failing backends, wanted %v but got %v", expectFailing, status.FailingBackends)
+			}
+		})
+	}
+}
+
+func TestFlushObservingClient_Complete(t *testing.T) {
+	fc := &flushObservingClient{timeout: time.Millisecond}
+
+	fc.observe(time.Now().Add(-time.Second), fmt.Errorf("arbitrary error"))
+	if failed, timedOut := fc.complete(); !failed || !timedOut {
+		t.Errorf("expected flush to have failed and timed out")
+	}
+	if !fc.lastFlushFailed() {
+		t.Errorf("expected last flush to be reported as failed")
+	}
+
+	fc.observe(time.Now(), nil)
+	if failed, timedOut := fc.complete(); failed || timedOut {
+		t.Errorf("expected successful flush")
+	}
+	if fc.lastFlushFailed() {
+		t.Errorf("expected successful flush to clear the failure")
+	}
+
+	var nilClient *flushObservingClient
+	if nilClient.lastFlushFailed() {
+		t.Errorf("expected nil client to report no failure")
+	}
+}
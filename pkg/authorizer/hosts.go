@@ -0,0 +1,40 @@
+package authorizer
+
+import (
+	"net"
+	"strings"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// HostsFromConfig returns the hostnames on which the service described by the proxy config answers
+func HostsFromConfig(config client.ProxyConfig) []string {
+	return append([]string(nil), config.Content.Proxy.Hosts...)
+}
+
+// HostMatches reports whether host, typically the Host header of an incoming request, is one of the hostnames
+// listed in the proxy config. Any port is ignored and the comparison is case-insensitive.
+// Returns false if the proxy config lists no hosts.
+func HostMatches(config client.ProxyConfig, host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+
+	for _, candidate := range config.Content.Proxy.Hosts {
+		if normalizeHost(candidate) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost strips any port, the brackets of an IPv6 literal and a trailing dot from host and lower cases it
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,101 @@
+package authorizer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestHostsFromConfig(t *testing.T) {
+	hosts := []string{"api.example.com", "example.com"}
+	config := client.ProxyConfig{Content: client.Content{Proxy: client.ContentProxy{Hosts: hosts}}}
+
+	got := HostsFromConfig(config)
+	if !reflect.DeepEqual(got, hosts) {
+		t.Errorf("unexpected hosts, wanted %v but got %v", hosts, got)
+	}
+
+	got[0] = "modified"
+	if config.Content.Proxy.Hosts[0] != "api.example.com" {
+		t.Errorf("expected returned hosts to be a copy")
+	}
+
+	if got := HostsFromConfig(client.ProxyConfig{}); len(got) != 0 {
+		t.Errorf("expected no hosts, got %v", got)
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	inputs := []struct {
+		name   string
+		hosts  []string
+		host   string
+		expect bool
+	}{
+		{
+			name:   "Test exact match",
+			hosts:  []string{"other.example.com", "api.example.com"},
+			host:   "api.example.com",
+			expect: true,
+		},
+		{
+			name:   "Test match is case insensitive",
+			hosts:  []string{"API.example.com"},
+			host:   "api.EXAMPLE.com",
+			expect: true,
+		},
+		{
+			name:   "Test port is ignored on the host",
+			hosts:  []string{"api.example.com"},
+			host:   "api.example.com:8443",
+			expect: true,
+		},
+		{
+			name:   "Test port is ignored on the configured host",
+			hosts:  []string{"api.example.com:443"},
+			host:   "api.example.com",
+			expect: true,
+		},
+		{
+			name:   "Test IPv6 literal with port",
+			hosts:  []string{"::1"},
+			host:   "[::1]:8080",
+			expect: true,
+		},
+		{
+			name:   "Test trailing dot is ignored",
+			hosts:  []string{"api.example.com"},
+			host:   "api.example.com.",
+			expect: true,
+		},
+		{
+			name:  "Test subdomain does not match",
+			hosts: []string{"example.com"},
+			host:  "api.example.com",
+		},
+		{
+			name:  "Test no match for unknown host",
+			hosts: []string{"api.example.com"},
+			host:  "evil.com",
+		},
+		{
+			name: "Test no match for empty host list",
+			host: "api.example.com",
+		},
+		{
+			name:  "Test no match for empty host",
+			hosts: []string{"api.example.com", ""},
+			host:  "",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			config := client.ProxyConfig{Content: client.Content{Proxy: client.ContentProxy{Hosts: input.hosts}}}
+			if got := HostMatches(config, input.host); got != input.expect {
+				t.Errorf("unexpected result for host %s, wanted %t but got %t", input.host, input.expect, got)
+			}
+		})
+	}
+}
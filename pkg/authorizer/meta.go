@@ -0,0 +1,112 @@
+package authorizer
+
+import (
+	"time"
+
+	"github.com/3scale/3scale-go-client/threescale/api"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// maxSuggestedMaxAge is the upper bound on any suggested max-age, regardless of how long a result is valid for
+const maxSuggestedMaxAge = time.Hour
+
+// ResponseMeta provides metadata which a caller can use to decide how long a result may be cached downstream
+type ResponseMeta struct {
+	// MaxAge is the suggested duration for which the result may be cached, for example as 'Cache-Control: max-age'
+	// A zero value indicates that the result should not be cached
+	MaxAge time.Duration
+}
+
+// GetSystemConfigurationWithMeta behaves as GetSystemConfiguration but additionally returns cache metadata
+// The suggested max-age is derived from the TTL remaining on the cached config and is therefore always zero
+// when the Manager is configured without a system cache or the cached entry has already expired
+func (m Manager) GetSystemConfigurationWithMeta(systemURL string, request SystemRequest) (client.ProxyConfig, ResponseMeta, error) {
+	var meta ResponseMeta
+
+	config, err := m.GetSystemConfiguration(systemURL, request)
+	if err != nil {
+		return config, meta, err
+	}
+
+	request = m.withDefaultEnvironment(request)
+	if request.ServiceID == "" {
+		request.ServiceID, _ = m.serviceIDs.get(generateSystemCacheKey(systemURL, request.SystemName))
+	}
+
+	if freshness, ok := m.systemConfigFreshness(systemURL, request); ok {
+		meta.MaxAge = suggestedMaxAge(freshness.TTLRemaining)
+	}
+	return config, meta, nil
+}
+
+// AuthRepWithMeta behaves as AuthRep but additionally returns cache metadata
+// Only a denied decision is considered cacheable, since every authorized request must be reported to 3scale.
+// For a denial, the suggested max-age is the time remaining until the earliest usage limit reported by 3scale
+// backend, or tracked by the backend cache, resets. Denials without usage reports are not cacheable
+func (m Manager) AuthRepWithMeta(backendURL string, request BackendRequest) (*BackendResponse, ResponseMeta, error) {
+	var meta ResponseMeta
+
+	resp, err := m.AuthRep(backendURL, request)
+	if err != nil || resp == nil {
+		return resp, meta, err
+	}
+
+	if !resp.Authorized && !resp.limitReset.IsZero() {
+		meta.MaxAge = suggestedMaxAge(resp.limitReset.Sub(time.Now()))
+	}
+	return resp, meta, nil
+}
+
+// suggestedMaxAge clamps the remaining validity of a result to [0, maxSuggestedMaxAge]
+// The result is truncated to whole seconds since that is the resolution of the Cache-Control header
+func suggestedMaxAge(remaining time.Duration) time.Duration {
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining > maxSuggestedMaxAge {
+		return maxSuggestedMaxAge
+	}
+	return remaining.Truncate(time.Second)
+}
+
+// earliestLimitReset returns the earliest end of any period window in the usage reports, zero if there are none
+func earliestLimitReset(reports api.UsageReports) time.Time {
+	var earliest int64
+	for _, metricReports := range reports {
+		for _, report := range metricReports {
+			end := report.PeriodWindow.End
+			if end > 0 && (earliest == 0 || end < earliest) {
+				earliest = end
+			}
+		}
+	}
+
+	if earliest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(earliest, 0)
+}
+
+// mostConstrainedLimitReset returns the end of the period window of the limit with the least remaining usage in the
+// usage reports, zero if there are none. Ties are resolved in favour of the limit which resets last
+func mostConstrainedLimitReset(reports api.UsageReports) time.Time {
+	var reset int64
+	var remaining int
+	for _, metricReports := range reports {
+		for _, report := range metricReports {
+			end := report.PeriodWindow.End
+			if end <= 0 {
+				continue
+			}
+			left := report.MaxValue - report.CurrentValue
+			if reset == 0 || left < remaining || (left == remaining && end > reset) {
+				reset, remaining = end, left
+			}
+		}
+	}
+
+	if reset == 0 {
+		return time.Time{}
+	}
+	return time.Unix(reset, 0)
+}
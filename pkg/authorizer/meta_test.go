@@ -0,0 +1,244 @@
+package authorizer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-go-client/threescale/api"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestSuggestedMaxAge(t *testing.T) {
+	inputs := []struct {
+		name      string
+		remaining time.Duration
+		expect    time.Duration
+	}{
+		{
+			name:      "Test expired result is not cacheable",
+			remaining: -time.Second,
+			expect:    0,
+		},
+		{
+			name:      "Test zero remaining is not cacheable",
+			remaining: 0,
+			expect:    0,
+		},
+		{
+			name:      "Test less than a second is truncated to zero",
+			remaining: time.Millisecond * 999,
+			expect:    0,
+		},
+		{
+			name:      "Test remaining is truncated to whole seconds",
+			remaining: time.Second*90 + time.Millisecond*500,
+			expect:    time.Second * 90,
+		},
+		{
+			name:      "Test upper bound is not clamped",
+			remaining: maxSuggestedMaxAge,
+			expect:    maxSuggestedMaxAge,
+		},
+		{
+			name:      "Test remaining is clamped to upper bound",
+			remaining: time.Hour * 24,
+			expect:    maxSuggestedMaxAge,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := suggestedMaxAge(input.remaining); got != input.expect {
+				t.Errorf("expected max-age %v but got %v", input.expect, got)
+			}
+		})
+	}
+}
+
+func TestManager_GetSystemConfigurationWithMeta(t *testing.T) {
+	inputs := []struct {
+		name      string
+		ttl       time.Duration
+		withCache bool
+		expectMin time.Duration
+		expectMax time.Duration
+	}{
+		{
+			name:      "Test no max-age without a cache",
+			expectMin: 0,
+			expectMax: 0,
+		},
+		{
+			name:      "Test max-age derived from remaining TTL",
+			ttl:       time.Second * 90,
+			withCache: true,
+			expectMin: time.Second * 89,
+			expectMax: time.Second * 90,
+		},
+		{
+			name:      "Test max-age clamped when TTL exceeds the upper bound",
+			ttl:       time.Hour * 2,
+			withCache: true,
+			expectMin: maxSuggestedMaxAge,
+			expectMax: maxSuggestedMaxAge,
+		},
+	}
+
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withSystemClient: mockSystemClient{
+						withConfig: client.ProxyConfigElement{ProxyConfig: client.ProxyConfig{Environment: "production"}},
+					},
+				},
+			}
+			if input.withCache {
+				m.systemCache = NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: input.ttl}, nil)
+			}
+
+			_, meta, err := m.GetSystemConfigurationWithMeta("test", request)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if meta.MaxAge < input.expectMin || meta.MaxAge > input.expectMax {
+				t.Errorf("expected max-age between %v and %v but got %v", input.expectMin, input.expectMax, meta.MaxAge)
+			}
+		})
+	}
+}
+
+func TestManager_AuthRepWithMeta(t *testing.T) {
+	reset := time.Now().Add(time.Minute * 10).Unix()
+	reports := api.UsageReports{
+		"hits": []api.UsageReport{
+			{PeriodWindow: api.PeriodWindow{Period: api.Hour, End: reset + 3000}, MaxValue: 100, CurrentValue: 20},
+			{PeriodWindow: api.PeriodWindow{Period: api.Minute, End: reset}, MaxValue: 10, CurrentValue: 10},
+		},
+	}
+
+	inputs := []struct {
+		name       string
+		authorized bool
+		reports    api.UsageReports
+		expectMin  time.Duration
+		expectMax  time.Duration
+	}{
+		{
+			name:       "Test authorized decision is not cacheable",
+			authorized: true,
+			reports:    reports,
+		},
+		{
+			name: "Test denial without usage reports is not cacheable",
+		},
+		{
+			name:      "Test denial cacheable until earliest limit reset",
+			reports:   reports,
+			expectMin: time.Minute*10 - time.Second*2,
+			expectMax: time.Minute * 10,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+							return &threescale.AuthorizeResult{
+								Authorized:   input.authorized,
+								UsageReports: input.reports,
+							}, nil
+						},
+					},
+				},
+			}
+
+			resp, meta, err := m.AuthRepWithMeta("", BackendRequest{
+				Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{
+						Metrics: map[string]int{"hits": 1},
+						Params:  BackendParams{AppID: "any"},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if resp.Authorized != input.authorized {
+				t.Errorf("unexpected authorization result")
+			}
+
+			if input.reports != nil && !resp.LimitReset.Equal(time.Unix(reset, 0)) {
+				t.Errorf("unexpected limit reset %v", resp.LimitReset)
+			}
+
+			if input.reports != nil && !resp.LimitReset.Equal(time.Unix(reset, 0)) {
+				t.Errorf("unexpected limit reset %v", resp.LimitReset)
+			}
+
+			if meta.MaxAge < input.expectMin || meta.MaxAge > input.expectMax {
+				t.Errorf("expected max-age between %v and %v but got %v", input.expectMin, input.expectMax, meta.MaxAge)
+			}
+		})
+	}
+}
+
+func TestMostConstrainedLimitReset(t *testing.T) {
+	const reset = int64(1600000000)
+
+	inputs := []struct {
+		name    string
+		reports api.UsageReports
+		expect  time.Time
+	}{
+		{
+			name: "Test no usage reports",
+		},
+		{
+			name: "Test usage reports without period windows",
+			reports: api.UsageReports{
+				"hits": {{PeriodWindow: api.PeriodWindow{Period: api.Eternity}, MaxValue: 10}},
+			},
+		},
+		{
+			name: "Test limit with least remaining usage",
+			reports: api.UsageReports{
+				"hits": {
+					{PeriodWindow: api.PeriodWindow{Period: api.Minute, End: reset}, MaxValue: 10, CurrentValue: 2},
+					{PeriodWindow: api.PeriodWindow{Period: api.Day, End: reset + 3600}, MaxValue: 100, CurrentValue: 99},
+				},
+				"other": {
+					{PeriodWindow: api.PeriodWindow{Period: api.Hour, End: reset + 60}, MaxValue: 5, CurrentValue: 3},
+				},
+			},
+			expect: time.Unix(reset+3600, 0),
+		},
+		{
+			name: "Test tie resolves to the latest reset",
+			reports: api.UsageReports{
+				"hits": {
+					{PeriodWindow: api.PeriodWindow{Period: api.Minute, End: reset}, MaxValue: 10, CurrentValue: 10},
+					{PeriodWindow: api.PeriodWindow{Period: api.Hour, End: reset + 60}, MaxValue: 100, CurrentValue: 100},
+				},
+			},
+			expect: time.Unix(reset+60, 0),
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := mostConstrainedLimitReset(input.reports); !got.Equal(input.expect) {
+				t.Errorf("unexpected reset, wanted %v but got %v", input.expect, got)
+			}
+		})
+	}
+}
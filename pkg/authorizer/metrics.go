@@ -2,7 +2,10 @@ package authorizer
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
+
+	"github.com/3scale/3scale-go-client/threescale"
 )
 
 type Cache int
@@ -27,21 +30,138 @@ type ResponseHook func(report TelemetryReport)
 // CacheHitHook is called when a hit is successful on system or backend cache
 type CacheHitHook func(cache Cache)
 
+// FlushSkippedHook is called when a periodic flush of a cached backend is skipped because the
+// previous flush of that backend is still in progress
+type FlushSkippedHook func(backendURL string)
+
+// FlushTimeoutHook is called when a flush of a cached backend is abandoned because a call to the backend
+// exceeded BackendConfig.FlushTimeout
+type FlushTimeoutHook func(backendURL string)
+
+// CacheEvictionHook is called when an application is evicted from the cache of a cached backend because
+// BackendConfig.MaxCachedApplications was exceeded
+type CacheEvictionHook func(backendURL string)
+
+// ThrottledHook is called when a call to a backend is throttled because it exceeded
+// BackendConfig.MaxConcurrentPassthrough
+type ThrottledHook func(backendURL string)
+
+// DecisionReport reports the outcome of a call to AuthRep for a single service
+type DecisionReport struct {
+	ServiceID  string
+	Authorized bool
+	// ErrorCode is the error code returned by 3scale backend for a denial, for example "limits_exceeded"
+	ErrorCode string
+}
+
+// DecisionHook is called with a DecisionReport for each call to AuthRep which resulted in a decision
+type DecisionHook func(report DecisionReport)
+
+// Phase identifies the kind of interaction with 3scale backend for which latency is observed
+type Phase string
+
+const (
+	// PhaseAuth covers calls to Authorize and AuthRep, whether made on behalf of a request or a flush
+	PhaseAuth Phase = "auth"
+	// PhaseReport covers calls to Report, made when flushing cached usage
+	PhaseReport Phase = "report"
+	// PhaseFlush covers a complete flush of a cached backend, including any auth and report calls it makes
+	PhaseFlush Phase = "flush"
+)
+
+// LatencyReport reports the time taken by an interaction with a 3scale backend
+type LatencyReport struct {
+	BackendURL string
+	Phase      Phase
+	TimeTaken  time.Duration
+}
+
+// LatencyHook is called with a LatencyReport after each interaction with a 3scale backend
+type LatencyHook func(report LatencyReport)
+
 // MetricsReporter holds config for reporting metrics
+// Callbacks are invoked synchronously from whichever goroutine observed the event, including request handlers,
+// the system cache refresh process and the background flushing of cached backends. As such, they may be called
+// concurrently and must be safe for concurrent use. Callbacks should return quickly since they block the caller.
 type MetricsReporter struct {
-	ReportMetrics bool
-	ResponseCB    ResponseHook
-	CacheHitCB    CacheHitHook
+	ReportMetrics  bool
+	ResponseCB     ResponseHook
+	CacheHitCB     CacheHitHook
+	FlushSkippedCB FlushSkippedHook
+	FlushTimeoutCB FlushTimeoutHook
+	// CacheEvictionCB is called for each eviction, a high rate of which indicates that the cardinality of the
+	// cached applications exceeds the limit
+	CacheEvictionCB CacheEvictionHook
+	ThrottledCB     ThrottledHook
+	// LatencyCB is called per backend URL and Phase, allowing latency to be observed for each backend
+	// Like ResponseCB, it is only called when ReportMetrics is true
+	LatencyCB LatencyHook
+	// DecisionCB is called for each authorization decision, labelled by service, whether or not ReportMetrics is set
+	// Calls which fail without a decision are not reported. Care should be taken when using the ServiceID as a metric
+	// label, since its cardinality is that of the services authorized by the Manager, which is unbounded when
+	// serving many tenants. The ErrorCode is one of the small set of codes defined by 3scale backend
+	DecisionCB DecisionHook
+}
+
+// observeDecision calls the DecisionCB, if configured, for a response which carries a decision
+func (mr *MetricsReporter) observeDecision(serviceID string, resp *BackendResponse, err error) {
+	if mr == nil || mr.DecisionCB == nil || err != nil || resp == nil {
+		return
+	}
+	mr.DecisionCB(DecisionReport{ServiceID: serviceID, Authorized: resp.Authorized, ErrorCode: resp.ErrorCode})
+}
+
+// observeLatency calls the LatencyCB, if configured, with the time since start
+func (mr *MetricsReporter) observeLatency(backendURL string, phase Phase, start time.Time) {
+	if mr == nil || !mr.ReportMetrics || mr.LatencyCB == nil {
+		return
+	}
+	mr.LatencyCB(LatencyReport{BackendURL: backendURL, Phase: phase, TimeTaken: time.Since(start)})
+}
+
+// latencyObservingClient is a threescale.Client which reports the latency of each call to a MetricsReporter
+type latencyObservingClient struct {
+	next       threescale.Client
+	backendURL string
+	reporter   *MetricsReporter
+}
+
+func (lc *latencyObservingClient) Authorize(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	defer lc.reporter.observeLatency(lc.backendURL, PhaseAuth, time.Now())
+	return lc.next.Authorize(request)
+}
+
+func (lc *latencyObservingClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	defer lc.reporter.observeLatency(lc.backendURL, PhaseAuth, time.Now())
+	return lc.next.AuthRep(request)
+}
+
+func (lc *latencyObservingClient) Report(request threescale.Request) (*threescale.ReportResult, error) {
+	defer lc.reporter.observeLatency(lc.backendURL, PhaseReport, time.Now())
+	return lc.next.Report(request)
+}
+
+func (lc *latencyObservingClient) GetPeer() string {
+	return lc.next.GetPeer()
 }
 
+// observeLatency wraps the client such that its calls are reported to the MetricsReporter, if one is configured
+func observeLatency(client threescale.Client, backendURL string, reporter *MetricsReporter) threescale.Client {
+	if reporter == nil || !reporter.ReportMetrics || reporter.LatencyCB == nil {
+		return client
+	}
+	return &latencyObservingClient{next: client, backendURL: backendURL, reporter: reporter}
+}
+
+// MetricsTransport is a http.RoundTripper which calls the hook with a TelemetryReport for each response
 type MetricsTransport struct {
-	client *http.Client
-	hook   ResponseHook
+	next http.RoundTripper
+	hook ResponseHook
 }
 
 func (mt *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
-	resp, err := mt.client.Transport.RoundTrip(req)
+	resp, err := mt.next.RoundTrip(req)
 	if err != nil {
 		return resp, err
 	}
@@ -57,3 +177,117 @@ func (mt *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	mt.hook(report)
 	return resp, err
 }
+
+// ManagerMetrics is a snapshot of the counters maintained by a Manager since it was created
+// It allows metrics to be polled, as an alternative to the callbacks of the MetricsReporter
+type ManagerMetrics struct {
+	// RequestsAuthorized, RequestsDenied and RequestsFailed count the calls to AuthRep by outcome
+	// Calls rejected with ErrShuttingDown are not counted
+	RequestsAuthorized int64
+	RequestsDenied     int64
+	RequestsFailed     int64
+	// RequestsThrottled counts the calls to AuthRep throttled by BackendConfig.MaxConcurrentPassthrough, whether or
+	// not they were let through by the failure policy
+	RequestsThrottled int64
+	// SystemCacheHits and SystemCacheMisses count lookups of proxy configs in the system cache
+	SystemCacheHits   int64
+	SystemCacheMisses int64
+	// BackendCacheHits counts cache hits as reported to MetricsReporter.CacheHitCB
+	// BackendCacheMisses counts the times state for an application was fetched from 3scale by a cached backend
+	BackendCacheHits   int64
+	BackendCacheMisses int64
+	// BackendCacheEvictions counts the applications evicted from cached backends to respect
+	// BackendConfig.MaxCachedApplications
+	BackendCacheEvictions int64
+	// Flushes counts completed periodic and final flushes of cached backends, of which FlushesFailed made a failed
+	// call to 3scale and FlushesTimedOut made a call which exceeded BackendConfig.FlushTimeout
+	Flushes         int64
+	FlushesFailed   int64
+	FlushesTimedOut int64
+	// FlushesSkipped counts periodic flushes skipped because the previous flush was still in progress
+	FlushesSkipped int64
+	// CachedBackends is the number of cached backends at the time of the snapshot
+	CachedBackends int
+	// ActiveFlushGoroutines is the value of ActiveFlushGoroutines at the time of the snapshot
+	ActiveFlushGoroutines int
+}
+
+// counter identifies one of the managerCounters
+type counter int
+
+const (
+	countRequestsAuthorized counter = iota
+	countRequestsDenied
+	countRequestsFailed
+	countRequestsThrottled
+	countSystemCacheHits
+	countSystemCacheMisses
+	countBackendCacheHits
+	countBackendCacheMisses
+	countBackendCacheEvictions
+	countFlushes
+	countFlushesFailed
+	countFlushesTimedOut
+	countFlushesSkipped
+	numCounters
+)
+
+// managerCounters holds the counters read by MetricsSnapshot, each of which must be accessed atomically
+type managerCounters struct {
+	values [numCounters]int64
+}
+
+// add increments the counter
+func (mc *managerCounters) add(c counter) {
+	if mc != nil {
+		atomic.AddInt64(&mc.values[c], 1)
+	}
+}
+
+// load returns the current value of the counter
+func (mc *managerCounters) load(c counter) int64 {
+	if mc == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&mc.values[c])
+}
+
+// observeResponse counts the outcome of a call to AuthRep
+func (mc *managerCounters) observeResponse(resp *BackendResponse, err error) {
+	switch {
+	case err != nil || resp == nil:
+		mc.add(countRequestsFailed)
+	case resp.Authorized:
+		mc.add(countRequestsAuthorized)
+	default:
+		mc.add(countRequestsDenied)
+	}
+}
+
+// MetricsSnapshot returns the current value of the counters maintained by the Manager
+func (m Manager) MetricsSnapshot() ManagerMetrics {
+	mc := m.counters
+	snapshot := ManagerMetrics{
+		RequestsAuthorized:    mc.load(countRequestsAuthorized),
+		RequestsDenied:        mc.load(countRequestsDenied),
+		RequestsFailed:        mc.load(countRequestsFailed),
+		RequestsThrottled:     mc.load(countRequestsThrottled),
+		SystemCacheHits:       mc.load(countSystemCacheHits),
+		SystemCacheMisses:     mc.load(countSystemCacheMisses),
+		BackendCacheHits:      mc.load(countBackendCacheHits),
+		BackendCacheMisses:    mc.load(countBackendCacheMisses),
+		BackendCacheEvictions: mc.load(countBackendCacheEvictions),
+		Flushes:               mc.load(countFlushes),
+		FlushesFailed:         mc.load(countFlushesFailed),
+		FlushesTimedOut:       mc.load(countFlushesTimedOut),
+		FlushesSkipped:        mc.load(countFlushesSkipped),
+		ActiveFlushGoroutines: m.ActiveFlushGoroutines(),
+	}
+
+	if m.cachedBackendsLock != nil {
+		m.cachedBackendsLock.RLock()
+		snapshot.CachedBackends = len(m.cachedBackends)
+		m.cachedBackendsLock.RUnlock()
+	}
+	return snapshot
+}
@@ -0,0 +1,270 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestMetricsReporter_ConcurrentCallbacks(t *testing.T) {
+	const concurrency = 20
+
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	var responses, backendHits int32
+	passthrough := NewManager(http.DefaultClient, nil, BackendConfig{}, &MetricsReporter{
+		ReportMetrics: true,
+		ResponseCB: func(report TelemetryReport) {
+			atomic.AddInt32(&responses, 1)
+		},
+	})
+	defer passthrough.Shutdown()
+
+	cached := NewManager(http.DefaultClient, nil, BackendConfig{
+		EnableCaching:      true,
+		CacheFlushInterval: time.Millisecond,
+	}, &MetricsReporter{
+		ReportMetrics: true,
+		ResponseCB: func(report TelemetryReport) {
+			atomic.AddInt32(&responses, 1)
+		},
+		CacheHitCB: func(cache Cache) {
+			if cache == Backend {
+				atomic.AddInt32(&backendHits, 1)
+			}
+		},
+	})
+	defer cached.Shutdown()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		for _, m := range []*Manager{passthrough, cached} {
+			wg.Add(1)
+			go func(m *Manager) {
+				defer wg.Done()
+				if _, err := m.AuthRep(server.URL, request); err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+			}(m)
+		}
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&responses) < concurrency {
+		t.Errorf("expected response callback to be called for each passthrough request")
+	}
+
+	if atomic.LoadInt32(&backendHits) < 1 {
+		t.Errorf("expected cache hit callback to be called for cached backend")
+	}
+}
+
+func TestMetricsReporter_LatencyPerBackend(t *testing.T) {
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "provider_key", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics: map[string]int{"hits": 1},
+				Params:  BackendParams{AppID: "any"},
+			},
+		},
+	}
+
+	inputs := []struct {
+		name          string
+		enableCaching bool
+		expectPhases  []Phase
+	}{
+		{
+			name:         "Test passthrough reports auth phase",
+			expectPhases: []Phase{PhaseAuth},
+		},
+		{
+			name:          "Test cached backend reports auth, report and flush phases",
+			enableCaching: true,
+			expectPhases:  []Phase{PhaseAuth, PhaseReport, PhaseFlush},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var lock sync.Mutex
+			observed := make(map[Phase]int)
+
+			m := NewManager(http.DefaultClient, nil, BackendConfig{
+				EnableCaching:      input.enableCaching,
+				CacheFlushInterval: time.Hour,
+			}, &MetricsReporter{
+				ReportMetrics: true,
+				LatencyCB: func(report LatencyReport) {
+					if report.BackendURL != server.URL {
+						t.Errorf("expected backend url %s but got %s", server.URL, report.BackendURL)
+					}
+					lock.Lock()
+					observed[report.Phase]++
+					lock.Unlock()
+				},
+			})
+
+			if _, err := m.AuthRep(server.URL, request); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			// shutting down flushes any cached backends
+			m.Shutdown()
+
+			lock.Lock()
+			defer lock.Unlock()
+			if len(observed) != len(input.expectPhases) {
+				t.Errorf("expected phases %v but observed %v", input.expectPhases, observed)
+			}
+			for _, phase := range input.expectPhases {
+				if observed[phase] == 0 {
+					t.Errorf("expected latency to be observed for phase %s", phase)
+				}
+			}
+		})
+	}
+}
+
+func TestManager_MetricsSnapshot(t *testing.T) {
+	server := newFakeApisonator(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer server.Close()
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, nil)
+	m := NewManager(http.DefaultClient, systemCache, BackendConfig{
+		EnableCaching:            true,
+		CacheFlushInterval:       time.Hour,
+		MaxMetricsPerTransaction: 1,
+		CredentialOverrides:      CredentialOverrides{Deny: []string{"denied"}},
+	}, nil)
+	m.clientBuilder = mockBuilder{
+		withSystemClient: mockSystemClient{
+			withConfig: client.ProxyConfigElement{ProxyConfig: client.ProxyConfig{Environment: "production"}},
+		},
+	}
+
+	systemRequest := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetSystemConfiguration("test", systemRequest); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	requestWith := func(params BackendParams, metrics map[string]int) BackendRequest {
+		return BackendRequest{
+			Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+			Service:      "any",
+			Transactions: []BackendTransaction{{Metrics: metrics, Params: params}},
+		}
+	}
+	requests := []BackendRequest{
+		requestWith(BackendParams{AppID: "any"}, map[string]int{"hits": 1}),
+		requestWith(BackendParams{AppID: "any"}, map[string]int{"hits": 1}),
+		requestWith(BackendParams{UserKey: "denied"}, map[string]int{"hits": 1}),
+		requestWith(BackendParams{AppID: "any"}, map[string]int{"hits": 1, "other": 1}),
+	}
+	for _, request := range requests {
+		m.AuthRep(server.URL, request)
+	}
+
+	snapshot := m.MetricsSnapshot()
+	if snapshot.RequestsAuthorized != 2 || snapshot.RequestsDenied != 1 || snapshot.RequestsFailed != 1 {
+		t.Errorf("unexpected request counts %+v", snapshot)
+	}
+	if snapshot.SystemCacheHits != 1 || snapshot.SystemCacheMisses != 1 {
+		t.Errorf("unexpected system cache counts %+v", snapshot)
+	}
+	if snapshot.BackendCacheMisses != 1 || snapshot.BackendCacheHits < 1 {
+		t.Errorf("unexpected backend cache counts %+v", snapshot)
+	}
+	if snapshot.CachedBackends != 1 || snapshot.ActiveFlushGoroutines != 1 || snapshot.Flushes != 0 {
+		t.Errorf("unexpected backend state %+v", snapshot)
+	}
+
+	m.Shutdown()
+	snapshot = m.MetricsSnapshot()
+	if snapshot.Flushes != 1 || snapshot.FlushesFailed != 0 || snapshot.ActiveFlushGoroutines != 0 {
+		t.Errorf("expected final flush to be counted, got %+v", snapshot)
+	}
+
+	if snapshot := (Manager{}).MetricsSnapshot(); snapshot != (ManagerMetrics{}) {
+		t.Errorf("expected empty snapshot for zero value manager, got %+v", snapshot)
+	}
+}
+
+func TestMetricsReporter_DecisionPerService(t *testing.T) {
+	var lock sync.Mutex
+	var decisions []DecisionReport
+	reporter := &MetricsReporter{
+		DecisionCB: func(report DecisionReport) {
+			lock.Lock()
+			decisions = append(decisions, report)
+			lock.Unlock()
+		},
+	}
+
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{
+				withAuthRepCb: func(request threescale.Request) (*threescale.AuthorizeResult, error) {
+					switch request.Service {
+					case "authorized":
+						return &threescale.AuthorizeResult{Authorized: true}, nil
+					case "denied":
+						return &threescale.AuthorizeResult{ErrorCode: "limits_exceeded"}, nil
+					default:
+						return nil, fmt.Errorf("arbitrary error")
+					}
+				},
+			},
+		},
+		metricsReporter: reporter,
+	}
+
+	for _, service := range []string{"authorized", "denied", "failing", "authorized"} {
+		m.AuthRep("", BackendRequest{
+			Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+			Service:      service,
+			Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+		})
+	}
+
+	expect := []DecisionReport{
+		{ServiceID: "authorized", Authorized: true},
+		{ServiceID: "denied", ErrorCode: "limits_exceeded"},
+		{ServiceID: "authorized", Authorized: true},
+	}
+	if !reflect.DeepEqual(decisions, expect) {
+		t.Errorf("unexpected decisions, wanted %+v but got %+v", expect, decisions)
+	}
+}
@@ -0,0 +1,42 @@
+package authorizer
+
+import (
+	"net/http"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// SystemManager is a lightweight alternative to Manager for consumers which only read configuration from 3scale system
+// It does not support interactions with 3scale backend and never starts any backend related background processes
+type SystemManager struct {
+	manager *Manager
+}
+
+// NewSystemManager returns an instance of SystemManager
+// Starts refreshing background process for underlying system cache if provided
+func NewSystemManager(client *http.Client, systemCache *SystemCache, reporter *MetricsReporter) *SystemManager {
+	return &SystemManager{
+		manager: NewManager(client, systemCache, BackendConfig{}, reporter),
+	}
+}
+
+// GetSystemConfiguration returns the configuration from 3scale system for the provided request
+func (sm *SystemManager) GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	return sm.manager.GetSystemConfiguration(systemURL, request)
+}
+
+// PeekSystemConfiguration returns the cached configuration for the provided request, if any, without fetching it
+func (sm *SystemManager) PeekSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, CacheMeta, bool) {
+	return sm.manager.PeekSystemConfiguration(systemURL, request)
+}
+
+// InvalidateSystemConfiguration removes the cached configuration for the provided request, if any,
+// resulting in the next call to GetSystemConfiguration fetching it from 3scale system
+func (sm *SystemManager) InvalidateSystemConfiguration(systemURL string, request SystemRequest) {
+	sm.manager.InvalidateSystemConfiguration(systemURL, request)
+}
+
+// Shutdown stops the background process refreshing the system cache and blocks until it has exited
+func (sm *SystemManager) Shutdown() {
+	sm.manager.Shutdown()
+}
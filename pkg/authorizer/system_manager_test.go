@@ -0,0 +1,58 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+func TestSystemManager_GetSystemConfiguration(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"proxy_config":{"id":1,"version":2,"environment":"production","content":{"id":1}}}`))
+	}))
+	defer server.Close()
+
+	request := SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "1",
+		Environment: "production",
+	}
+
+	sc := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, TTL: time.Minute}, make(chan struct{}))
+	sm := NewSystemManager(http.DefaultClient, sc, nil)
+	sm.manager.clientBuilder = NewClientBuilder(http.DefaultClient)
+	defer sm.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		config, err := sm.GetSystemConfiguration(server.URL, request)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if config.Version != 2 {
+			t.Errorf("unexpected config returned %v", config)
+		}
+	}
+
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected config to be served from cache, got %d remote calls", calls)
+	}
+
+	sm.InvalidateSystemConfiguration(server.URL, request)
+	if _, err := sm.GetSystemConfiguration(server.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected config to be fetched remotely after invalidation")
+	}
+
+	if sm.manager.cachedBackends != nil {
+		t.Errorf("expected no backend machinery to be configured")
+	}
+}
@@ -0,0 +1,191 @@
+package authorizer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// TransportStats is a snapshot of the connection pool of the http client used to call 3scale, system and backend
+// It is only collected when the Manager is created WithTransportStats
+type TransportStats struct {
+	// Dials and DialErrors count the connections dialed, successfully or not
+	Dials      int64
+	DialErrors int64
+	// OpenConnections is the number of dialed connections which have not yet been closed
+	OpenConnections int64
+	// ActiveConnections is the number of connections in use by a request, IdleConnections the number of
+	// open connections which are not. These assume one request per connection, as is the case for HTTP/1.1
+	ActiveConnections int64
+	IdleConnections   int64
+	// Requests counts the requests for which a connection was obtained, ReusedConnections those for which
+	// the connection had been used by a previous request rather than newly dialed
+	Requests          int64
+	ReusedConnections int64
+}
+
+// ReuseRate returns the fraction of requests which reused an existing connection
+func (ts TransportStats) ReuseRate() float64 {
+	if ts.Requests == 0 {
+		return 0
+	}
+	return float64(ts.ReusedConnections) / float64(ts.Requests)
+}
+
+// WithTransportStats collects statistics on the connection pool of the http client provided to NewManager, which
+// are returned by Manager.TransportStats. Open and idle connections are counted by wrapping the DialContext of the
+// *http.Transport at the base of the client, so are not counted for backends listening on a Unix domain socket, or
+// if the transport has been replaced by a custom http.RoundTripper
+func WithTransportStats() ManagerOption {
+	return func(m *Manager) {
+		m.transportStats = &transportStats{}
+	}
+}
+
+// TransportStats returns the current statistics of the connection pool used to call 3scale
+// Returns the zero value unless the Manager was created WithTransportStats
+func (m Manager) TransportStats() TransportStats {
+	ts := m.transportStats
+	if ts == nil {
+		return TransportStats{}
+	}
+
+	stats := TransportStats{
+		Dials:             atomic.LoadInt64(&ts.dials),
+		DialErrors:        atomic.LoadInt64(&ts.dialErrors),
+		OpenConnections:   atomic.LoadInt64(&ts.open),
+		ActiveConnections: atomic.LoadInt64(&ts.active),
+		Requests:          atomic.LoadInt64(&ts.requests),
+		ReusedConnections: atomic.LoadInt64(&ts.reused),
+	}
+	if idle := stats.OpenConnections - stats.ActiveConnections; idle > 0 {
+		stats.IdleConnections = idle
+	}
+	return stats
+}
+
+// transportStats holds the counters read by TransportStats, each of which must be accessed atomically
+type transportStats struct {
+	dials      int64
+	dialErrors int64
+	open       int64
+	active     int64
+	requests   int64
+	reused     int64
+}
+
+// withTransportStats returns a copy of the provided http client which records its use of connections to stats
+// If the base of its transport cannot be replaced, open connections are not counted
+func withTransportStats(httpClient *http.Client, stats *transportStats) (*http.Client, error) {
+	transport, err := withBaseTransport(httpClient.Transport, func(base *http.Transport) http.RoundTripper {
+		countingTransport := base.Clone()
+		countingTransport.DialContext = stats.countDials(base.DialContext)
+		return countingTransport
+	})
+	if err != nil {
+		return withTransport(httpClient, func(next http.RoundTripper) http.RoundTripper {
+			return &statsTransport{next: next, stats: stats}
+		}), err
+	}
+
+	statsClient := *httpClient
+	statsClient.Transport = &statsTransport{next: transport, stats: stats}
+	return &statsClient, nil
+}
+
+// countDials wraps the provided dial function, counting the connections it dials until they are closed
+func (ts *transportStats) countDials(dial func(ctx context.Context, network, addr string) (net.Conn, error)) DialContextFunc {
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&ts.dialErrors, 1)
+			return conn, err
+		}
+		atomic.AddInt64(&ts.dials, 1)
+		atomic.AddInt64(&ts.open, 1)
+		return &countedConn{Conn: conn, stats: ts}, nil
+	}
+}
+
+// countedConn is a net.Conn which decrements the count of open connections when it is first closed
+type countedConn struct {
+	net.Conn
+	stats *transportStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// statsTransport is a http.RoundTripper which traces the connection used by each request, counting a connection as
+// active from when it is obtained until the response body is closed
+type statsTransport struct {
+	next  http.RoundTripper
+	stats *transportStats
+}
+
+func (st *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release := &connRelease{stats: st.stats}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			atomic.AddInt64(&st.stats.requests, 1)
+			if info.Reused {
+				atomic.AddInt64(&st.stats.reused, 1)
+			}
+			release.acquire()
+		},
+	}
+
+	resp, err := st.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil || resp == nil || resp.Body == nil {
+		release.release()
+		return resp, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// connRelease tracks whether a request holds an active connection, such that it is released exactly once
+type connRelease struct {
+	stats    *transportStats
+	held     int32
+	released int32
+}
+
+func (cr *connRelease) acquire() {
+	if atomic.CompareAndSwapInt32(&cr.held, 0, 1) {
+		atomic.AddInt64(&cr.stats.active, 1)
+	}
+}
+
+func (cr *connRelease) release() {
+	if atomic.LoadInt32(&cr.held) == 1 && atomic.CompareAndSwapInt32(&cr.released, 0, 1) {
+		atomic.AddInt64(&cr.stats.active, -1)
+	}
+}
+
+// releasingBody releases the connection of the request once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release *connRelease
+}
+
+func (rb *releasingBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.release.release()
+	return err
+}
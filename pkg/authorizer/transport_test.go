@@ -0,0 +1,87 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManager_TransportStats(t *testing.T) {
+	server := httptest.NewServer(fakeApisonatorHandler(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	m := NewManager(&http.Client{Transport: &http.Transport{}}, nil, BackendConfig{}, nil, WithTransportStats())
+
+	const requests = 3
+	for i := 0; i < requests; i++ {
+		resp, err := m.AuthRep(server.URL, BackendRequest{
+			Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+			Service:      "1",
+			Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+		})
+		if err != nil || !resp.Authorized {
+			t.Fatalf("expected request to be authorized, got %v, %v", resp, err)
+		}
+	}
+
+	expect := TransportStats{
+		Dials:             1,
+		OpenConnections:   1,
+		IdleConnections:   1,
+		Requests:          requests,
+		ReusedConnections: requests - 1,
+	}
+	stats := m.TransportStats()
+	if stats != expect {
+		t.Errorf("unexpected stats, wanted %+v but got %+v", expect, stats)
+	}
+	if rate, expectRate := stats.ReuseRate(), float64(requests-1)/requests; rate != expectRate {
+		t.Errorf("unexpected reuse rate, wanted %v but got %v", expectRate, rate)
+	}
+
+	if _, err := m.AuthRep("http://127.0.0.1:0", BackendRequest{
+		Auth:         BackendAuth{Type: "provider_key", Value: "any"},
+		Service:      "1",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "any"}}},
+	}); err == nil {
+		t.Fatalf("expected an error for an unreachable backend")
+	}
+	if stats := m.TransportStats(); stats.DialErrors != 1 || stats.ActiveConnections != 0 {
+		t.Errorf("expected a dial error and no active connections, got %+v", stats)
+	}
+
+	if stats := (Manager{}).TransportStats(); stats != (TransportStats{}) {
+		t.Errorf("expected no stats unless enabled, got %+v", stats)
+	}
+}
+
+func TestTransportStats_ReuseRate(t *testing.T) {
+	inputs := []struct {
+		name   string
+		stats  TransportStats
+		expect float64
+	}{
+		{
+			name:   "Test no requests",
+			expect: 0,
+		},
+		{
+			name:   "Test no reuse",
+			stats:  TransportStats{Requests: 2},
+			expect: 0,
+		},
+		{
+			name:   "Test partial reuse",
+			stats:  TransportStats{Requests: 4, ReusedConnections: 3},
+			expect: 0.75,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := input.stats.ReuseRate(); got != input.expect {
+				t.Errorf("unexpected reuse rate, wanted %v but got %v", input.expect, got)
+			}
+		})
+	}
+}
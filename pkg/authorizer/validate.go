@@ -0,0 +1,143 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// metricSystemNamePattern matches the characters 3scale allows in a metric system name
+var metricSystemNamePattern = regexp.MustCompile(`^[\w\-.]+$`)
+
+// httpMethods are the methods which a mapping rule can be defined against
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "TRACE", "CONNECT"}
+
+// ValidateProxyConfig checks a proxy config for problems which would prevent it from being used reliably
+// It checks that each mapping rule has a pattern which compiles, a supported HTTP method, a positive delta and
+// a well formed metric system name, as well as checking that the backend and API backend endpoints are valid URLs.
+// Since the proxy config does not list the metrics of a service, a referenced metric is required to be well formed
+// but is not checked against the metrics defined in 3scale. Returns a list of problems, empty if there are none
+func ValidateProxyConfig(config client.ProxyConfig) []error {
+	var problems []error
+	proxy := config.Content.Proxy
+
+	if err := validateEndpoint(proxy.Backend.Endpoint); err != nil {
+		problems = append(problems, fmt.Errorf("backend endpoint - %s", err.Error()))
+	}
+
+	if proxy.APIBackend != "" {
+		if err := validateEndpoint(proxy.APIBackend); err != nil {
+			problems = append(problems, fmt.Errorf("api backend - %s", err.Error()))
+		}
+	}
+
+	for index, rule := range proxy.ProxyRules {
+		for _, err := range validateProxyRule(rule) {
+			problems = append(problems, fmt.Errorf("mapping rule %d (%s %s) - %s", index, rule.HTTPMethod, rule.Pattern, err.Error()))
+		}
+	}
+
+	return problems
+}
+
+func validateProxyRule(rule client.ProxyRule) []error {
+	var problems []error
+
+	if err := validatePattern(rule.Pattern); err != nil {
+		problems = append(problems, err)
+	}
+
+	if !contains(strings.ToUpper(rule.HTTPMethod), httpMethods) {
+		problems = append(problems, fmt.Errorf("unsupported http method %q", rule.HTTPMethod))
+	}
+
+	if rule.MetricSystemName == "" {
+		problems = append(problems, fmt.Errorf("no metric referenced"))
+	} else if !metricSystemNamePattern.MatchString(rule.MetricSystemName) {
+		problems = append(problems, fmt.Errorf("invalid metric system name %q", rule.MetricSystemName))
+	}
+
+	if rule.Delta <= 0 {
+		problems = append(problems, fmt.Errorf("delta must be positive, got %d", rule.Delta))
+	}
+
+	return problems
+}
+
+// validatePattern checks that a mapping rule pattern is well formed and can be compiled to a regular expression
+// A pattern must be a path starting with '/', may contain named placeholders such as '{id}' and may end in '$'
+// to require an exact match
+func validatePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("pattern %q must start with '/'", pattern)
+	}
+
+	path := pattern
+	if index := strings.Index(path, "?"); index >= 0 {
+		path = path[:index]
+	}
+
+	exact := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	if strings.Contains(path, "$") {
+		return fmt.Errorf("pattern %q may only contain '$' at the end of the path", pattern)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for len(path) > 0 {
+		start := strings.IndexAny(path, "{}")
+		if start < 0 {
+			expr.WriteString(regexp.QuoteMeta(path))
+			break
+		}
+		if path[start] == '}' {
+			return fmt.Errorf("pattern %q has an unopened '}'", pattern)
+		}
+
+		end := strings.Index(path[start:], "}")
+		if end < 0 {
+			return fmt.Errorf("pattern %q has an unclosed '{'", pattern)
+		}
+		name := path[start+1 : start+end]
+		if name == "" || strings.Contains(name, "{") {
+			return fmt.Errorf("pattern %q has an invalid placeholder %q", pattern, name)
+		}
+
+		expr.WriteString(regexp.QuoteMeta(path[:start]))
+		expr.WriteString(`[^/?]+`)
+		path = path[start+end+1:]
+	}
+	if exact {
+		expr.WriteString("$")
+	}
+
+	if _, err := regexp.Compile(expr.String()); err != nil {
+		return fmt.Errorf("pattern %q does not compile - %s", pattern, err.Error())
+	}
+	return nil
+}
+
+// validateEndpoint checks that the endpoint is an absolute http or https URL
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("not set")
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid url %q - %s", endpoint, err.Error())
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme in %q", endpoint)
+	}
+
+	if parsed.Host == "" {
+		return fmt.Errorf("no host in %q", endpoint)
+	}
+	return nil
+}
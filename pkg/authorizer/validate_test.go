@@ -0,0 +1,128 @@
+package authorizer
+
+import (
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestValidateProxyConfig(t *testing.T) {
+	validRule := client.ProxyRule{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1}
+
+	configWith := func(modify func(proxy *client.ContentProxy)) client.ProxyConfig {
+		proxy := client.ContentProxy{
+			APIBackend: "https://echo-api.3scale.net:443",
+			Backend:    client.Backend{Endpoint: "https://su1.3scale.net"},
+			ProxyRules: []client.ProxyRule{validRule},
+		}
+		if modify != nil {
+			modify(&proxy)
+		}
+		return client.ProxyConfig{Content: client.Content{Proxy: proxy}}
+	}
+
+	withRule := func(rule client.ProxyRule) func(proxy *client.ContentProxy) {
+		return func(proxy *client.ContentProxy) {
+			proxy.ProxyRules = append(proxy.ProxyRules, rule)
+		}
+	}
+
+	inputs := []struct {
+		name           string
+		config         client.ProxyConfig
+		expectProblems int
+	}{
+		{
+			name:   "Test valid config has no problems",
+			config: configWith(nil),
+		},
+		{
+			name: "Test valid config with placeholders, query and exact match",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod:       "post",
+				Pattern:          "/v1/{account}/orders/{id}.json$",
+				MetricSystemName: "orders.create",
+				Delta:            2,
+			})),
+		},
+		{
+			name: "Test pattern with query parameters",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/search?q={query}", MetricSystemName: "search", Delta: 1,
+			})),
+		},
+		{
+			name: "Test pattern must start with a slash",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "orders", MetricSystemName: "hits", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test unclosed placeholder",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/orders/{id", MetricSystemName: "hits", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test unopened placeholder",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/orders/id}", MetricSystemName: "hits", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test empty placeholder",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/orders/{}", MetricSystemName: "hits", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test dollar sign before the end of the path",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/orders$/items", MetricSystemName: "hits", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test broken rule reports each problem",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "FETCH", Pattern: "/", MetricSystemName: "", Delta: 0,
+			})),
+			expectProblems: 3,
+		},
+		{
+			name: "Test invalid metric system name",
+			config: configWith(withRule(client.ProxyRule{
+				HTTPMethod: "GET", Pattern: "/", MetricSystemName: "my metric", Delta: 1,
+			})),
+			expectProblems: 1,
+		},
+		{
+			name: "Test missing backend endpoint",
+			config: configWith(func(proxy *client.ContentProxy) {
+				proxy.Backend.Endpoint = ""
+			}),
+			expectProblems: 1,
+		},
+		{
+			name: "Test broken endpoints",
+			config: configWith(func(proxy *client.ContentProxy) {
+				proxy.Backend.Endpoint = "su1.3scale.net"
+				proxy.APIBackend = "https://"
+			}),
+			expectProblems: 2,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			problems := ValidateProxyConfig(input.config)
+			if len(problems) != input.expectProblems {
+				t.Errorf("expected %d problems but got %d - %v", input.expectProblems, len(problems), problems)
+			}
+		})
+	}
+}
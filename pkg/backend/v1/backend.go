@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3scale/3scale-authorizer/pkg/core"
@@ -17,6 +18,48 @@ import (
 // describing the different reasons an authorization can be denied.
 const RejectionReasonHeaderExtension = "rejection_reason_header"
 
+// Aggregation defines how the values reported for a metric are accumulated in the cache between flushes
+type Aggregation string
+
+// Supported aggregations. Metrics are aggregated with AggregateSum unless configured otherwise
+const (
+	// AggregateSum reports the sum of the values reported since the last flush, suitable for counters
+	AggregateSum Aggregation = "sum"
+	// AggregateMax reports the largest value reported since the last flush, suitable for gauges such as
+	// concurrent connections
+	AggregateMax Aggregation = "max"
+	// AggregateLast reports the most recent value reported since the last flush
+	AggregateLast Aggregation = "last"
+)
+
+// WindowAlignment configures how the period windows of the cached limits are aligned to the calendar, and so the time
+// at which each limit is enforced as having reset and is reported to reset. The zero value matches apisonator, which aligns
+// windows in UTC with weeks starting on Monday, and should only be changed when 3scale is known to align them differently
+type WindowAlignment struct {
+	// Location in which windows are aligned to the calendar, defaults to UTC if nil
+	Location *time.Location
+	// WeekStartsOnSunday aligns weekly windows to start on Sunday rather than Monday
+	WeekStartsOnSunday bool
+}
+
+func (wa WindowAlignment) location() *time.Location {
+	if wa.Location == nil {
+		return time.UTC
+	}
+	return wa.Location
+}
+
+// daysSinceWeekStart returns the number of days between the first day of the week and the given day
+func (wa WindowAlignment) daysSinceWeekStart(day time.Weekday) int {
+	if wa.WeekStartsOnSunday {
+		return int(day)
+	}
+	return (int(day) + 6) % 7
+}
+
+// userSegmentSeparator separates the application from the user in cache keys segmented per user
+const userSegmentSeparator = ":"
+
 // Backend defines the connection to a single backend and maintains a cache
 // for multiple services and applications per backend. It implements the 3scale Client interface
 type Backend struct {
@@ -29,6 +72,35 @@ type Backend struct {
 	policy           FailurePolicy
 	logger           core.Logger
 	cacheHitCallback func()
+	// cacheMissCallback, if set, is called when state for an application must be fetched from 3scale
+	cacheMissCallback func()
+	// flushLock ensures only a single flush runs at any given time
+	flushLock sync.Mutex
+	// pendingFlushes counts flushes which are running or waiting to run
+	pendingFlushes int32
+	// segmentByUser results in counters being cached per end user, when a user id is provided
+	segmentByUser bool
+	// pendingTransactions counts transactions reported to the cache since the last flush began
+	pendingTransactions int64
+	// aggregations maps metric names to the aggregation used for them, metrics not present are summed
+	aggregations map[string]Aggregation
+	// flushClient, if set, is used in place of client for the calls made when flushing
+	flushClient threescale.Client
+	// overflowed is set when the last flush could not enqueue every cached application because the queue was full
+	overflowed int32
+	// maxCachedApplications, if greater than zero, limits the number of cached applications
+	maxCachedApplications int
+	// lru tracks the use of cached applications when their number is limited
+	lru *lruTracker
+	// evictionCallback, if set, is called for each application evicted from the cache
+	evictionCallback func()
+	// evicting is set while an eviction is running
+	evicting int32
+	// evictionDone is closed once the most recently started eviction has completed, guarded by evictionLock
+	evictionDone chan struct{}
+	evictionLock sync.Mutex
+	// windowAlignment configures the alignment of the period windows of returned usage reports
+	windowAlignment WindowAlignment
 }
 
 // Application defined under a 3scale service
@@ -47,6 +119,8 @@ type Application struct {
 	id string
 	// ownedBy this service id
 	ownedBy api.Service
+	// evicted is set once the application has been removed from the cache to limit its size
+	evicted bool
 }
 
 // LimitCounter keeps a count of limits for a given period
@@ -83,6 +157,7 @@ func NewBackend(url string, client *http.Client, logger core.Logger, policy Fail
 		cache:            NewLocalCache(),
 		queue:            newQueue(100),
 		policy:           policy,
+		logger:           logger,
 		cacheHitCallback: func() {},
 	}, nil
 }
@@ -92,6 +167,68 @@ func (b *Backend) SetCacheHitCallback(f func()) {
 	b.cacheHitCallback = f
 }
 
+// SetCacheMissCallback sets a callback which is called each time state for an application is fetched from 3scale
+// because it is not present in the cache
+func (b *Backend) SetCacheMissCallback(f func()) {
+	b.cacheMissCallback = f
+}
+
+// SetSegmentByUser toggles caching of counters per end user for requests which provide a user id
+// This allows limits defined for end users to be enforced locally at the cost of increased cache cardinality
+// When disabled, usage is cached and reported per application only, without a user id
+func (b *Backend) SetSegmentByUser(segment bool) {
+	b.segmentByUser = segment
+}
+
+// SetWindowAlignment configures how the period windows of cached limits are aligned to the calendar, both when enforcing
+// them and in the usage reports returned by Authorize and AuthRep. Windows are aligned in UTC with weeks starting on Monday, matching apisonator, unless configured otherwise
+// It must be called before the backend is used
+func (b *Backend) SetWindowAlignment(alignment WindowAlignment) {
+	b.windowAlignment = alignment
+}
+
+// SetMetricAggregations configures how the values reported for each metric are accumulated between flushes
+// Metrics which are not present, or which are mapped to an unsupported Aggregation, use AggregateSum
+// It must be called before the backend is used
+func (b *Backend) SetMetricAggregations(aggregations map[string]Aggregation) {
+	b.aggregations = aggregations
+}
+
+// SetMaxCachedApplications limits the number of applications, including per user segments, held in the cache.
+// Once exceeded, the least recently used applications are evicted in the background. The usage recorded for an
+// evicted application is reported to 3scale before it is dropped, if the report fails the usage is lost and an error
+// is logged. Only caches which are Deletable can be limited
+// It must be called before the backend is used
+func (b *Backend) SetMaxCachedApplications(max int) {
+	if _, ok := b.cache.(Deletable); !ok || max <= 0 {
+		b.maxCachedApplications, b.lru = 0, nil
+		return
+	}
+	b.maxCachedApplications, b.lru = max, newLRUTracker()
+}
+
+// SetEvictionCallback sets a callback which is called each time an application is evicted from the cache
+// because the limit set via SetMaxCachedApplications was exceeded
+func (b *Backend) SetEvictionCallback(f func()) {
+	b.evictionCallback = f
+}
+
+// WrapClient replaces the client used to call 3scale with the result of wrap, allowing calls to be observed
+// It must be called before the backend is used
+func (b *Backend) WrapClient(wrap func(client threescale.Client) threescale.Client) {
+	b.client = wrap(b.client)
+	if b.flushClient != nil {
+		b.flushClient = wrap(b.flushClient)
+	}
+}
+
+// SetFlushClient sets the client used to report to and fetch state from 3scale when flushing, allowing flushes
+// to be configured independently, for example with a shorter timeout, from calls made on behalf of a request
+// It must be called before the backend is used
+func (b *Backend) SetFlushClient(client threescale.Client) {
+	b.flushClient = client
+}
+
 // Authorize authorizes a request based on the current cached values
 // If the request misses the cache, a remote call to 3scale is made
 // Request Transactions must not be nil and must not be empty
@@ -108,7 +245,7 @@ func (b *Backend) authorize(request threescale.Request) (*threescale.AuthorizeRe
 		return nil, err
 	}
 
-	cacheKey := generateCacheKeyFromRequest(request, 0)
+	cacheKey := b.generateCacheKey(request, 0)
 	app := b.getApplicationFromCache(cacheKey)
 
 	if app == nil {
@@ -122,10 +259,11 @@ func (b *Backend) authorize(request threescale.Request) (*threescale.AuthorizeRe
 		}
 	}
 
+	now := time.Now()
 	affectedMetrics := computeAffectedMetrics(app, request)
-	isAuthorized := b.isAuthorized(app, affectedMetrics)
+	isAuthorized := b.isAuthorized(app, affectedMetrics, now)
 
-	result := &threescale.AuthorizeResult{Authorized: isAuthorized}
+	result := &threescale.AuthorizeResult{Authorized: isAuthorized, UsageReports: app.currentUsageReports(now, b.windowAlignment)}
 	if !isAuthorized {
 		result.ErrorCode = "limits_exceeded"
 	}
@@ -150,7 +288,7 @@ func (b *Backend) authRep(request threescale.Request) (*threescale.AuthorizeResu
 		return nil, err
 	}
 
-	cacheKey := generateCacheKeyFromRequest(request, 0)
+	cacheKey := b.generateCacheKey(request, 0)
 	app := b.getApplicationFromCache(cacheKey)
 
 	if app == nil {
@@ -164,8 +302,9 @@ func (b *Backend) authRep(request threescale.Request) (*threescale.AuthorizeResu
 		}
 	}
 
+	now := time.Now()
 	affectedMetrics := computeAffectedMetrics(app, request)
-	isAuthorized := b.isAuthorized(app, affectedMetrics)
+	isAuthorized := b.isAuthorized(app, affectedMetrics, now)
 
 	result := &threescale.AuthorizeResult{Authorized: isAuthorized}
 	if isAuthorized {
@@ -174,6 +313,7 @@ func (b *Backend) authRep(request threescale.Request) (*threescale.AuthorizeResu
 	} else {
 		result.ErrorCode = "limits_exceeded"
 	}
+	result.UsageReports = app.currentUsageReports(now, b.windowAlignment)
 
 	return result, nil
 }
@@ -192,6 +332,9 @@ func (b *Backend) handleAuthorizationNetworkError(err error) (*threescale.Author
 // Sets the value in the cache and returns the newly cached value for re-use if required
 func (b *Backend) handleCacheMiss(request threescale.Request, cacheKey string) (*Application, *threescale.AuthorizeResult, error) {
 	var app Application
+	if b.cacheMissCallback != nil {
+		b.cacheMissCallback()
+	}
 
 	emptyTransaction := emptyTransactionFrom(request.Transactions[0])
 	emptyRequest := getEmptyAuthRequest(request.Service, request.Auth, emptyTransaction.Params)
@@ -205,14 +348,101 @@ func (b *Backend) handleCacheMiss(request threescale.Request, cacheKey string) (
 	}
 	app = getApplicationFromResponse(resp)
 	app.annotateWithRequestDetails(request)
+	if !b.segmentByUser {
+		// usage from multiple users is aggregated so it must not be attributed to the user who caused the miss
+		app.params.UserID = ""
+	}
 
 	b.cache.Set(cacheKey, &app)
+	b.trackCachedApplication(cacheKey)
 	return &app, resp, nil
 }
 
+// trackCachedApplication records the use of a cached application, starting an eviction in the background if the
+// number of cached applications exceeds the limit
+func (b *Backend) trackCachedApplication(key string) {
+	if b.lru == nil {
+		return
+	}
+	if b.lru.touch(key) > b.maxCachedApplications && atomic.CompareAndSwapInt32(&b.evicting, 0, 1) {
+		done := make(chan struct{})
+		b.evictionLock.Lock()
+		b.evictionDone = done
+		b.evictionLock.Unlock()
+
+		go func() {
+			defer close(done)
+			b.evictLeastRecentlyUsed()
+		}()
+	}
+}
+
+// waitForEviction blocks until the eviction in progress, if any, has reported the usage of the evicted applications
+func (b *Backend) waitForEviction() {
+	b.evictionLock.Lock()
+	done := b.evictionDone
+	b.evictionLock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// evictLeastRecentlyUsed removes the least recently used applications from the cache until the limit is respected,
+// reporting their usage to 3scale. It is serialized with flushes so that no usage is reported twice
+func (b *Backend) evictLeastRecentlyUsed() {
+	for {
+		b.evict(b.lru.popOver(b.maxCachedApplications))
+		atomic.StoreInt32(&b.evicting, 0)
+		// applications cached while evicting may have exceeded the limit again
+		if b.lru.len() <= b.maxCachedApplications || !atomic.CompareAndSwapInt32(&b.evicting, 0, 1) {
+			return
+		}
+	}
+}
+
+func (b *Backend) evict(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	deletable := b.cache.(Deletable)
+
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	grouped := make(map[api.Service][]*Application)
+	for _, key := range keys {
+		app, ok := b.cache.Get(key)
+		if !ok {
+			continue
+		}
+		svc, appID, err := parseCacheKey(key)
+		if err != nil {
+			b.logger.Errorf("unable to evict cached application %s - %s", key, err.Error())
+			continue
+		}
+
+		app.Lock()
+		app.evicted = true
+		deletable.Delete(key)
+		clone := app.deepCopy()
+		app.Unlock()
+
+		clone.ownedBy = svc
+		clone.id = appID
+		grouped[svc] = append(grouped[svc], &clone)
+		if b.evictionCallback != nil {
+			b.evictionCallback()
+		}
+	}
+
+	for svc, apps := range grouped {
+		b.reportGroupedApps(svc, apps)
+	}
+}
+
 // isAuthorized takes a read lock on the application and confirms if the request
-// should be authorized based on the affected metrics against current state
-func (b *Backend) isAuthorized(application *Application, affectedMetrics api.Metrics) bool {
+// should be authorized based on the affected metrics against current state as of now
+func (b *Backend) isAuthorized(application *Application, affectedMetrics api.Metrics, now time.Time) bool {
 	application.RLock()
 	defer application.RUnlock()
 
@@ -225,8 +455,8 @@ out:
 			continue
 		}
 
-		for _, granularity := range cachedValue {
-			if granularity.CurrentValue+incrementBy > granularity.MaxValue {
+		for i, granularity := range cachedValue {
+			if application.currentValue(metric, i, now, b.windowAlignment)+incrementBy > granularity.MaxValue {
 				authorized = false
 				break out
 			}
@@ -259,7 +489,7 @@ func (b *Backend) report(request threescale.Request) (*threescale.ReportResult,
 		for index, transaction := range request.Transactions {
 			// we support reporting in batches so for every transaction, grab the cache key and see if we
 			// have a match. if not, we can report locally regardless once we know the hierarchy
-			cacheKey := generateCacheKeyFromRequest(request, index)
+			cacheKey := b.generateCacheKey(request, index)
 
 			app := b.getApplicationFromCache(cacheKey)
 			if app == nil {
@@ -297,6 +527,9 @@ func (b *Backend) getApplicationFromCache(key string) *Application {
 		if b.cacheHitCallback != nil {
 			b.cacheHitCallback()
 		}
+		if b.lru != nil {
+			b.lru.touch(key)
+		}
 	}
 	return app
 }
@@ -307,7 +540,15 @@ func (b *Backend) remoteAuth(request threescale.Request) (*threescale.AuthorizeR
 }
 
 func (b *Backend) remoteReport(request threescale.Request) (*threescale.ReportResult, error) {
-	return b.client.Report(request)
+	return b.flushingClient().Report(request)
+}
+
+// flushingClient returns the client which should be used for calls made when flushing
+func (b *Backend) flushingClient() threescale.Client {
+	if b.flushClient != nil {
+		return b.flushClient
+	}
+	return b.client
 }
 
 // localReport takes a write lock on the application and reports to the cache
@@ -323,23 +564,98 @@ func (b *Backend) localReport(cacheKey string, metrics api.Metrics) {
 
 	application.Lock()
 	defer application.Unlock()
+	if application.evicted {
+		// the application was evicted after being read from the cache, its usage has already been reported
+		return
+	}
 
 	for metric, incrementBy := range metrics {
 		cachedValue, ok := application.LocalState[metric]
+		aggregation := b.aggregations[metric]
 
 		if ok {
 			for index := range cachedValue {
-				updateCountersCurrentValue(&cachedValue[index], incrementBy)
+				application.aggregateCounter(metric, &cachedValue[index], aggregation, incrementBy)
 			}
 		} else {
-			application.updateUnlimitedCounter(metric, incrementBy)
+			application.aggregateUnlimitedCounter(metric, aggregation, incrementBy)
 		}
 	}
 	b.cache.Set(cacheKey, application)
+	atomic.AddInt64(&b.pendingTransactions, 1)
+}
+
+// PendingTransactions returns the number of transactions which have been reported to the cache since the
+// last flush began and which are therefore yet to be reported to 3scale
+func (b *Backend) PendingTransactions() int64 {
+	return atomic.LoadInt64(&b.pendingTransactions)
+}
+
+// Overflowed returns true if the last flush could not enqueue every cached application because the queue was full
+// The usage of such applications remains in the cache and is not reported by that flush
+func (b *Backend) Overflowed() bool {
+	return atomic.LoadInt32(&b.overflowed) == 1
+}
+
+// UnreportedTransactions returns, for each service, the usage recorded in the cache which has not been reported
+// to 3scale, as a transaction per cached application. Following a successful flush, no usage is returned
+func (b *Backend) UnreportedTransactions() map[api.Service][]api.Transaction {
+	unreported := make(map[api.Service][]api.Transaction)
+	for _, key := range b.cache.Keys() {
+		svc, _, err := parseCacheKey(key)
+		if err != nil {
+			continue
+		}
+		app, ok := b.cache.Get(key)
+		if !ok {
+			continue
+		}
+
+		app.RLock()
+		deltas := app.calculateDeltas()
+		params := app.params
+		app.RUnlock()
+
+		metrics := make(api.Metrics)
+		for metric, value := range deltas {
+			if value > 0 {
+				metrics[metric] = value
+			}
+		}
+		if len(metrics) > 0 {
+			unreported[svc] = append(unreported[svc], api.Transaction{Metrics: metrics, Params: params})
+		}
+	}
+	return unreported
 }
 
 // Flush the cached entries and report existing state to backend
+// Flushes are serialized, so if a flush is already in progress, Flush blocks until it has completed
+// A flush reports a snapshot of each application, while requests continue to be recorded to the live counters.
+// Only once 3scale has accepted the report is the reported usage deducted from the live counters, such that usage
+// is never cleared before it has been confirmed and usage recorded during the flush is kept for the next flush
+// Flush also waits for any eviction in progress, such that once it returns the usage of evicted applications has been reported
 func (b *Backend) Flush() {
+	atomic.AddInt32(&b.pendingFlushes, 1)
+	defer atomic.AddInt32(&b.pendingFlushes, -1)
+	b.waitForEviction()
+	b.serializedFlush()
+}
+
+// TryFlush flushes the cached entries if no other flush is running or waiting to run
+// Returns false, without flushing, if a flush was already in progress
+func (b *Backend) TryFlush() bool {
+	if !atomic.CompareAndSwapInt32(&b.pendingFlushes, 0, 1) {
+		return false
+	}
+	defer atomic.AddInt32(&b.pendingFlushes, -1)
+	b.serializedFlush()
+	return true
+}
+
+func (b *Backend) serializedFlush() {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
 	b.flush()
 }
 
@@ -357,9 +673,26 @@ type handledApp struct {
 	deltas api.Metrics
 }
 
+// RefreshService reports the pending usage of each cached application of the service and refreshes their
+// cached state, including limits, from 3scale. It should be called when the limits of the service may have
+// changed, such that they are enforced locally without waiting for the next flush. It is serialized with flushes
+func (b *Backend) RefreshService(service string) {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	b.enqueueCachedApplications(func(owner api.Service) bool {
+		return owner == api.Service(service)
+	})
+	handledApps := b.handleFlushReporting()
+	handledApps = b.handleFlushAuthorization(handledApps)
+	b.handleFlushCacheUpdate(handledApps)
+}
+
 func (b *Backend) flush() {
+	// transactions reported from here on are not part of this flush
+	atomic.StoreInt64(&b.pendingTransactions, 0)
 	// read the cache and write the items to the queue
-	b.enqueueCachedApplications()
+	b.enqueueCachedApplications(func(api.Service) bool { return true })
 
 	// report the metrics for all known applications
 	handledApps := b.handleFlushReporting()
@@ -373,21 +706,32 @@ func (b *Backend) flush() {
 }
 
 // enqueueCachedApplications takes a snapshot of each application currently stored in the cache
-// and writes it to the back of the queue
-func (b *Backend) enqueueCachedApplications() {
+// which is owned by a matching service and writes it to the back of the queue
+func (b *Backend) enqueueCachedApplications(matches func(service api.Service) bool) {
 	keys := b.cache.Keys()
+	var overflowed int32
 
 	for _, key := range keys {
+		svc, appID, err := parseCacheKey(key)
+		if err != nil {
+			b.logger.Errorf("unable to flush cached application %s - %s", key, err.Error())
+			continue
+		}
+		if !matches(svc) {
+			continue
+		}
 		if app, ok := b.cache.Get(key); ok {
 			app.RLock()
 			clone := app.deepCopy()
 			app.RUnlock()
-			svc, appID, _ := parseCacheKey(key)
 			clone.ownedBy = svc
 			clone.id = appID
-			b.queue.append(&clone)
+			if !b.queue.append(&clone) {
+				overflowed = 1
+			}
 		}
 	}
+	atomic.StoreInt32(&b.overflowed, overflowed)
 }
 
 // handleFlushReporting removes items from the deque and sorts them under relevant services
@@ -470,7 +814,7 @@ func (b *Backend) reportGroupedApps(service api.Service, apps []*Application) []
 func (b *Backend) handleFlushAuthorization(apps []*handledApp) []*handledApp {
 	for _, app := range apps {
 		req := getEmptyAuthRequest(app.snapshot.ownedBy, app.snapshot.auth, app.snapshot.params)
-		resp, err := b.remoteAuth(req)
+		resp, err := b.flushingClient().Authorize(req)
 		if err != nil {
 			b.logger.Errorf(
 				"failed to fetch state for service %s and backend %s",
@@ -522,7 +866,7 @@ func (b *Backend) handleFlushCacheUpdate(apps []*handledApp) {
 			// representation of the remote state with the deltas we know that 3scale has processed.
 			cachedApp.addDeltasToRemoteState(app.deltas)
 			// we need to account for activity in between while adjusting our unlimited counter
-			cachedApp.pruneUnlimitedCounter(app.snapshot)
+			cachedApp.pruneUnlimitedCounter(app.snapshot, b.aggregations)
 			b.cache.Set(cacheKey, cachedApp)
 			cachedApp.Unlock()
 			continue
@@ -532,12 +876,26 @@ func (b *Backend) handleFlushCacheUpdate(apps []*handledApp) {
 		updatedApp := getApplicationFromResponse(app.authResp)
 
 		cachedApp.Lock()
-		cachedApp.adjustLocalState(app, updatedApp.RemoteState, updatedApp.timestamp)
+		cachedApp.adjustLocalState(app, updatedApp.RemoteState, updatedApp.timestamp, b.aggregations, b.windowAlignment)
+		if updatedApp.metricHierarchy != nil {
+			// keep parent metrics in sync with any changes to the hierarchy made in 3scale since it was cached
+			cachedApp.metricHierarchy = updatedApp.metricHierarchy
+		}
 		b.cache.Set(cacheKey, cachedApp)
 		cachedApp.Unlock()
 	}
 }
 
+// generateCacheKey returns the cache key for the transaction at the given index in the request
+// If segmenting by user, the user id is included in the key
+func (b *Backend) generateCacheKey(request threescale.Request, transactionIndex int) string {
+	key := generateCacheKeyFromRequest(request, transactionIndex)
+	if userID := request.Transactions[transactionIndex].Params.UserID; b.segmentByUser && userID != "" {
+		key = fmt.Sprintf("%s%s%s", key, userSegmentSeparator, userID)
+	}
+	return key
+}
+
 // GetPeer returns the hostname of the connected backend
 func (b *Backend) GetPeer() string {
 	return b.client.GetPeer()
@@ -598,6 +956,48 @@ func (a *Application) addDeltasToRemoteState(deltas api.Metrics) *Application {
 	return a
 }
 
+// currentUsageReports returns a copy of the local counters of the application, taking a read lock, with the window
+// of each limit set to the window of its period which contains now, as aligned by alignment, such that the reset time of each limit is known
+// Limits for eternity are omitted since they never reset
+func (a *Application) currentUsageReports(now time.Time, alignment WindowAlignment) api.UsageReports {
+	a.RLock()
+	defer a.RUnlock()
+
+	var reports api.UsageReports
+	for metric, counters := range a.LocalState {
+		for i, counter := range counters {
+			window, ok := periodWindowAt(counter.PeriodWindow.Period, now, alignment)
+			if !ok {
+				continue
+			}
+			if reports == nil {
+				reports = make(api.UsageReports)
+			}
+			counter.CurrentValue = a.currentValue(metric, i, now, alignment)
+			counter.PeriodWindow = window
+			reports[metric] = append(reports[metric], counter)
+		}
+	}
+	return reports
+}
+
+// currentValue returns the value of the local counter at index i of the metric as of now. Once the aligned window of
+// the last known remote state for the counter has ended, the usage known to 3scale no longer counts towards the limit,
+// so only the usage recorded locally since it was fetched is returned, until the next flush fetches the new window
+// The caller must hold a lock on the application
+func (a *Application) currentValue(metric string, i int, now time.Time, alignment WindowAlignment) int {
+	counter := a.LocalState[metric][i]
+	if !a.statesAreComparable(metric, i, a.LocalState, a.RemoteState) {
+		return counter.CurrentValue
+	}
+
+	remote := a.RemoteState[metric][i]
+	if remote.PeriodWindow.Start == 0 || !hasPeriodElapsed(remote.PeriodWindow.Period, remote.PeriodWindow.Start, now.Unix(), alignment) {
+		return counter.CurrentValue
+	}
+	return counter.CurrentValue - remote.CurrentValue
+}
+
 // deepCopy creates a clone of the Application 'a'
 func (a *Application) deepCopy() Application {
 	unlimitedHitsClone := make(map[string]int, len(a.UnlimitedCounter))
@@ -615,40 +1015,58 @@ func (a *Application) deepCopy() Application {
 	}
 }
 
-// updateUnlimitedCounter modifies the Applications 'UnlimitedCounter' field
-func (a *Application) updateUnlimitedCounter(metric string, incrementBy int) {
-	// has no limits so just cache the value for reporting purposes
-	current, ok := a.UnlimitedCounter[metric]
-	if !ok {
-		a.UnlimitedCounter[metric] = 0
+// aggregateCounter applies the value to a rate limited counter using the provided aggregation
+// The aggregation applies to the usage which is pending since the last known remote state for the same period
+func (a *Application) aggregateCounter(metric string, counter *api.UsageReport, aggregation Aggregation, value int) {
+	var remoteValue int
+	for _, remote := range a.RemoteState[metric] {
+		if remote.PeriodWindow.Period == counter.PeriodWindow.Period {
+			remoteValue = remote.CurrentValue
+			break
+		}
 	}
 
-	a.UnlimitedCounter[metric] = current + incrementBy
+	pending := aggregate(aggregation, counter.CurrentValue-remoteValue, value)
+	counter.CurrentValue = remoteValue + pending
+}
+
+// aggregateUnlimitedCounter modifies the Applications 'UnlimitedCounter' field using the provided aggregation
+func (a *Application) aggregateUnlimitedCounter(metric string, aggregation Aggregation, value int) {
+	// has no limits so just cache the value for reporting purposes
+	a.UnlimitedCounter[metric] = aggregate(aggregation, a.UnlimitedCounter[metric], value)
 }
 
 // pruneUnlimitedCounter resets a metrics counter to the difference between the provided old value and the current value
 // If the end result is not at least 1, the metric is pruned from the counter
-func (a *Application) pruneUnlimitedCounter(snapshot Application) {
+// Metrics which are not summed are pruned only if their value has not changed since the snapshot was reported
+func (a *Application) pruneUnlimitedCounter(snapshot Application, aggregations map[string]Aggregation) {
 	for metric, value := range a.UnlimitedCounter {
-		oldValue, ok := snapshot.UnlimitedCounter[metric]
-		if !ok {
-			delete(a.UnlimitedCounter, metric)
+		reported := snapshot.UnlimitedCounter[metric]
+		switch aggregations[metric] {
+		case AggregateMax, AggregateLast:
+			if value == reported {
+				delete(a.UnlimitedCounter, metric)
+			}
+			continue
 		}
 
-		value -= oldValue
+		// only the value in the snapshot has been reported, anything recorded since must be kept for the next flush
+		value -= reported
 		if value < 1 {
 			delete(a.UnlimitedCounter, metric)
+			continue
 		}
+		a.UnlimitedCounter[metric] = value
 	}
 }
 
 // adjustLocalState assumes that we have a new remote state (set on a) fetched from 3scale and modifies local state based
 // on the state obtained during cache flushing
-func (a *Application) adjustLocalState(flushingState *handledApp, remoteState LimitCounter, remoteTimestamp int64) *Application {
+func (a *Application) adjustLocalState(flushingState *handledApp, remoteState LimitCounter, remoteTimestamp int64, aggregations map[string]Aggregation, alignment WindowAlignment) *Application {
 	a.RemoteState = remoteState
 
 	// get a map of periods that have elapsed, computed using our two timestamps
-	elapsedPeriods := a.LocalState.getElapsedPeriods(a.timestamp, remoteTimestamp)
+	elapsedPeriods := a.LocalState.getElapsedPeriods(a.timestamp, remoteTimestamp, alignment)
 	// find any metrics and hence associated limits that have been deleted from the updated view of the state
 	added, removed := computeAddedAndRemovedMetrics(a.LocalState, a.RemoteState)
 
@@ -672,7 +1090,7 @@ func (a *Application) adjustLocalState(flushingState *handledApp, remoteState Li
 
 	if !flushingState.reportingErr {
 		// reset the counter if we have reported already
-		a.pruneUnlimitedCounter(flushingState.snapshot)
+		a.pruneUnlimitedCounter(flushingState.snapshot, aggregations)
 	}
 
 	for metric, counters := range a.LocalState {
@@ -718,20 +1136,27 @@ func (a *Application) adjustLocalState(flushingState *handledApp, remoteState Li
 			continue
 		}
 
-		// if this was not a new limit we need to see if the period has elapsed
-		if elapsed := elapsedPeriods[lowestLocalGranularity.PeriodWindow.Period]; elapsed {
-			// we add the remote current value if the period has elapsed
-			lowestLocalGranularity.CurrentValue += lowestRemoteGranularity.CurrentValue
-			lowestLocalGranularity.MaxValue = lowestRemoteGranularity.MaxValue
-			continue
-		}
-
 		var reportedHits int
 		delta := flushingState.deltas[metric]
 		if !flushingState.reportingErr {
 			reportedHits = delta
 		}
 
+		// the remote state of the higher granularities is only adopted once their period has elapsed, at which point
+		// the usage since the snapshot, and any which failed to be reported, carries over to their new window
+		for i := 1; i < len(counters); i++ {
+			period := counters[i].PeriodWindow.Period
+			if !elapsedPeriods[period] || !a.statesAreComparable(metric, i, a.LocalState, a.RemoteState) {
+				continue
+			}
+			snapped, ok := flushingState.snapshot.LocalState.counterFor(metric, period)
+			if !ok {
+				continue
+			}
+			a.LocalState[metric][i].CurrentValue = a.RemoteState[metric][i].CurrentValue +
+				counters[i].CurrentValue - snapped.CurrentValue + delta - reportedHits
+		}
+
 		updated := lowestLocalGranularity.CurrentValue + lowestRemoteGranularity.CurrentValue -
 			(lowestSnappedGranularity.CurrentValue - delta) - reportedHits
 
@@ -790,34 +1215,49 @@ func (lc LimitCounter) deepCopy() LimitCounter {
 	return clone
 }
 
-func (lc LimitCounter) getElapsedPeriods(startOfPeriod, endOfPeriod int64) map[api.Period]bool {
+// getElapsedPeriods returns the periods of the counters whose aligned window containing startOfPeriod has ended by endOfPeriod
+func (lc LimitCounter) getElapsedPeriods(startOfPeriod, endOfPeriod int64, alignment WindowAlignment) map[api.Period]bool {
 	var elapsedPeriods = make(map[api.Period]bool)
-	clone := lc.deepCopy()
-	// sort the clone so we can pull out the largest granularity first
-	api.UsageReports(clone).OrderByDescendingGranularity()
 	for _, reports := range lc {
-		if len(reports) < 1 {
-			continue
-		}
-		largestGranularity := reports[0].PeriodWindow.Period
-		hasElapsed := hasSurpassedDeadline(startOfPeriod, largestGranularity, endOfPeriod)
-		if !hasElapsed {
-			continue
-		}
-		for i := largestGranularity; i > 0; i-- {
-			if elapsedPeriods[i] == true {
-				break
+		for _, report := range reports {
+			period := report.PeriodWindow.Period
+			if _, known := elapsedPeriods[period]; !known {
+				elapsedPeriods[period] = hasPeriodElapsed(period, startOfPeriod, endOfPeriod, alignment)
 			}
-			elapsedPeriods[i] = true
 		}
 	}
 	return elapsedPeriods
 }
 
+// counterFor returns the counter of the metric for the given period, if any
+func (lc LimitCounter) counterFor(metric string, period api.Period) (api.UsageReport, bool) {
+	for _, counter := range lc[metric] {
+		if counter.PeriodWindow.Period == period {
+			return counter, true
+		}
+	}
+	return api.UsageReport{}, false
+}
+
 func updateCountersCurrentValue(counter *api.UsageReport, incrementBy int) {
 	counter.CurrentValue += incrementBy
 }
 
+// aggregate combines the pending value with a newly reported value
+func aggregate(aggregation Aggregation, pending, value int) int {
+	switch aggregation {
+	case AggregateMax:
+		if value > pending {
+			return value
+		}
+		return pending
+	case AggregateLast:
+		return value
+	default:
+		return pending + value
+	}
+}
+
 // FailOpenPolicy authorizes requests when the upstream 3scale is unavailable
 func FailOpenPolicy() bool {
 	return true
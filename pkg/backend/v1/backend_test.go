@@ -8,7 +8,11 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -432,7 +436,7 @@ func TestBackend_Authorize(t *testing.T) {
 			}
 			equals(t, resp.Authorized, input.expectResult.Authorized)
 			equals(t, resp.Hierarchy, api.Hierarchy(nil))
-			equals(t, resp.UsageReports, api.UsageReports(nil))
+			assertCurrentWindows(t, resp.UsageReports)
 			equals(t, resp.RateLimits, (*api.RateLimits)(nil))
 		})
 	}
@@ -959,7 +963,7 @@ func TestBackend_AuthRep(t *testing.T) {
 
 			equals(t, resp.Authorized, input.expectResult.Authorized)
 			equals(t, resp.Hierarchy, api.Hierarchy(nil))
-			equals(t, resp.UsageReports, api.UsageReports(nil))
+			assertCurrentWindows(t, resp.UsageReports)
 			equals(t, resp.RateLimits, (*api.RateLimits)(nil))
 
 			cachedVal, _ := b.cache.Get(cacheKey)
@@ -1634,6 +1638,674 @@ func TestBackend_Flush(t *testing.T) {
 	}
 }
 
+func TestBackend_TryFlush(t *testing.T) {
+	reportStarted := make(chan struct{}, 1)
+	releaseReport := make(chan struct{})
+	cache := NewLocalCache()
+
+	app := newApplication()
+	app.UnlimitedCounter["hits"] = 1
+	cache.Set("testService_testApplication", app)
+
+	b := &Backend{
+		client: &mockRemoteClient{
+			authRes: &threescale.AuthorizeResult{Authorized: true},
+			reportCallback: func(request threescale.Request) {
+				select {
+				case reportStarted <- struct{}{}:
+					<-releaseReport
+				default:
+				}
+			},
+		},
+		cache:  cache,
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+
+	go b.Flush()
+	<-reportStarted
+
+	if b.TryFlush() {
+		t.Errorf("expected flush to be skipped while another is in progress")
+	}
+	close(releaseReport)
+
+	// wait for the in progress flush to complete
+	b.Flush()
+	if !b.TryFlush() {
+		t.Errorf("expected flush to run when no other flush is in progress")
+	}
+}
+
+func TestBackend_FlushPreservesUnconfirmedUsage(t *testing.T) {
+	request := threescale.Request{
+		Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+		Service: "testService",
+		Transactions: []api.Transaction{
+			{
+				Metrics: api.Metrics{"hits": 1, "orphan": 1},
+				Params:  api.Params{AppID: "testApplication"},
+			},
+		},
+	}
+
+	authRes := &threescale.AuthorizeResult{
+		Authorized: true,
+		UsageReports: api.UsageReports{
+			"hits": []api.UsageReport{
+				{
+					PeriodWindow: api.PeriodWindow{Period: api.Minute},
+					MaxValue:     100,
+				},
+			},
+		},
+	}
+	var b *Backend
+	var attempted []api.Metrics
+	confirmed := make(api.Metrics)
+	recordDuringReport := false
+	remote := &mockRemoteClient{authRes: authRes}
+	remote.reportCallback = func(report threescale.Request) {
+		metrics := report.Transactions[0].Metrics
+		attempted = append(attempted, metrics)
+		if remote.reportErr != nil {
+			return
+		}
+		for metric, value := range metrics {
+			confirmed[metric] += value
+		}
+		// apisonator now accounts for the reported usage
+		authRes.UsageReports["hits"][0].CurrentValue = confirmed["hits"]
+
+		if recordDuringReport {
+			recordDuringReport = false
+			if _, err := b.AuthRep(request); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		}
+	}
+	b = &Backend{
+		client: remote,
+		cache:  NewLocalCache(),
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.AuthRep(request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	// a failed report must preserve the counters
+	remote.reportErr = errors.New("arbitrary error")
+	b.Flush()
+	unreported := b.UnreportedTransactions()["testService"]
+	if len(unreported) != 1 {
+		t.Fatalf("expected usage to be preserved, got %v", unreported)
+	}
+	equals(t, api.Metrics{"hits": 2, "orphan": 2}, unreported[0].Metrics)
+
+	// the preserved usage is reported by the next flush, while usage recorded during that flush is kept
+	remote.reportErr = nil
+	recordDuringReport = true
+	b.Flush()
+	unreported = b.UnreportedTransactions()["testService"]
+	if len(unreported) != 1 {
+		t.Fatalf("expected usage recorded during the flush to be kept, got %v", unreported)
+	}
+	equals(t, api.Metrics{"hits": 1, "orphan": 1}, unreported[0].Metrics)
+
+	b.Flush()
+	if unreported := b.UnreportedTransactions(); len(unreported) != 0 {
+		t.Errorf("expected no unreported usage, got %v", unreported)
+	}
+	equals(t, api.Metrics{"hits": 3, "orphan": 3}, confirmed)
+	equals(t, []api.Metrics{
+		{"hits": 2, "orphan": 2},
+		{"hits": 2, "orphan": 2},
+		{"hits": 1, "orphan": 1},
+	}, attempted)
+}
+
+func TestBackend_WindowAlignmentEnforcement(t *testing.T) {
+	india := WindowAlignment{Location: time.FixedZone("IST", 5*60*60+30*60)}
+	// the day window as last fetched from 3scale, which in India ends at 18:30 UTC
+	day := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	beforeBoundary := time.Date(2020, time.January, 1, 18, 29, 59, 0, time.UTC)
+	atBoundary := time.Date(2020, time.January, 1, 18, 30, 0, 0, time.UTC)
+
+	inputs := []struct {
+		name        string
+		alignment   WindowAlignment
+		localValue  int
+		maxValue    int
+		now         time.Time
+		expectAuth  bool
+		expectValue int
+	}{
+		{
+			name:        "Test limit is enforced before the aligned boundary",
+			alignment:   india,
+			localValue:  10,
+			maxValue:    10,
+			now:         beforeBoundary,
+			expectValue: 10,
+		},
+		{
+			name:        "Test limit resets at the aligned boundary",
+			alignment:   india,
+			localValue:  10,
+			maxValue:    10,
+			now:         atBoundary,
+			expectAuth:  true,
+			expectValue: 0,
+		},
+		{
+			name:        "Test usage recorded since the state was fetched counts towards the new window",
+			alignment:   india,
+			localValue:  12,
+			maxValue:    2,
+			now:         atBoundary,
+			expectValue: 2,
+		},
+		{
+			name:        "Test limit is enforced until the boundary in UTC by default",
+			localValue:  10,
+			maxValue:    10,
+			now:         atBoundary,
+			expectValue: 10,
+		},
+		{
+			name:        "Test limit resets at the boundary in UTC by default",
+			localValue:  10,
+			maxValue:    10,
+			now:         day.AddDate(0, 0, 1),
+			expectAuth:  true,
+			expectValue: 0,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			window := api.PeriodWindow{Period: api.Day, Start: day.Unix(), End: day.AddDate(0, 0, 1).Unix()}
+			app := &Application{
+				RemoteState: LimitCounter{"hits": []api.UsageReport{
+					{PeriodWindow: window, MaxValue: input.maxValue, CurrentValue: 10},
+				}},
+				LocalState: LimitCounter{"hits": []api.UsageReport{
+					{PeriodWindow: window, MaxValue: input.maxValue, CurrentValue: input.localValue},
+				}},
+			}
+			b := &Backend{windowAlignment: input.alignment}
+
+			if authorized := b.isAuthorized(app, api.Metrics{"hits": 1}, input.now); authorized != input.expectAuth {
+				t.Errorf("expected authorized to be %t at %s", input.expectAuth, input.now)
+			}
+			reports := app.currentUsageReports(input.now, input.alignment)
+			if value := reports["hits"][0].CurrentValue; value != input.expectValue {
+				t.Errorf("expected current value %d but got %d", input.expectValue, value)
+			}
+		})
+	}
+}
+
+func TestBackend_SegmentByUser(t *testing.T) {
+	requestFor := func(userID string) threescale.Request {
+		return threescale.Request{
+			Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+			Service: "testService",
+			Transactions: []api.Transaction{
+				{
+					Metrics: api.Metrics{"hits": 1},
+					Params:  api.Params{AppID: "testApplication", UserID: userID},
+				},
+			},
+		}
+	}
+
+	inputs := []struct {
+		name          string
+		segment       bool
+		users         []string
+		expectAuth    []bool
+		expectKeys    int
+		expectUserIDs []string
+	}{
+		{
+			name:          "Test counters are shared between users when not segmenting",
+			expectAuth:    []bool{true, false, false},
+			expectKeys:    1,
+			expectUserIDs: []string{""},
+		},
+		{
+			name:          "Test counters are segmented per user",
+			segment:       true,
+			expectAuth:    []bool{true, true, false},
+			expectKeys:    2,
+			expectUserIDs: []string{"one", "two"},
+		},
+		{
+			name:          "Test user ids containing underscores are segmented and flushed",
+			segment:       true,
+			users:         []string{"user_one", "user_two", "user_one"},
+			expectAuth:    []bool{true, true, false},
+			expectKeys:    2,
+			expectUserIDs: []string{"user_one", "user_two"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var reportedUserIDs []string
+			cache := NewLocalCache()
+			b := &Backend{
+				client: &mockRemoteClient{
+					authRes: &threescale.AuthorizeResult{
+						Authorized: true,
+						UsageReports: api.UsageReports{
+							"hits": []api.UsageReport{
+								{
+									PeriodWindow: api.PeriodWindow{Period: api.Minute},
+									MaxValue:     1,
+								},
+							},
+						},
+					},
+					reportCallback: func(request threescale.Request) {
+						for _, transaction := range request.Transactions {
+							reportedUserIDs = append(reportedUserIDs, transaction.Params.UserID)
+						}
+					},
+				},
+				cache:  cache,
+				queue:  newQueue(10),
+				logger: &core.NoOpLogger{},
+			}
+			b.SetSegmentByUser(input.segment)
+
+			users := input.users
+			if users == nil {
+				users = []string{"one", "two", "one"}
+			}
+			for index, userID := range users {
+				res, err := b.AuthRep(requestFor(userID))
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if res.Authorized != input.expectAuth[index] {
+					t.Errorf("unexpected auth result for request %d from user %s", index, userID)
+				}
+			}
+
+			if len(cache.Keys()) != input.expectKeys {
+				t.Errorf("unexpected number of cache entries %v", cache.Keys())
+			}
+
+			b.Flush()
+			sort.Strings(reportedUserIDs)
+			equals(t, input.expectUserIDs, reportedUserIDs)
+		})
+	}
+}
+
+func TestBackend_MetricAggregations(t *testing.T) {
+	inputs := []struct {
+		name        string
+		aggregation Aggregation
+		expect      int
+	}{
+		{
+			name:   "Test values are summed by default",
+			expect: 12,
+		},
+		{
+			name:        "Test values are summed",
+			aggregation: AggregateSum,
+			expect:      12,
+		},
+		{
+			name:        "Test largest value is retained",
+			aggregation: AggregateMax,
+			expect:      7,
+		},
+		{
+			name:        "Test last value is retained",
+			aggregation: AggregateLast,
+			expect:      2,
+		},
+		{
+			name:        "Test unsupported aggregation is summed",
+			aggregation: "unknown",
+			expect:      12,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var reported []api.Metrics
+			b := &Backend{
+				client: &mockRemoteClient{
+					authRes: &threescale.AuthorizeResult{
+						Authorized: true,
+						UsageReports: api.UsageReports{
+							"limited": []api.UsageReport{
+								{
+									PeriodWindow: api.PeriodWindow{Period: api.Minute},
+									MaxValue:     100,
+									CurrentValue: 10,
+								},
+								{
+									PeriodWindow: api.PeriodWindow{Period: api.Hour},
+									MaxValue:     1000,
+									CurrentValue: 50,
+								},
+							},
+						},
+					},
+					reportCallback: func(request threescale.Request) {
+						for _, transaction := range request.Transactions {
+							reported = append(reported, transaction.Metrics)
+						}
+					},
+				},
+				cache:  NewLocalCache(),
+				queue:  newQueue(10),
+				logger: &core.NoOpLogger{},
+			}
+			if input.aggregation != "" {
+				b.SetMetricAggregations(map[string]Aggregation{
+					"limited":   input.aggregation,
+					"unlimited": input.aggregation,
+				})
+			}
+
+			for _, value := range []int{3, 7, 2} {
+				res, err := b.AuthRep(threescale.Request{
+					Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+					Service: "testService",
+					Transactions: []api.Transaction{
+						{
+							Metrics: api.Metrics{"limited": value, "unlimited": value},
+							Params:  api.Params{AppID: "testApplication"},
+						},
+					},
+				})
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if !res.Authorized {
+					t.Fatalf("expected request reporting %d to be authorized", value)
+				}
+			}
+
+			b.Flush()
+			equals(t, []api.Metrics{{"limited": input.expect, "unlimited": input.expect}}, reported)
+		})
+	}
+}
+
+func TestBackend_HierarchyFromResponse(t *testing.T) {
+	responseWith := func(hierarchy api.Hierarchy) *threescale.AuthorizeResult {
+		return &threescale.AuthorizeResult{
+			Authorized: true,
+			UsageReports: api.UsageReports{
+				"hits": []api.UsageReport{
+					{
+						PeriodWindow: api.PeriodWindow{Period: api.Minute},
+						MaxValue:     100,
+					},
+				},
+			},
+			AuthorizeExtensions: threescale.AuthorizeExtensions{Hierarchy: hierarchy},
+		}
+	}
+
+	request := threescale.Request{
+		Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+		Service: "testService",
+		Transactions: []api.Transaction{
+			{
+				Metrics: api.Metrics{"child": 1},
+				Params:  api.Params{AppID: "testApplication"},
+			},
+		},
+	}
+
+	parentValue := func(b *Backend) int {
+		t.Helper()
+		app, ok := b.cache.Get(generateCacheKeyFromRequest(request, 0))
+		if !ok {
+			t.Fatalf("expected application to be cached")
+		}
+		return app.LocalState["hits"][0].CurrentValue
+	}
+
+	remote := &mockRemoteClient{authRes: responseWith(nil)}
+	b := &Backend{
+		client: remote,
+		cache:  NewLocalCache(),
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+
+	if _, err := b.AuthRep(request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if value := parentValue(b); value != 0 {
+		t.Errorf("expected parent counter to be unaffected without a hierarchy, got %d", value)
+	}
+
+	// the child is added to the parent in 3scale and the hierarchy is returned by the next auth during flush
+	remote.authRes = responseWith(api.Hierarchy{"hits": []string{"child"}})
+	b.Flush()
+
+	if _, err := b.AuthRep(request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if value := parentValue(b); value != 1 {
+		t.Errorf("expected parent counter to be updated using the hierarchy from 3scale, got %d", value)
+	}
+}
+
+func TestBackend_UnreportedTransactions(t *testing.T) {
+	remote := &mockRemoteClient{
+		authRes: &threescale.AuthorizeResult{
+			Authorized: true,
+			UsageReports: api.UsageReports{
+				"hits": []api.UsageReport{
+					{
+						PeriodWindow: api.PeriodWindow{Period: api.Minute},
+						MaxValue:     100,
+					},
+				},
+			},
+		},
+		reportErr: fmt.Errorf("arbitrary error"),
+	}
+	b := &Backend{
+		client: remote,
+		cache:  NewLocalCache(),
+		queue:  newQueue(1),
+		logger: &core.NoOpLogger{},
+	}
+
+	for _, appID := range []string{"first", "second"} {
+		_, err := b.AuthRep(threescale.Request{
+			Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+			Service: "testService",
+			Transactions: []api.Transaction{
+				{
+					Metrics: api.Metrics{"hits": 1},
+					Params:  api.Params{AppID: appID},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	b.Flush()
+	if !b.Overflowed() {
+		t.Errorf("expected flush to overflow the queue")
+	}
+	unreported := b.UnreportedTransactions()
+	if len(unreported["testService"]) != 2 {
+		t.Fatalf("expected usage of both applications to be unreported, got %v", unreported)
+	}
+	for _, transaction := range unreported["testService"] {
+		equals(t, api.Metrics{"hits": 1}, transaction.Metrics)
+	}
+
+	remote.reportErr = nil
+	b.queue = newQueue(10)
+	b.Flush()
+	if b.Overflowed() {
+		t.Errorf("unexpected overflow")
+	}
+	if unreported := b.UnreportedTransactions(); len(unreported) != 0 {
+		t.Errorf("expected no unreported usage after a successful flush, got %v", unreported)
+	}
+}
+
+func TestBackend_MaxCachedApplications(t *testing.T) {
+	var lock sync.Mutex
+	reported := make(map[string]int)
+	evictionReported := make(chan struct{}, 1)
+	remote := &mockRemoteClient{
+		authRes: &threescale.AuthorizeResult{
+			Authorized: true,
+			UsageReports: api.UsageReports{
+				"hits": []api.UsageReport{
+					{
+						PeriodWindow: api.PeriodWindow{Period: api.Minute},
+						MaxValue:     100,
+					},
+				},
+			},
+		},
+		reportCallback: func(request threescale.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			for _, transaction := range request.Transactions {
+				reported[transaction.Params.AppID] += transaction.Metrics["hits"]
+			}
+			select {
+			case evictionReported <- struct{}{}:
+			default:
+			}
+		},
+	}
+	cache := NewLocalCache()
+	b := &Backend{
+		client: remote,
+		cache:  cache,
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+	b.SetMaxCachedApplications(1)
+	var evictions int32
+	b.SetEvictionCallback(func() {
+		atomic.AddInt32(&evictions, 1)
+	})
+
+	for _, appID := range []string{"first", "first", "second"} {
+		_, err := b.AuthRep(threescale.Request{
+			Auth:    api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+			Service: "testService",
+			Transactions: []api.Transaction{
+				{
+					Metrics: api.Metrics{"hits": 1},
+					Params:  api.Params{AppID: appID},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	select {
+	case <-evictionReported:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the usage of the evicted application to be reported")
+	}
+
+	equals(t, int32(1), atomic.LoadInt32(&evictions))
+	equals(t, []string{"testService_second"}, cache.Keys())
+
+	b.Flush()
+	lock.Lock()
+	defer lock.Unlock()
+	equals(t, map[string]int{"first": 2, "second": 1}, reported)
+}
+
+func TestBackend_FlushWaitsForEviction(t *testing.T) {
+	var lock sync.Mutex
+	reported := make(map[string]int)
+	remote := &mockRemoteClient{
+		authRes: &threescale.AuthorizeResult{
+			Authorized: true,
+			UsageReports: api.UsageReports{
+				"hits": []api.UsageReport{
+					{
+						PeriodWindow: api.PeriodWindow{Period: api.Minute},
+						MaxValue:     100,
+					},
+				},
+			},
+		},
+		reportCallback: func(request threescale.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			for _, transaction := range request.Transactions {
+				reported[transaction.Params.AppID] += transaction.Metrics["hits"]
+			}
+		},
+	}
+	b := &Backend{
+		client: remote,
+		cache:  NewLocalCache(),
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+	b.SetMaxCachedApplications(1)
+
+	// holding the flush lock keeps the eviction from starting to report until the flush has been requested
+	b.flushLock.Lock()
+	for _, appID := range []string{"first", "second"} {
+		if _, err := b.AuthRep(threescale.Request{
+			Auth:         api.ClientAuth{Type: api.ProviderKey, Value: "any"},
+			Service:      "testService",
+			Transactions: []api.Transaction{{Metrics: api.Metrics{"hits": 1}, Params: api.Params{AppID: appID}}},
+		}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		b.Flush()
+		close(flushed)
+	}()
+	b.flushLock.Unlock()
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected flush to complete")
+	}
+	if atomic.LoadInt32(&b.evicting) != 0 {
+		t.Errorf("expected the eviction to have completed once the flush returned")
+	}
+	equals(t, []string{"testService_second"}, b.cache.Keys())
+	lock.Lock()
+	defer lock.Unlock()
+	equals(t, map[string]int{"first": 1, "second": 1}, reported)
+}
+
 func TestBackend_GetPeer(t *testing.T) {
 	mc := &mockRemoteClient{}
 	b := &Backend{
@@ -1671,6 +2343,19 @@ func newLimitCounter(t *testing.T, metric string, period api.Period, current, ma
 }
 
 // mocks and helpers *****************
+// assertCurrentWindows fails the test if any of the usage reports has a window which does not contain the current time
+func assertCurrentWindows(t *testing.T, reports api.UsageReports) {
+	t.Helper()
+	now := time.Now().Unix()
+	for metric, metricReports := range reports {
+		for _, report := range metricReports {
+			if report.PeriodWindow.Start > now || report.PeriodWindow.End <= now {
+				t.Errorf("expected window of %s to contain the current time, got %+v", metric, report.PeriodWindow)
+			}
+		}
+	}
+}
+
 type mockRemoteClient struct {
 	// error from authorization call, default nil
 	authzErr error
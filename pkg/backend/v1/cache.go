@@ -1,6 +1,11 @@
 package backend
 
-import "github.com/orcaman/concurrent-map"
+import (
+	"container/list"
+	"sync"
+
+	"github.com/orcaman/concurrent-map"
+)
 
 // Cacheable defines the required behaviour of a Backend cache
 // The cache key should be in the format of '<serviceID>_<applicationID>'
@@ -13,6 +18,13 @@ type Cacheable interface {
 	Keys() []string
 }
 
+// Deletable is implemented by caches which support removing entries, which is required to limit the number of
+// applications cached by a Backend
+type Deletable interface {
+	// Delete the entry for the provided key, if any
+	Delete(key string)
+}
+
 // LocalCache is an implementation of Cacheable providing an in-memory cache
 type LocalCache struct {
 	ds cmap.ConcurrentMap
@@ -44,3 +56,54 @@ func (l LocalCache) Set(cacheKey string, app *Application) {
 func (l LocalCache) Keys() []string {
 	return l.ds.Keys()
 }
+
+// Delete entries for LocalCache
+func (l LocalCache) Delete(cacheKey string) {
+	l.ds.Remove(cacheKey)
+}
+
+// lruTracker records the order in which cache keys were last used
+type lruTracker struct {
+	order    *list.List
+	elements map[string]*list.Element
+	sync.Mutex
+}
+
+func newLRUTracker() *lruTracker {
+	return &lruTracker{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+// touch marks the key as the most recently used, tracking it if it is not already known
+// Returns the number of tracked keys
+func (l *lruTracker) touch(key string) int {
+	l.Lock()
+	defer l.Unlock()
+
+	if element, ok := l.elements[key]; ok {
+		l.order.MoveToFront(element)
+	} else {
+		l.elements[key] = l.order.PushFront(key)
+	}
+	return l.order.Len()
+}
+
+// len returns the number of tracked keys
+func (l *lruTracker) len() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.order.Len()
+}
+
+// popOver stops tracking, and returns, the least recently used keys until no more than max keys are tracked
+func (l *lruTracker) popOver(max int) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	var keys []string
+	for l.order.Len() > max {
+		key := l.order.Remove(l.order.Back()).(string)
+		delete(l.elements, key)
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -117,3 +117,31 @@ func TestLocalCache(t *testing.T) {
 		t.Errorf("Unlimited counter result unexpected, wanted 1 but got %d", val)
 	}
 }
+
+func TestLocalCache_Delete(t *testing.T) {
+	const cacheKey = "testKey"
+	cache := NewLocalCache()
+
+	cache.Set(cacheKey, &Application{})
+	cache.Delete(cacheKey)
+	if _, ok := cache.Get(cacheKey); ok {
+		t.Errorf("expected entry to have been deleted")
+	}
+	// deleting an unknown key is a no-op
+	cache.Delete("unknown")
+}
+
+func TestLRUTracker(t *testing.T) {
+	lru := newLRUTracker()
+	for _, key := range []string{"one", "two", "three"} {
+		lru.touch(key)
+	}
+	// the oldest key becomes the most recently used
+	if n := lru.touch("one"); n != 3 {
+		t.Errorf("unexpected number of tracked keys %d", n)
+	}
+
+	equals(t, []string{"two"}, lru.popOver(2))
+	equals(t, []string{"three", "one"}, lru.popOver(0))
+	equals(t, 0, lru.len())
+}
@@ -91,8 +91,10 @@ func getEmptyAuthRequest(service api.Service, auth api.ClientAuth, params api.Pa
 	}
 }
 
+// parseCacheKey splits the key on the first separator only, since the application, and in particular the user id
+// of keys segmented per user, may itself contain the separator
 func parseCacheKey(cacheKey string) (service api.Service, application string, err error) {
-	parsed := strings.Split(cacheKey, "_")
+	parsed := strings.SplitN(cacheKey, "_", 2)
 
 	if len(parsed) != 2 {
 		return service, application, fmt.Errorf("error parsing key")
@@ -202,32 +204,45 @@ func contains(key string, in []string) bool {
 	return false
 }
 
-// todo - this function is currently safe to use because we only provide it with timestamps and
-// deadlines that have been learned from 3scale backend. This means they are already correctly set
-// at the beginning of a specific period. That is to say, for example f(hour, 12:23:39) => 12:00:00 to 12:59:59
-// an hour has been passed through func f and its timestamp set to 12:00:00 and deadline to 12:59:59
-// This works because we only check deadlines on successful auth responses. *When* we provide adjustments for other
-// use cases, f(granularity api.Period, timestamp int64) will need to be created.
-func hasSurpassedDeadline(timestamp int64, granularity api.Period, endTimestamp int64) bool {
-	deadline := time.Unix(endTimestamp, 0)
-	switch granularity {
+// hasPeriodElapsed returns true if the window of the given period which contains timestamp, aligned as configured by
+// alignment, has ended by endTimestamp. Eternity never elapses
+func hasPeriodElapsed(period api.Period, timestamp int64, endTimestamp int64, alignment WindowAlignment) bool {
+	window, ok := periodWindowAt(period, time.Unix(timestamp, 0), alignment)
+	return ok && endTimestamp >= window.End
+}
+
+// periodWindowAt returns the window of the given period which contains t, aligned to the calendar as configured by
+// alignment. The zero value aligns windows in UTC, with weeks starting on Monday, matching the fixed windows used by
+// apisonator. The end of the window is the time at which the period resets. Returns false for eternity, which never resets
+func periodWindowAt(period api.Period, t time.Time, alignment WindowAlignment) (api.PeriodWindow, bool) {
+	loc := alignment.location()
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+
+	var start, end time.Time
+	switch period {
 	case api.Minute:
-		return time.Unix(timestamp, 0).Add(time.Minute).After(deadline)
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		end = start.Add(time.Minute)
 	case api.Hour:
-		return time.Unix(timestamp, 0).Add(time.Hour).After(deadline)
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		end = start.Add(time.Hour)
 	case api.Day:
-		return time.Unix(timestamp, 0).AddDate(0, 0, 1).After(deadline)
+		start = day
+		end = start.AddDate(0, 0, 1)
 	case api.Week:
-		// todo - needs revisiting as may not be technically correct with the way 3scale handles weeks
-		// time.Unix(timestamp, 0).AddDate(0, 0, 7).After(deadline)
-		return false
+		start = day.AddDate(0, 0, -alignment.daysSinceWeekStart(t.Weekday()))
+		end = start.AddDate(0, 0, 7)
 	case api.Month:
-		return time.Unix(timestamp, 0).AddDate(0, 1, 0).After(deadline)
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
 	case api.Year:
-		return time.Unix(timestamp, 0).AddDate(1, 0, 0).After(deadline)
+		start = time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(1, 0, 0)
 	default:
-		return false
+		return api.PeriodWindow{}, false
 	}
+	return api.PeriodWindow{Period: period, Start: start.Unix(), End: end.Unix()}, true
 }
 
 // newApplication creates a new, empty application with maps initialised
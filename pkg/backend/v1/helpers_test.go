@@ -2,6 +2,7 @@ package backend
 
 import (
 	"testing"
+	"time"
 
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -217,6 +218,12 @@ func Test_ParseCacheKey(t *testing.T) {
 			expectService: "svc",
 			expectApp:     "app",
 		},
+		{
+			name:          "Test user id containing the separator",
+			key:           "svc_app:user_with_underscores",
+			expectService: "svc",
+			expectApp:     "app:user_with_underscores",
+		},
 	}
 
 	for _, test := range tests {
@@ -456,3 +463,165 @@ func TestGetDifferenceBetweenSets(t *testing.T) {
 	got = getDifferenceBetweenSets(destinationReports, sourceReports)
 	equals(t, expect, got)
 }
+
+func Test_PeriodWindowAt(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("invalid time %s", value)
+		}
+		return parsed
+	}
+	india := WindowAlignment{Location: time.FixedZone("IST", 5*60*60+30*60)}
+
+	inputs := []struct {
+		name        string
+		period      api.Period
+		alignment   WindowAlignment
+		at          time.Time
+		expectStart time.Time
+		expectReset time.Time
+	}{
+		{
+			name:        "Test minute at the end of its window",
+			period:      api.Minute,
+			at:          at("2020-06-15T12:00:59Z"),
+			expectStart: at("2020-06-15T12:00:00Z"),
+			expectReset: at("2020-06-15T12:01:00Z"),
+		},
+		{
+			name:        "Test minute at the start of its window",
+			period:      api.Minute,
+			at:          at("2020-06-15T12:01:00Z"),
+			expectStart: at("2020-06-15T12:01:00Z"),
+			expectReset: at("2020-06-15T12:02:00Z"),
+		},
+		{
+			name:        "Test hour at the end of its window",
+			period:      api.Hour,
+			at:          at("2020-06-15T12:59:59Z"),
+			expectStart: at("2020-06-15T12:00:00Z"),
+			expectReset: at("2020-06-15T13:00:00Z"),
+		},
+		{
+			name:        "Test day resets at midnight UTC",
+			period:      api.Day,
+			at:          at("2020-06-15T23:59:59Z"),
+			expectStart: at("2020-06-15T00:00:00Z"),
+			expectReset: at("2020-06-16T00:00:00Z"),
+		},
+		{
+			name:        "Test day is aligned to UTC regardless of location",
+			period:      api.Day,
+			at:          at("2020-06-15T22:30:00-05:00"),
+			expectStart: at("2020-06-16T00:00:00Z"),
+			expectReset: at("2020-06-17T00:00:00Z"),
+		},
+		{
+			name:        "Test week ending on Sunday",
+			period:      api.Week,
+			at:          at("2020-06-14T23:59:59Z"),
+			expectStart: at("2020-06-08T00:00:00Z"),
+			expectReset: at("2020-06-15T00:00:00Z"),
+		},
+		{
+			name:        "Test week starting on Monday",
+			period:      api.Week,
+			at:          at("2020-06-15T00:00:00Z"),
+			expectStart: at("2020-06-15T00:00:00Z"),
+			expectReset: at("2020-06-22T00:00:00Z"),
+		},
+		{
+			name:        "Test month at the end of February in a leap year",
+			period:      api.Month,
+			at:          at("2020-02-29T23:59:59Z"),
+			expectStart: at("2020-02-01T00:00:00Z"),
+			expectReset: at("2020-03-01T00:00:00Z"),
+		},
+		{
+			name:        "Test month and year at the end of the year",
+			period:      api.Year,
+			at:          at("2020-12-31T23:59:59Z"),
+			expectStart: at("2020-01-01T00:00:00Z"),
+			expectReset: at("2021-01-01T00:00:00Z"),
+		},
+		{
+			name:        "Test minute aligned in a location with a half hour offset",
+			period:      api.Minute,
+			alignment:   india,
+			at:          at("2020-06-15T12:00:59Z"),
+			expectStart: at("2020-06-15T12:00:00Z"),
+			expectReset: at("2020-06-15T12:01:00Z"),
+		},
+		{
+			name:        "Test hour aligned in a location with a half hour offset",
+			period:      api.Hour,
+			alignment:   india,
+			at:          at("2020-06-15T12:59:59Z"),
+			expectStart: at("2020-06-15T18:00:00+05:30"),
+			expectReset: at("2020-06-15T19:00:00+05:30"),
+		},
+		{
+			name:        "Test day resets at local midnight",
+			period:      api.Day,
+			alignment:   india,
+			at:          at("2020-06-15T20:00:00Z"),
+			expectStart: at("2020-06-16T00:00:00+05:30"),
+			expectReset: at("2020-06-17T00:00:00+05:30"),
+		},
+		{
+			name:        "Test week starts on local Monday",
+			period:      api.Week,
+			alignment:   india,
+			at:          at("2020-06-14T20:00:00Z"),
+			expectStart: at("2020-06-15T00:00:00+05:30"),
+			expectReset: at("2020-06-22T00:00:00+05:30"),
+		},
+		{
+			name:        "Test week starting on Sunday",
+			period:      api.Week,
+			alignment:   WindowAlignment{WeekStartsOnSunday: true},
+			at:          at("2020-06-15T12:00:00Z"),
+			expectStart: at("2020-06-14T00:00:00Z"),
+			expectReset: at("2020-06-21T00:00:00Z"),
+		},
+		{
+			name:        "Test week starting on Sunday on a Sunday",
+			period:      api.Week,
+			alignment:   WindowAlignment{WeekStartsOnSunday: true},
+			at:          at("2020-06-21T00:00:00Z"),
+			expectStart: at("2020-06-21T00:00:00Z"),
+			expectReset: at("2020-06-28T00:00:00Z"),
+		},
+		{
+			name:        "Test month resets at local midnight on the first",
+			period:      api.Month,
+			alignment:   WindowAlignment{Location: time.FixedZone("EST", -5*60*60)},
+			at:          at("2020-03-01T02:00:00Z"),
+			expectStart: at("2020-02-01T00:00:00-05:00"),
+			expectReset: at("2020-03-01T00:00:00-05:00"),
+		},
+		{
+			name:        "Test year resets at local midnight on new year",
+			period:      api.Year,
+			alignment:   india,
+			at:          at("2020-12-31T20:00:00Z"),
+			expectStart: at("2021-01-01T00:00:00+05:30"),
+			expectReset: at("2022-01-01T00:00:00+05:30"),
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			window, ok := periodWindowAt(input.period, input.at, input.alignment)
+			if !ok {
+				t.Fatalf("expected a window for period %v", input.period)
+			}
+			equals(t, api.PeriodWindow{Period: input.period, Start: input.expectStart.Unix(), End: input.expectReset.Unix()}, window)
+		})
+	}
+
+	if _, ok := periodWindowAt(api.Eternity, time.Now(), WindowAlignment{}); ok {
+		t.Errorf("expected eternity to never reset")
+	}
+}
@@ -3,6 +3,8 @@ package cache
 
 import (
 	"errors"
+	"math"
+	"math/rand"
 	"sync/atomic"
 	"time"
 
@@ -22,7 +24,11 @@ const (
 	DefaultCacheLimit = -1
 )
 
-var now = time.Now
+// now and randFloat64 can be replaced in tests to control expiry
+var (
+	now         = time.Now
+	randFloat64 = rand.Float64
+)
 
 // ConfigurationCache is the interface for managing a cache of `Proxy Config` resource(s)
 type ConfigurationCache interface {
@@ -33,13 +39,22 @@ type ConfigurationCache interface {
 	Delete(key string)
 	FlushExpired()
 	Refresh()
+	// Keys returns a list of keys for all cached items
+	Keys() []string
 }
 
 // Value defines the value that must be stored in the cache
 type Value struct {
 	Item        client.ProxyConfig
+	cachedAt    time.Time
 	expires     time.Time
 	refreshWith RefreshCb
+	// refreshFailures counts the refresh attempts which have failed since the value was last written
+	refreshFailures int
+	// nextRefresh is the time before which a value which has failed to refresh is not refreshed again
+	nextRefresh time.Time
+	// tolerance is the clock skew tolerance of the cache the value was read from, which pads its expiry
+	tolerance time.Duration
 }
 
 // ConfigCache provides an in-memory solution which implements 'ConfigurationCache'
@@ -49,8 +64,19 @@ type ConfigCache struct {
 	refreshWorkerRunning int32
 	stopRefreshWorker    chan struct{}
 	ttl                  time.Duration
+	// clockSkewTolerance pads the expiry of values when checking if they have expired
+	clockSkewTolerance time.Duration
+	// ttlJitterPercent is the maximum percentage by which the ttl of each value is randomly reduced
+	ttlJitterPercent int
+	// refreshBackoff and maxRefreshBackoff delay the refresh of values which have failed to refresh
+	refreshBackoff    time.Duration
+	maxRefreshBackoff time.Duration
 }
 
+// ErrDeleted may be returned, wrapped, by a RefreshCb to indicate that the cached resource no longer exists
+// Refresh evicts such elements immediately rather than leaving them in the cache to expire
+var ErrDeleted = errors.New("cached resource has been deleted")
+
 // RefreshCb defines a callback which can be used to refresh elements in the cache as required
 type RefreshCb func() (client.ProxyConfig, error)
 
@@ -81,13 +107,18 @@ func (scp *ConfigCache) Get(key string) (Value, bool) {
 	if !ok {
 		return Value{}, ok
 	}
-	return value.(Value), ok
+	v := value.(Value)
+	v.tolerance = scp.clockSkewTolerance
+	return v, ok
 }
 
 // Set an item in the cache under the provided key
 // Returns an error if the max number of entries in the cache has been reached
 func (scp *ConfigCache) Set(key string, v Value) error {
 	if scp.limit < 0 || scp.cache.Count() < scp.limit {
+		if v.cachedAt.IsZero() {
+			v.cachedAt = now()
+		}
 		if v.expires.IsZero() {
 			v.expires = scp.getExpiryTime()
 		}
@@ -103,6 +134,11 @@ func (scp *ConfigCache) Delete(key string) {
 	scp.cache.Remove(key)
 }
 
+// Keys returns a list of keys for all cached items
+func (scp *ConfigCache) Keys() []string {
+	return scp.cache.Keys()
+}
+
 // FlushExpired elements from the cache
 // Any element whose expiration date is passed the current time will be removed immediately
 func (scp *ConfigCache) FlushExpired() {
@@ -110,7 +146,8 @@ func (scp *ConfigCache) FlushExpired() {
 
 	scp.cache.IterCb(func(key string, v interface{}) {
 		item := v.(Value)
-		if item.isExpired() {
+		item.tolerance = scp.clockSkewTolerance
+		if item.Expired() {
 			forDeletion = append(forDeletion, key)
 		}
 	})
@@ -121,19 +158,37 @@ func (scp *ConfigCache) FlushExpired() {
 
 // Refresh elements in the cache using the provided callback
 // Elements whose callback returns an error will not be refreshed but wil be left in the cache to expire
+// The failure is recorded against the element and is reset by the next successful refresh
+// Elements whose callback returns an error wrapping ErrDeleted are removed from the cache
+// If a refresh backoff is set, elements which have failed to refresh are skipped until their backoff has passed
 func (scp *ConfigCache) Refresh() {
 	refreshItems := make(map[string]Value)
+	var forDeletion []string
 
 	scp.cache.IterCb(func(key string, v interface{}) {
 		item := v.(Value)
 		if item.refreshWith != nil {
+			if now().Before(item.nextRefresh) {
+				return
+			}
+
 			resp, err := item.refreshWith()
+			if errors.Is(err, ErrDeleted) {
+				forDeletion = append(forDeletion, key)
+				return
+			}
 			if err != nil {
+				item.refreshFailures++
+				if scp.refreshBackoff > 0 {
+					item.nextRefresh = now().Add(scp.backoffAfter(item.refreshFailures))
+				}
+				refreshItems[key] = item
 				return
 			}
 
 			value := Value{
 				Item:        resp,
+				cachedAt:    now(),
 				expires:     scp.getExpiryTime(),
 				refreshWith: item.refreshWith,
 			}
@@ -143,6 +198,9 @@ func (scp *ConfigCache) Refresh() {
 	for k, v := range refreshItems {
 		scp.Set(k, v)
 	}
+	for _, key := range forDeletion {
+		scp.Delete(key)
+	}
 }
 
 // RunRefreshWorker at increments provided by the interval
@@ -168,8 +226,64 @@ func (scp *ConfigCache) RunRefreshWorker(interval time.Duration, stop chan struc
 	return nil
 }
 
+// SetClockSkewTolerance pads the expiry of cached values such that a value is not considered expired until
+// its TTL plus the tolerance has passed. This smooths out inconsistent eviction across replicas whose clocks
+// are skewed, at the cost of serving values for slightly longer than the TTL.
+func (scp *ConfigCache) SetClockSkewTolerance(tolerance time.Duration) *ConfigCache {
+	scp.clockSkewTolerance = tolerance
+	return scp
+}
+
+// SetTTLJitter randomly reduces the TTL of each value written to the cache by up to the provided percentage
+// of the TTL, such that values cached at the same time do not all expire and need refreshing at the same time.
+// The percentage is clamped to the range 0 to 100, with 0 disabling jitter.
+func (scp *ConfigCache) SetTTLJitter(percent int) *ConfigCache {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	scp.ttlJitterPercent = percent
+	return scp
+}
+
+// SetRefreshBackoff delays the refresh of values which have failed to refresh, such that a value which keeps failing
+// is refreshed at a progressively slower cadence rather than on every call to Refresh. After n consecutive failures
+// a value is not refreshed again until base * 2^(n-1) has passed, capped at max if max is greater than zero.
+// The normal cadence resumes once the value is refreshed successfully. A base of zero disables the backoff.
+func (scp *ConfigCache) SetRefreshBackoff(base, max time.Duration) *ConfigCache {
+	scp.refreshBackoff = base
+	scp.maxRefreshBackoff = max
+	return scp
+}
+
+// backoffAfter returns the delay before a value which has failed to refresh the provided number of times is retried
+func (scp *ConfigCache) backoffAfter(failures int) time.Duration {
+	backoff := scp.refreshBackoff
+	for i := 1; i < failures; i++ {
+		if scp.maxRefreshBackoff > 0 && backoff >= scp.maxRefreshBackoff {
+			break
+		}
+		// guard against overflow when no maximum is set
+		if backoff > math.MaxInt64/2 {
+			break
+		}
+		backoff *= 2
+	}
+	if scp.maxRefreshBackoff > 0 && backoff > scp.maxRefreshBackoff {
+		backoff = scp.maxRefreshBackoff
+	}
+	return backoff
+}
+
 func (scp *ConfigCache) getExpiryTime() time.Time {
-	return now().Add(scp.ttl)
+	ttl := scp.ttl
+	if scp.ttlJitterPercent > 0 {
+		window := float64(ttl) * float64(scp.ttlJitterPercent) / 100
+		ttl -= time.Duration(window * randFloat64())
+	}
+	return now().Add(ttl)
 }
 
 // SetExpiry time on a value to override the default expiry time set by the caching implementation
@@ -178,13 +292,30 @@ func (v *Value) SetExpiry(t time.Time) *Value {
 	return v
 }
 
+// Expiry returns the time at which the value will be marked as expired
+// For values read from the cache, this is padded by the clock skew tolerance of the cache
+func (v Value) Expiry() time.Time {
+	return v.expires.Add(v.tolerance)
+}
+
+// Expired returns true once the expiry of the value, including any clock skew tolerance, has passed
+func (v Value) Expired() bool {
+	return now().After(v.Expiry())
+}
+
+// CachedAt returns the time at which the value was last written to the cache
+func (v Value) CachedAt() time.Time {
+	return v.cachedAt
+}
+
+// RefreshFailures returns the number of consecutive failed attempts to refresh the value
+func (v Value) RefreshFailures() int {
+	return v.refreshFailures
+}
+
 // SetRefreshCallback, the callback that will be used to attempt to refresh an element when requested
 // Retry and backoff logic should be implemented in the callback as required.
 func (v *Value) SetRefreshCallback(fn RefreshCb) *Value {
 	v.refreshWith = fn
 	return v
 }
-
-func (v Value) isExpired() bool {
-	return now().After(v.expires)
-}
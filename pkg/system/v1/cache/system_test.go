@@ -1,7 +1,11 @@
 package cache
 
 import (
+	"fmt"
+	"math/rand"
 	"net/http"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -69,6 +73,25 @@ func TestConfigCache_Delete(t *testing.T) {
 	}
 }
 
+func TestConfigCache_Keys(t *testing.T) {
+	cc := NewDefaultConfigCache()
+	if len(cc.Keys()) != 0 {
+		t.Error("expected new cache to have no keys")
+	}
+
+	cc.Set("one", Value{})
+	cc.Set("two", Value{})
+	if len(cc.Keys()) != 2 {
+		t.Error("expected a key for each cached item")
+	}
+
+	cc.Delete("one")
+	keys := cc.Keys()
+	if len(keys) != 1 || keys[0] != "two" {
+		t.Error("expected deleted item to be removed from keys")
+	}
+}
+
 func TestConfigCache_FlushExpired(t *testing.T) {
 	cc := NewDefaultConfigCache()
 
@@ -87,6 +110,119 @@ func TestConfigCache_FlushExpired(t *testing.T) {
 	}
 }
 
+func TestConfigCache_ClockSkewTolerance(t *testing.T) {
+	defer func() { now = time.Now }()
+
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	cc := NewConfigCache(time.Minute, DefaultCacheLimit).SetClockSkewTolerance(time.Second * 10)
+	cc.Set("test", Value{Item: client.ProxyConfig{ID: 5}})
+
+	inputs := []struct {
+		name          string
+		elapsed       time.Duration
+		expectExpired bool
+	}{
+		{
+			name:    "Test value is retained before TTL has passed",
+			elapsed: time.Second * 30,
+		},
+		{
+			name:    "Test value is retained within tolerance after TTL has passed",
+			elapsed: time.Minute + time.Second*5,
+		},
+		{
+			name:          "Test value is expired once TTL and tolerance have passed",
+			elapsed:       time.Minute + time.Second*11,
+			expectExpired: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			now = func() time.Time { return start.Add(input.elapsed) }
+			if value, ok := cc.Get("test"); !ok || value.Expired() != input.expectExpired {
+				t.Errorf("unexpected expiry of value after %s", input.elapsed)
+			}
+			cc.FlushExpired()
+
+			if _, ok := cc.Get("test"); ok == input.expectExpired {
+				t.Errorf("unexpected presence of value after %s", input.elapsed)
+			}
+		})
+	}
+}
+
+func TestConfigCache_TTLJitter(t *testing.T) {
+	defer func() {
+		now = time.Now
+		randFloat64 = rand.Float64
+	}()
+
+	const entries = 100
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	inputs := []struct {
+		name          string
+		jitterPercent int
+		expectWindow  time.Duration
+	}{
+		{
+			name:          "Test no jitter by default",
+			jitterPercent: 0,
+			expectWindow:  0,
+		},
+		{
+			name:          "Test expiry spread across jitter window",
+			jitterPercent: 20,
+			expectWindow:  time.Second * 12,
+		},
+		{
+			name:          "Test jitter clamped to the TTL",
+			jitterPercent: 150,
+			expectWindow:  time.Minute,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int
+			// spread the random values evenly across [0, 1)
+			randFloat64 = func() float64 {
+				calls++
+				return float64(calls-1) / entries
+			}
+
+			cc := NewConfigCache(time.Minute, DefaultCacheLimit).SetTTLJitter(input.jitterPercent)
+			for i := 0; i < entries; i++ {
+				cc.Set(strconv.Itoa(i), Value{Item: client.ProxyConfig{ID: i}})
+			}
+
+			earliest, latest := start.Add(time.Hour), start
+			for _, key := range cc.Keys() {
+				v, _ := cc.Get(key)
+				if v.Expiry().Before(earliest) {
+					earliest = v.Expiry()
+				}
+				if v.Expiry().After(latest) {
+					latest = v.Expiry()
+				}
+			}
+
+			if !latest.Equal(start.Add(time.Minute)) {
+				t.Errorf("expected latest expiry to be the full TTL, got %s", latest.Sub(start))
+			}
+			// the last value is just short of the edge of the window
+			minExpiry := start.Add(time.Minute - input.expectWindow)
+			if earliest.Before(minExpiry) || earliest.Sub(minExpiry) > input.expectWindow/entries {
+				t.Errorf("expected earliest expiry close to %s, got %s", minExpiry.Sub(start), earliest.Sub(start))
+			}
+		})
+	}
+}
+
 func TestConfigCache_Refresh(t *testing.T) {
 	cc := NewDefaultConfigCache()
 
@@ -106,6 +242,9 @@ func TestConfigCache_Refresh(t *testing.T) {
 	if updatedV.Item.ID != 5 {
 		t.Error("unexpected result. expected callback to have modified ID when refreshing")
 	}
+	if updatedV.RefreshFailures() != 1 {
+		t.Error("expected failed refresh to be recorded")
+	}
 
 	// test refresh success
 	refreshCb = func() (client.ProxyConfig, error) {
@@ -123,6 +262,117 @@ func TestConfigCache_Refresh(t *testing.T) {
 	if updatedV.Item.ID != 6 {
 		t.Error("unexpected result. expected callback to have modified ID when refreshing")
 	}
+	if updatedV.RefreshFailures() != 0 {
+		t.Error("expected successful refresh to reset failures")
+	}
+
+	// test deleted element is evicted
+	refreshCb = func() (client.ProxyConfig, error) {
+		return client.ProxyConfig{}, fmt.Errorf("service is gone - %w", ErrDeleted)
+	}
+	v = Value{Item: client.ProxyConfig{ID: 5}}
+	v.SetRefreshCallback(refreshCb)
+
+	cc.Set("test", v)
+	cc.Refresh()
+	if _, ok := cc.Get("test"); ok {
+		t.Error("expected deleted element to be evicted")
+	}
+}
+
+func TestConfigCache_RefreshBackoff(t *testing.T) {
+	start := time.Now()
+	elapsed := time.Duration(0)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return start.Add(elapsed) }
+
+	cc := NewDefaultConfigCache().SetRefreshBackoff(time.Minute, time.Minute*4)
+
+	var attempts []time.Duration
+	failing := true
+	v := Value{Item: client.ProxyConfig{ID: 5}}
+	v.SetRefreshCallback(func() (client.ProxyConfig, error) {
+		attempts = append(attempts, elapsed)
+		if failing {
+			return client.ProxyConfig{}, http.ErrHandlerTimeout
+		}
+		return client.ProxyConfig{ID: 6}, nil
+	})
+	cc.Set("test", v)
+
+	// refresh every 30 seconds, the backoff doubles after each failure up to the maximum of four minutes
+	for ; elapsed <= time.Minute*11; elapsed += time.Second * 30 {
+		cc.Refresh()
+	}
+	expect := []time.Duration{0, time.Minute, time.Minute * 3, time.Minute * 7, time.Minute * 11}
+	if !reflect.DeepEqual(attempts, expect) {
+		t.Fatalf("unexpected refresh attempts, wanted %v but got %v", expect, attempts)
+	}
+	if value, _ := cc.Get("test"); value.RefreshFailures() != len(expect) {
+		t.Errorf("expected %d failures but got %d", len(expect), value.RefreshFailures())
+	}
+
+	// once the value refreshes successfully it is refreshed on every call again
+	failing = false
+	elapsed = time.Minute * 15
+	attempts = nil
+	for i := 0; i < 3; i++ {
+		cc.Refresh()
+		elapsed += time.Second * 30
+	}
+	if len(attempts) != 3 {
+		t.Errorf("expected normal cadence to resume after a successful refresh, got attempts %v", attempts)
+	}
+	if value, _ := cc.Get("test"); value.Item.ID != 6 || value.RefreshFailures() != 0 {
+		t.Errorf("unexpected value after successful refresh %+v", value)
+	}
+}
+
+func TestConfigCache_BackoffAfter(t *testing.T) {
+	inputs := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		failures int
+		expect   time.Duration
+	}{
+		{
+			name:     "Test first failure waits for the base",
+			base:     time.Second,
+			max:      time.Minute,
+			failures: 1,
+			expect:   time.Second,
+		},
+		{
+			name:     "Test backoff doubles",
+			base:     time.Second,
+			max:      time.Minute,
+			failures: 4,
+			expect:   time.Second * 8,
+		},
+		{
+			name:     "Test backoff is capped",
+			base:     time.Second,
+			max:      time.Minute,
+			failures: 10,
+			expect:   time.Minute,
+		},
+		{
+			name:     "Test backoff without a maximum does not overflow",
+			base:     time.Second,
+			failures: 100,
+			expect:   time.Second << 33,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			cc := NewDefaultConfigCache().SetRefreshBackoff(input.base, input.max)
+			if got := cc.backoffAfter(input.failures); got != input.expect {
+				t.Errorf("unexpected backoff, wanted %s but got %s", input.expect, got)
+			}
+		})
+	}
 }
 
 func TestConfigCache_RunRefreshWorker(t *testing.T) {